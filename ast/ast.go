@@ -14,21 +14,214 @@ type Expr interface {
 	Node
 }
 
-// CreateTableStmt is a CREATE TABLE statement node.
+// QueryStmt is a statement that produces a table: a SelectStmt,
+// CompoundSelectStmt or WithStmt.
+type QueryStmt interface {
+	Node
+}
+
+// CreateTableStmt is a CREATE TABLE statement node. Constraints includes
+// those declared as part of a column definition. For CREATE TABLE AS, Query
+// is the query and there are no columns or constraints.
 type CreateTableStmt struct {
+	StartPos    token.Pos
+	Table       *Ident
+	Temporary   bool
+	IfNotExists bool
+	Columns     []*ColumnDefinition
+	Constraints []*Constraint
+	Query       QueryStmt // nil unless CREATE TABLE AS
+}
+
+func (n *CreateTableStmt) Pos() token.Pos { return n.StartPos }
+
+// CreateViewStmt is a CREATE [OR REPLACE] VIEW or CREATE [INCREMENTAL]
+// MATERIALIZED VIEW statement node. Columns, if not empty, renames the first
+// columns of the query's result.
+type CreateViewStmt struct {
+	StartPos     token.Pos
+	OrReplace    bool
+	Materialized bool
+	Incremental  bool // maintain the materialized view as its table changes
+	Name         *Ident
+	Columns      []*Ident
+	Query        QueryStmt
+}
+
+func (n *CreateViewStmt) Pos() token.Pos { return n.StartPos }
+
+// DropViewStmt is a DROP [MATERIALIZED] VIEW statement node.
+type DropViewStmt struct {
+	StartPos     token.Pos
+	Materialized bool
+	Views        []*Ident
+	IfExists     bool
+	Cascade      bool
+}
+
+func (n *DropViewStmt) Pos() token.Pos { return n.StartPos }
+
+// RefreshStmt is a REFRESH MATERIALIZED VIEW statement node.
+type RefreshStmt struct {
+	StartPos token.Pos
+	View     *Ident
+}
+
+func (n *RefreshStmt) Pos() token.Pos { return n.StartPos }
+
+// BeginStmt is a BEGIN or START TRANSACTION statement node.
+type BeginStmt struct {
+	StartPos token.Pos
+}
+
+func (n *BeginStmt) Pos() token.Pos { return n.StartPos }
+
+// CommitStmt is a COMMIT statement node.
+type CommitStmt struct {
+	StartPos token.Pos
+}
+
+func (n *CommitStmt) Pos() token.Pos { return n.StartPos }
+
+// RollbackStmt is a ROLLBACK or ROLLBACK TO SAVEPOINT statement node.
+type RollbackStmt struct {
+	StartPos  token.Pos
+	Savepoint *Ident // nil unless ROLLBACK TO SAVEPOINT
+}
+
+func (n *RollbackStmt) Pos() token.Pos { return n.StartPos }
+
+// SavepointStmt is a SAVEPOINT statement node.
+type SavepointStmt struct {
+	StartPos token.Pos
+	Name     *Ident
+}
+
+func (n *SavepointStmt) Pos() token.Pos { return n.StartPos }
+
+// ReleaseStmt is a RELEASE SAVEPOINT statement node.
+type ReleaseStmt struct {
+	StartPos token.Pos
+	Name     *Ident
+}
+
+func (n *ReleaseStmt) Pos() token.Pos { return n.StartPos }
+
+// DropTableStmt is a DROP TABLE statement node.
+type DropTableStmt struct {
+	StartPos token.Pos
+	Tables   []*Ident
+	IfExists bool
+	Cascade  bool
+}
+
+func (n *DropTableStmt) Pos() token.Pos { return n.StartPos }
+
+// TruncateStmt is a TRUNCATE statement node.
+type TruncateStmt struct {
+	StartPos token.Pos
+	Tables   []*Ident
+}
+
+func (n *TruncateStmt) Pos() token.Pos { return n.StartPos }
+
+// AlterTableStmt is an ALTER TABLE statement node. A RENAME subcommand is
+// always the only subcommand.
+type AlterTableStmt struct {
 	StartPos token.Pos
 	Table    *Ident
-	Columns  []*ColumnDefinition
+	Cmds     []*AlterTableCmd
 }
 
-func (n *CreateTableStmt) Pos() token.Pos { return n.StartPos }
+func (n *AlterTableStmt) Pos() token.Pos { return n.StartPos }
+
+// AlterTableCmd is a subcommand of an ALTER TABLE statement node.
+type AlterTableCmd struct {
+	StartPos    token.Pos
+	Kind        AlterKind
+	Column      *Ident            // nil for AddColumn and RenameTable
+	Definition  *ColumnDefinition // AddColumn only
+	Constraints []*Constraint     // AddColumn only
+	NewName     *Ident            // RenameColumn and RenameTable only
+	Type        token.Kind        // AlterColumnType only
+	IfExists    bool              // AddColumn (IF NOT EXISTS) and DropColumn only
+	Cascade     bool              // DropColumn only
+}
+
+func (n *AlterTableCmd) Pos() token.Pos { return n.StartPos }
+
+// AlterKind is the kind of an ALTER TABLE subcommand.
+type AlterKind int
+
+const (
+	AddColumn       AlterKind = iota // ADD COLUMN
+	DropColumn                       // DROP COLUMN
+	RenameColumn                     // RENAME COLUMN ... TO
+	RenameTable                      // RENAME TO
+	AlterColumnType                  // ALTER COLUMN ... TYPE
+	SetNotNull                       // ALTER COLUMN ... SET NOT NULL
+	DropNotNull                      // ALTER COLUMN ... DROP NOT NULL
+)
+
+var alterKindNames = [...]string{
+	AddColumn:       "ADD COLUMN",
+	DropColumn:      "DROP COLUMN",
+	RenameColumn:    "RENAME COLUMN",
+	RenameTable:     "RENAME TO",
+	AlterColumnType: "ALTER COLUMN TYPE",
+	SetNotNull:      "ALTER COLUMN SET NOT NULL",
+	DropNotNull:     "ALTER COLUMN DROP NOT NULL",
+}
+
+func (k AlterKind) String() string { return alterKindNames[k] }
+
+// Constraint is a PRIMARY KEY, UNIQUE, CHECK or FOREIGN KEY constraint node.
+// For a constraint declared as part of a column definition, Columns holds
+// that column, even for a CHECK constraint.
+type Constraint struct {
+	StartPos   token.Pos
+	Name       *Ident     // nil if unnamed
+	Kind       token.Kind // Primary, Unique, Check or Foreign
+	Columns    []*Ident
+	Check      Expr      // CHECK only
+	RefTable   *Ident    // FOREIGN KEY only
+	RefColumns []*Ident  // FOREIGN KEY only; empty means the primary key
+	OnDelete   RefAction // FOREIGN KEY only
+	OnUpdate   RefAction // FOREIGN KEY only
+}
+
+func (n *Constraint) Pos() token.Pos { return n.StartPos }
+
+// RefAction is what a foreign key does to the rows that refer to a row that
+// is deleted, or whose key is updated.
+type RefAction int
+
+const (
+	NoAction   RefAction = iota // fail unless the reference is restored by the end of the statement
+	Restrict                    // fail
+	Cascade                     // delete the rows, or update their references
+	SetNull                     // set the references to null
+	SetDefault                  // set the references to their default values
+)
+
+var refActionNames = [...]string{
+	NoAction:   "NO ACTION",
+	Restrict:   "RESTRICT",
+	Cascade:    "CASCADE",
+	SetNull:    "SET NULL",
+	SetDefault: "SET DEFAULT",
+}
+
+func (a RefAction) String() string { return refActionNames[a] }
 
 // ColumnDefinition is a table column definition node.
 type ColumnDefinition struct {
-	Name     *Ident
-	Type     token.Kind // e.g. Integer, Varchar, etc.
-	Nullable bool
-	// DefaultValue Expr
+	Name            *Ident
+	Type            token.Kind // e.g. Integer, Varchar, etc.
+	Nullable        bool
+	DefaultValue    Expr // nil if none
+	AutoIncrement   bool // AUTO_INCREMENT, SERIAL or GENERATED ... AS IDENTITY
+	GeneratedAlways bool // GENERATED ALWAYS AS IDENTITY
 }
 
 func (n *ColumnDefinition) Pos() token.Pos { return n.Name.Pos() }
@@ -43,47 +236,167 @@ func (n *ColumnDefinition) Pos() token.Pos { return n.Name.Pos() }
 
 // SelectStmt is a SELECT statement node.
 type SelectStmt struct {
-	StartPos token.Pos
-	Columns  []Expr
-	Table    Expr
-	Where    Expr
+	StartPos   token.Pos
+	Distinct   bool
+	DistinctOn []Expr // DISTINCT ON (...); implies Distinct
+	Columns    []Expr
+	Table      Expr
+	Where      Expr
+	GroupBy    []Expr
+	Having     Expr
+	Windows    []*WindowDef
+	OrderBy    []*OrderingTerm
+	Limit      Expr
+	Offset     Expr
+
+	// SELECT ... INTO creates a table from the result. Only valid in a
+	// top-level statement.
+	Into          *Ident
+	IntoTemporary bool
 }
 
 func (n *SelectStmt) Pos() token.Pos { return n.StartPos }
 
+// CompoundSelectStmt combines the results of two queries with a set operator.
+// Op is one of Union, Intersect or Except. The ORDER BY, LIMIT and OFFSET
+// clauses apply to the combined result.
+type CompoundSelectStmt struct {
+	Left    QueryStmt
+	Op      token.Kind
+	All     bool
+	Right   QueryStmt
+	OrderBy []*OrderingTerm
+	Limit   Expr
+	Offset  Expr
+}
+
+func (n *CompoundSelectStmt) Pos() token.Pos { return n.Left.Pos() }
+
+// WithStmt is a query preceded by a WITH clause, which defines named temporary
+// tables (common table expressions) for use in the query.
+type WithStmt struct {
+	StartPos  token.Pos
+	Recursive bool
+	CTEs      []*CommonTableExpr
+	Query     QueryStmt
+}
+
+func (n *WithStmt) Pos() token.Pos { return n.StartPos }
+
+// CommonTableExpr is a named query in a WITH clause, as in "name (a, b) AS
+// (SELECT ...)". Columns is nil if the column names were not given.
+type CommonTableExpr struct {
+	Name    *Ident
+	Columns []*Ident
+	Query   QueryStmt
+}
+
+func (n *CommonTableExpr) Pos() token.Pos { return n.Name.Pos() }
+
+// OrderingTerm is a sort key in an ORDER BY clause.
+type OrderingTerm struct {
+	Expr       Expr
+	Desc       bool
+	NullsFirst bool
+}
+
+func (n *OrderingTerm) Pos() token.Pos { return n.Expr.Pos() }
+
+// SubqueryExpr is a parenthesized select statement that appears within an
+// expression or in a FROM clause.
+type SubqueryExpr struct {
+	StartPos token.Pos
+	Select   QueryStmt
+}
+
+func (n *SubqueryExpr) Pos() token.Pos { return n.StartPos }
+
 // SelectStarExpr represents the "*" SQL operator in a SELECT expression list.
+// If Table is not nil, the operator is qualified, as in "t.*".
 type SelectStarExpr struct {
 	StartPos token.Pos
+	Table    *Ident
 }
 
 func (n *SelectStarExpr) Pos() token.Pos { return n.StartPos }
 
-// InsertStmt is an INSERT statement node.
+// AliasedTableExpr is a table expression in a FROM clause that has been given
+// an alias, as in "FROM emp e" or "FROM emp AS e".
+type AliasedTableExpr struct {
+	Expr  Expr
+	Alias *Ident
+}
+
+func (n *AliasedTableExpr) Pos() token.Pos { return n.Expr.Pos() }
+
+// AliasedExpr is an expression in the projection of a SELECT statement that
+// has been given a name, as in "SELECT n + 1 AS m" or "SELECT n + 1 m".
+type AliasedExpr struct {
+	Expr  Expr
+	Alias *Ident
+}
+
+func (n *AliasedExpr) Pos() token.Pos { return n.Expr.Pos() }
+
+// JoinExpr is a join of two table expressions in a FROM clause. Kind is one of
+// Inner, Left, Right, Full or Cross. On is nil for cross joins.
+type JoinExpr struct {
+	Left  Expr
+	Kind  token.Kind
+	Right Expr
+	On    Expr
+}
+
+func (n *JoinExpr) Pos() token.Pos { return n.Left.Pos() }
+
+// InsertStmt is an INSERT statement node. The rows to insert are given either
+// by a VALUES list, in which case Values holds one list of expressions per
+// row, or by a query.
 type InsertStmt struct {
+	StartPos   token.Pos
+	Table      *Ident
+	Columns    []*Ident
+	Values     [][]Expr
+	Query      QueryStmt // nil if there is a VALUES list
+	OnConflict *OnConflict
+	Returning  []Expr
+}
+
+func (n *InsertStmt) Pos() token.Pos { return n.StartPos }
+
+// OnConflict is the ON CONFLICT clause of an INSERT statement, which says what
+// to do with a row that would violate a unique key: either nothing, or update
+// the existing row. Columns identifies the key, and may be empty only for DO
+// NOTHING, in which case the clause applies to every unique key.
+type OnConflict struct {
 	StartPos token.Pos
-	Table    *Ident
 	Columns  []*Ident
-	Values   []Expr
+	DoUpdate bool
+	Set      []*Ident // DO UPDATE only
+	Values   []Expr   // DO UPDATE only
+	Where    Expr     // DO UPDATE only
 }
 
-func (n *InsertStmt) Pos() token.Pos { return n.StartPos }
+func (n *OnConflict) Pos() token.Pos { return n.StartPos }
 
 // UpdateStmt is an UPDATE statement node.
 type UpdateStmt struct {
-	StartPos token.Pos
-	Table    *Ident
-	Columns  []*Ident
-	Values   []Expr
-	Where    Expr
+	StartPos  token.Pos
+	Table     *Ident
+	Columns   []*Ident
+	Values    []Expr
+	Where     Expr
+	Returning []Expr
 }
 
 func (n *UpdateStmt) Pos() token.Pos { return n.StartPos }
 
 // DeleteStmt is a DELETE statement node.
 type DeleteStmt struct {
-	StartPos token.Pos
-	Table    *Ident
-	Where    Expr
+	StartPos  token.Pos
+	Table     *Ident
+	Where     Expr
+	Returning []Expr
 }
 
 func (n *DeleteStmt) Pos() token.Pos { return n.StartPos }
@@ -96,6 +409,15 @@ type Ident struct {
 
 func (n *Ident) Pos() token.Pos { return n.NamePos }
 
+// QualifiedIdent is a column reference qualified by a table name or alias, as
+// in "e.name".
+type QualifiedIdent struct {
+	Table *Ident
+	Name  *Ident
+}
+
+func (n *QualifiedIdent) Pos() token.Pos { return n.Table.Pos() }
+
 // BinaryExpr is a binary expression node.
 type BinaryExpr struct {
 	Lhs Expr
@@ -105,6 +427,76 @@ type BinaryExpr struct {
 
 func (n *BinaryExpr) Pos() token.Pos { return n.Lhs.Pos() }
 
+// CaseExpr is a CASE expression node. If Operand is nil, the expression is a
+// "searched" CASE, and each WHEN condition is a boolean expression; otherwise,
+// each WHEN condition is a value to compare with the operand.
+type CaseExpr struct {
+	StartPos token.Pos
+	Operand  Expr
+	Whens    []*WhenClause
+	Else     Expr
+}
+
+func (n *CaseExpr) Pos() token.Pos { return n.StartPos }
+
+// WhenClause is a "WHEN condition THEN result" clause in a CASE expression.
+type WhenClause struct {
+	Cond   Expr
+	Result Expr
+}
+
+func (n *WhenClause) Pos() token.Pos { return n.Cond.Pos() }
+
+// CastExpr is a type conversion node, written as either "CAST(expr AS type)"
+// or "expr::type".
+type CastExpr struct {
+	StartPos token.Pos
+	Expr     Expr
+	Type     token.Kind // e.g. Integer, Varchar, etc.
+}
+
+func (n *CastExpr) Pos() token.Pos { return n.StartPos }
+
+// LikeExpr is a pattern-matching predicate node. Op is either Like or Ilike.
+// Escape is nil unless an ESCAPE clause was given.
+type LikeExpr struct {
+	Expr    Expr
+	Op      token.Kind
+	Pattern Expr
+	Escape  Expr
+}
+
+func (n *LikeExpr) Pos() token.Pos { return n.Expr.Pos() }
+
+// BetweenExpr is a "x BETWEEN low AND high" predicate node.
+type BetweenExpr struct {
+	Expr Expr
+	Low  Expr
+	High Expr
+}
+
+func (n *BetweenExpr) Pos() token.Pos { return n.Expr.Pos() }
+
+// TupleExpr is a parenthesized list of expressions, as in "x IN (1, 2, 3)".
+type TupleExpr struct {
+	StartPos token.Pos
+	Exprs    []Expr
+}
+
+func (n *TupleExpr) Pos() token.Pos { return n.StartPos }
+
+// IsExpr is an "IS [NOT] ..." predicate node. Kind is one of Null, True, False,
+// Unknown or Distinct; in the last case, the predicate is "IS [NOT] DISTINCT
+// FROM", and From is the right-hand operand.
+type IsExpr struct {
+	Expr Expr
+	Not  bool
+	Kind token.Kind
+	From Expr
+}
+
+func (n *IsExpr) Pos() token.Pos { return n.Expr.Pos() }
+
 // UnaryExpr is a unary expression node.
 type UnaryExpr struct {
 	StartPos token.Pos
@@ -148,9 +540,93 @@ type Null struct {
 
 func (n *Null) Pos() token.Pos { return n.ValuePos }
 
+// Default is the DEFAULT keyword in the VALUES list of an INSERT statement or
+// in a SET clause, which stands for the default value of the corresponding
+// column.
+type Default struct {
+	ValuePos token.Pos
+}
+
+func (n *Default) Pos() token.Pos { return n.ValuePos }
+
 type FunctionCall struct {
-	Name *Ident
-	Args []Expr
+	Name     *Ident
+	Distinct bool
+	Args     []Expr
+	Filter   Expr        // FILTER (WHERE ...), or nil
+	Over     *WindowSpec // non-nil if this is a window function call
 }
 
 func (n *FunctionCall) Pos() token.Pos { return n.Name.Pos() }
+
+// WindowDef is a named window in the WINDOW clause of a SELECT statement, as
+// in "WINDOW w AS (PARTITION BY x)".
+type WindowDef struct {
+	Name *Ident
+	Spec *WindowSpec
+}
+
+func (n *WindowDef) Pos() token.Pos { return n.Name.Pos() }
+
+// WindowSpec specifies the window over which a window function is computed.
+// If Name is non-nil, the window is based on the named window, from which it
+// inherits the partitioning and (unless it has its own) the ordering. Frame is
+// nil if the default frame applies.
+type WindowSpec struct {
+	StartPos    token.Pos
+	Name        *Ident
+	PartitionBy []Expr
+	OrderBy     []*OrderingTerm
+	Frame       *WindowFrame
+}
+
+func (n *WindowSpec) Pos() token.Pos { return n.StartPos }
+
+// WindowFrame is the frame clause of a window, e.g. "ROWS BETWEEN 1 PRECEDING
+// AND CURRENT ROW". If Range is false, the frame is measured in rows.
+type WindowFrame struct {
+	StartPos token.Pos
+	Range    bool
+	Start    *FrameBound
+	End      *FrameBound
+}
+
+func (n *WindowFrame) Pos() token.Pos { return n.StartPos }
+
+// FrameBound is the start or end of a window frame. Offset is non-nil only if
+// Kind is Preceding or Following.
+type FrameBound struct {
+	StartPos token.Pos
+	Kind     FrameBoundKind
+	Offset   Expr
+}
+
+func (n *FrameBound) Pos() token.Pos { return n.StartPos }
+
+// FrameBoundKind specifies the type of a window frame bound. The kinds are
+// declared in order, from the start of a partition to its end.
+type FrameBoundKind uint8
+
+const (
+	UnboundedPreceding FrameBoundKind = iota
+	Preceding
+	CurrentRow
+	Following
+	UnboundedFollowing
+)
+
+func (k FrameBoundKind) String() string {
+	switch k {
+	case UnboundedPreceding:
+		return "UNBOUNDED PRECEDING"
+	case Preceding:
+		return "PRECEDING"
+	case CurrentRow:
+		return "CURRENT ROW"
+	case Following:
+		return "FOLLOWING"
+	case UnboundedFollowing:
+		return "UNBOUNDED FOLLOWING"
+	}
+	return "INVALID"
+}
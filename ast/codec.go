@@ -0,0 +1,196 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Marshal returns an encoding of an AST as JSON, from which Unmarshal can
+// reconstruct it.
+func Marshal(node Node) ([]byte, error) {
+	return json.Marshal(encodeValue(reflect.ValueOf(&node).Elem()))
+}
+
+// Unmarshal returns the AST encoded by Marshal.
+func Unmarshal(data []byte) (Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var x interface{}
+	if err := dec.Decode(&x); err != nil {
+		return nil, err
+	}
+	var node Node
+	v, err := decodeValue(reflect.TypeOf(&node).Elem(), x)
+	if err != nil {
+		return nil, err
+	}
+	node, _ = v.Interface().(Node)
+	return node, nil
+}
+
+// The types of the nodes that may be the values of interfaces in an AST, by
+// name.
+var nodeTypes = make(map[string]reflect.Type)
+
+func init() {
+	for _, node := range []Node{
+		&CreateTableStmt{}, &CreateViewStmt{}, &DropViewStmt{}, &RefreshStmt{},
+		&BeginStmt{}, &CommitStmt{}, &RollbackStmt{}, &SavepointStmt{},
+		&ReleaseStmt{}, &DropTableStmt{}, &TruncateStmt{}, &AlterTableStmt{},
+		&AlterTableCmd{}, &Constraint{}, &ColumnDefinition{}, &SelectStmt{},
+		&CompoundSelectStmt{}, &WithStmt{}, &CommonTableExpr{}, &OrderingTerm{},
+		&SubqueryExpr{}, &SelectStarExpr{}, &AliasedTableExpr{}, &AliasedExpr{},
+		&JoinExpr{}, &InsertStmt{}, &OnConflict{}, &UpdateStmt{}, &DeleteStmt{},
+		&Ident{}, &QualifiedIdent{}, &BinaryExpr{}, &CaseExpr{}, &WhenClause{},
+		&CastExpr{}, &LikeExpr{}, &BetweenExpr{}, &TupleExpr{}, &IsExpr{},
+		&UnaryExpr{}, &IntegerLiteral{}, &NumberLiteral{}, &StringLiteral{},
+		&BooleanLiteral{}, &Null{}, &Default{}, &FunctionCall{}, &WindowDef{},
+		&WindowSpec{}, &WindowFrame{}, &FrameBound{},
+	} {
+		t := reflect.TypeOf(node)
+		nodeTypes[t.Elem().Name()] = t
+	}
+}
+
+// Returns a value that encoding/json can marshal. The value of an interface is
+// tagged with the name of its type; structs become objects without their zero
+// fields.
+func encodeValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return map[string]interface{}{"type": v.Elem().Type().Elem().Name(), "node": encodeValue(v.Elem())}
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).IsZero() {
+				m[v.Type().Field(i).Name] = encodeValue(v.Field(i))
+			}
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = encodeValue(v.Index(i))
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		// JSON numbers cannot be infinite.
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+	return v.Interface()
+}
+
+// Returns a value of type t decoded from x, the result of unmarshaling the
+// JSON encoding of a value returned by encodeValue.
+func decodeValue(t reflect.Type, x interface{}) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if x == nil {
+		return v, nil
+	}
+	fail := func() (reflect.Value, error) {
+		return v, fmt.Errorf("ast: cannot decode %v as %s", x, t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := decodeValue(t.Elem(), x)
+		if err != nil {
+			return v, err
+		}
+		v.Set(reflect.New(t.Elem()))
+		v.Elem().Set(elem)
+	case reflect.Interface:
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return fail()
+		}
+		name, _ := m["type"].(string)
+		nt, ok := nodeTypes[name]
+		if !ok || !nt.Implements(t) {
+			return v, fmt.Errorf("ast: unknown %s type %q", t, name)
+		}
+		node, err := decodeValue(nt, m["node"])
+		if err != nil {
+			return v, err
+		}
+		v.Set(node)
+	case reflect.Struct:
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return fail()
+		}
+		for name, fx := range m {
+			f, ok := t.FieldByName(name)
+			if !ok {
+				return v, fmt.Errorf("ast: %s has no field %s", t, name)
+			}
+			fv, err := decodeValue(f.Type, fx)
+			if err != nil {
+				return v, err
+			}
+			v.FieldByIndex(f.Index).Set(fv)
+		}
+	case reflect.Slice:
+		s, ok := x.([]interface{})
+		if !ok {
+			return fail()
+		}
+		v.Set(reflect.MakeSlice(t, len(s), len(s)))
+		for i, ex := range s {
+			ev, err := decodeValue(t.Elem(), ex)
+			if err != nil {
+				return v, err
+			}
+			v.Index(i).Set(ev)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := x.(json.Number)
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if !ok || err != nil || v.OverflowInt(i) {
+			return fail()
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := x.(json.Number)
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		if !ok || err != nil || v.OverflowUint(u) {
+			return fail()
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		s, ok := x.(string)
+		f, err := strconv.ParseFloat(s, 64)
+		if !ok || err != nil {
+			return fail()
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, ok := x.(string)
+		if !ok {
+			return fail()
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := x.(bool)
+		if !ok {
+			return fail()
+		}
+		v.SetBool(b)
+	default:
+		return fail()
+	}
+	return v, nil
+}
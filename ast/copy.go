@@ -0,0 +1,48 @@
+package ast
+
+import "reflect"
+
+// Copy returns a deep copy of an AST, which may be modified without affecting
+// the original.
+func Copy(node Node) Node {
+	if node == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(node)).Interface().(Node)
+}
+
+// Returns a deep copy of a value: pointers, interfaces and slices are copied
+// recursively, everything else by assignment.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
+	case reflect.Interface:
+		c := reflect.New(v.Type()).Elem()
+		if !v.IsNil() {
+			c.Set(copyValue(v.Elem()))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			c.Field(i).Set(copyValue(v.Field(i)))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	}
+	return v
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/dcowgill/toysqleval/token"
 )
 
 // PrettyPrinter is a utility for printing an AST with indentation.
@@ -19,36 +21,343 @@ func (pp *PrettyPrinter) printf(format string, args ...interface{}) {
 	fmt.Fprintf(pp.Writer, format+"\n", args...)
 }
 
+// Prints the RETURNING clause of a data-modifying statement, if any.
+func (pp *PrettyPrinter) printReturning(exprs []Expr) {
+	if len(exprs) == 0 {
+		return
+	}
+	pp.printf("RETURNING")
+	for _, child := range exprs {
+		pp.Visit(child)
+	}
+}
+
 // Visit pretty-prints the AST starting at n.
 func (pp *PrettyPrinter) Visit(n Node) {
 	pp.depth++
 
 	switch n := n.(type) {
 	case *CreateTableStmt:
-		pp.printf("CREATE TABLE")
+		create := "CREATE TABLE"
+		if n.Temporary {
+			create = "CREATE TEMPORARY TABLE"
+		}
+		if n.IfNotExists {
+			create += " IF NOT EXISTS"
+		}
+		pp.printf("%s", create)
 		pp.Visit(n.Table)
 		for _, child := range n.Columns {
 			pp.Visit(child)
 		}
+		for _, child := range n.Constraints {
+			pp.Visit(child)
+		}
+		if n.Query != nil {
+			pp.printf("AS")
+			pp.Visit(n.Query)
+		}
+
+	case *CreateViewStmt:
+		switch {
+		case n.OrReplace:
+			pp.printf("CREATE OR REPLACE VIEW")
+		case n.Incremental:
+			pp.printf("CREATE INCREMENTAL MATERIALIZED VIEW")
+		case n.Materialized:
+			pp.printf("CREATE MATERIALIZED VIEW")
+		default:
+			pp.printf("CREATE VIEW")
+		}
+		pp.Visit(n.Name)
+		for _, child := range n.Columns {
+			pp.Visit(child)
+		}
+		pp.printf("AS")
+		pp.Visit(n.Query)
+
+	case *DropViewStmt:
+		kind := "VIEW"
+		if n.Materialized {
+			kind = "MATERIALIZED VIEW"
+		}
+		switch {
+		case n.IfExists && n.Cascade:
+			pp.printf("DROP %s IF EXISTS CASCADE", kind)
+		case n.IfExists:
+			pp.printf("DROP %s IF EXISTS", kind)
+		case n.Cascade:
+			pp.printf("DROP %s CASCADE", kind)
+		default:
+			pp.printf("DROP %s", kind)
+		}
+		for _, child := range n.Views {
+			pp.Visit(child)
+		}
+
+	case *RefreshStmt:
+		pp.printf("REFRESH MATERIALIZED VIEW")
+		pp.Visit(n.View)
+
+	case *BeginStmt:
+		pp.printf("BEGIN")
+
+	case *CommitStmt:
+		pp.printf("COMMIT")
+
+	case *RollbackStmt:
+		if n.Savepoint != nil {
+			pp.printf("ROLLBACK TO SAVEPOINT")
+			pp.Visit(n.Savepoint)
+		} else {
+			pp.printf("ROLLBACK")
+		}
+
+	case *SavepointStmt:
+		pp.printf("SAVEPOINT")
+		pp.Visit(n.Name)
+
+	case *ReleaseStmt:
+		pp.printf("RELEASE SAVEPOINT")
+		pp.Visit(n.Name)
+
+	case *DropTableStmt:
+		switch {
+		case n.IfExists && n.Cascade:
+			pp.printf("DROP TABLE IF EXISTS CASCADE")
+		case n.IfExists:
+			pp.printf("DROP TABLE IF EXISTS")
+		case n.Cascade:
+			pp.printf("DROP TABLE CASCADE")
+		default:
+			pp.printf("DROP TABLE")
+		}
+		for _, child := range n.Tables {
+			pp.Visit(child)
+		}
+
+	case *TruncateStmt:
+		pp.printf("TRUNCATE")
+		for _, child := range n.Tables {
+			pp.Visit(child)
+		}
+
+	case *AlterTableStmt:
+		pp.printf("ALTER TABLE")
+		pp.Visit(n.Table)
+		for _, child := range n.Cmds {
+			pp.Visit(child)
+		}
+
+	case *AlterTableCmd:
+		switch {
+		case n.IfExists && n.Kind == AddColumn:
+			pp.printf("%s IF NOT EXISTS", n.Kind)
+		case n.IfExists:
+			pp.printf("%s IF EXISTS", n.Kind)
+		default:
+			pp.printf("%s", n.Kind)
+		}
+		if n.Column != nil {
+			pp.Visit(n.Column)
+		}
+		if n.Definition != nil {
+			pp.Visit(n.Definition)
+		}
+		for _, child := range n.Constraints {
+			pp.Visit(child)
+		}
+		if n.NewName != nil {
+			pp.printf("TO")
+			pp.Visit(n.NewName)
+		}
+		if n.Kind == AlterColumnType {
+			pp.printf("TYPE %s", n.Type)
+		}
+		if n.Cascade {
+			pp.printf("CASCADE")
+		}
+
+	case *Constraint:
+		name := ""
+		if n.Name != nil {
+			name = fmt.Sprintf(" %q", n.Name.Name)
+		}
+		switch n.Kind {
+		case token.Primary:
+			pp.printf("CONSTRAINT%s PRIMARY KEY", name)
+		case token.Foreign:
+			pp.printf("CONSTRAINT%s FOREIGN KEY", name)
+		default:
+			pp.printf("CONSTRAINT%s %s", name, n.Kind)
+		}
+		for _, child := range n.Columns {
+			pp.Visit(child)
+		}
+		if n.Check != nil {
+			pp.Visit(n.Check)
+		}
+		if n.RefTable != nil {
+			pp.printf("REFERENCES")
+			pp.Visit(n.RefTable)
+			for _, child := range n.RefColumns {
+				pp.Visit(child)
+			}
+			pp.printf("ON DELETE %s ON UPDATE %s", n.OnDelete, n.OnUpdate)
+		}
 
 	case *ColumnDefinition:
-		nullable := "Y"
+		nullable := "N"
 		if n.Nullable {
-			nullable = "N"
+			nullable = "Y"
+		}
+		switch {
+		case n.GeneratedAlways:
+			pp.printf("%q type=%-7s nullable=%s default=%s", n.Name.Name, n.Type, nullable, "GENERATED ALWAYS AS IDENTITY")
+		case n.AutoIncrement:
+			pp.printf("%q type=%-7s nullable=%s default=%s", n.Name.Name, n.Type, nullable, "AUTO_INCREMENT")
+		case n.DefaultValue != nil:
+			pp.printf("%q type=%-7s nullable=%s default=", n.Name.Name, n.Type, nullable)
+			pp.Visit(n.DefaultValue)
+		default:
+			pp.printf("%q type=%-7s nullable=%s default=%s", n.Name.Name, n.Type, nullable, "NULL")
 		}
-		pp.printf("%q type=%-7s nullable=%s default=%s", n.Name.Name, n.Type, nullable, "NULL")
 
 	case *SelectStmt:
-		pp.printf("SELECT")
+		switch {
+		case len(n.DistinctOn) != 0:
+			pp.printf("SELECT DISTINCT ON")
+			for _, child := range n.DistinctOn {
+				pp.Visit(child)
+			}
+			pp.printf("COLUMNS")
+		case n.Distinct:
+			pp.printf("SELECT DISTINCT")
+		default:
+			pp.printf("SELECT")
+		}
 		for _, child := range n.Columns {
 			pp.Visit(child)
 		}
-		pp.printf("FROM")
-		pp.Visit(n.Table)
+		if n.Into != nil {
+			if n.IntoTemporary {
+				pp.printf("INTO TEMPORARY")
+			} else {
+				pp.printf("INTO")
+			}
+			pp.Visit(n.Into)
+		}
+		if n.Table != nil {
+			pp.printf("FROM")
+			pp.Visit(n.Table)
+		}
 		if n.Where != nil {
 			pp.printf("WHERE")
 			pp.Visit(n.Where)
 		}
+		if len(n.GroupBy) != 0 {
+			pp.printf("GROUP BY")
+			for _, child := range n.GroupBy {
+				pp.Visit(child)
+			}
+		}
+		if n.Having != nil {
+			pp.printf("HAVING")
+			pp.Visit(n.Having)
+		}
+		for _, child := range n.Windows {
+			pp.Visit(child)
+		}
+		if len(n.OrderBy) != 0 {
+			pp.printf("ORDER BY")
+			for _, child := range n.OrderBy {
+				pp.Visit(child)
+			}
+		}
+		if n.Limit != nil {
+			pp.printf("LIMIT")
+			pp.Visit(n.Limit)
+		}
+		if n.Offset != nil {
+			pp.printf("OFFSET")
+			pp.Visit(n.Offset)
+		}
+
+	case *CompoundSelectStmt:
+		if n.All {
+			pp.printf("%s ALL", n.Op)
+		} else {
+			pp.printf("%s", n.Op)
+		}
+		pp.Visit(n.Left)
+		pp.Visit(n.Right)
+		if len(n.OrderBy) != 0 {
+			pp.printf("ORDER BY")
+			for _, child := range n.OrderBy {
+				pp.Visit(child)
+			}
+		}
+		if n.Limit != nil {
+			pp.printf("LIMIT")
+			pp.Visit(n.Limit)
+		}
+		if n.Offset != nil {
+			pp.printf("OFFSET")
+			pp.Visit(n.Offset)
+		}
+
+	case *WithStmt:
+		if n.Recursive {
+			pp.printf("WITH RECURSIVE")
+		} else {
+			pp.printf("WITH")
+		}
+		for _, child := range n.CTEs {
+			pp.Visit(child)
+		}
+		pp.Visit(n.Query)
+
+	case *CommonTableExpr:
+		pp.printf("CTE")
+		pp.Visit(n.Name)
+		for _, child := range n.Columns {
+			pp.Visit(child)
+		}
+		pp.Visit(n.Query)
+
+	case *OrderingTerm:
+		dir, nulls := "ASC", "LAST"
+		if n.Desc {
+			dir = "DESC"
+		}
+		if n.NullsFirst {
+			nulls = "FIRST"
+		}
+		pp.printf("%s NULLS %s", dir, nulls)
+		pp.Visit(n.Expr)
+
+	case *SubqueryExpr:
+		pp.printf("Subquery")
+		pp.Visit(n.Select)
+
+	case *AliasedTableExpr:
+		pp.printf("AS")
+		pp.Visit(n.Expr)
+		pp.Visit(n.Alias)
+
+	case *AliasedExpr:
+		pp.printf("AS")
+		pp.Visit(n.Expr)
+		pp.Visit(n.Alias)
+
+	case *JoinExpr:
+		pp.printf("%s JOIN", n.Kind)
+		pp.Visit(n.Left)
+		pp.Visit(n.Right)
+		if n.On != nil {
+			pp.printf("ON")
+			pp.Visit(n.On)
+		}
 
 	case *InsertStmt:
 		pp.printf("INSERT INTO")
@@ -57,9 +366,38 @@ func (pp *PrettyPrinter) Visit(n Node) {
 		for _, child := range n.Columns {
 			pp.Visit(child)
 		}
-		pp.printf("VALUES")
-		for _, child := range n.Values {
+		if n.Query != nil {
+			pp.Visit(n.Query)
+		}
+		for _, row := range n.Values {
+			pp.printf("VALUES")
+			for _, child := range row {
+				pp.Visit(child)
+			}
+		}
+		if n.OnConflict != nil {
+			pp.Visit(n.OnConflict)
+		}
+		pp.printReturning(n.Returning)
+
+	case *OnConflict:
+		pp.printf("ON CONFLICT")
+		for _, child := range n.Columns {
+			pp.Visit(child)
+		}
+		if !n.DoUpdate {
+			pp.printf("DO NOTHING")
+			break
+		}
+		pp.printf("DO UPDATE SET")
+		for i, child := range n.Set {
 			pp.Visit(child)
+			pp.printf("=")
+			pp.Visit(n.Values[i])
+		}
+		if n.Where != nil {
+			pp.printf("WHERE")
+			pp.Visit(n.Where)
 		}
 
 	case *UpdateStmt:
@@ -75,6 +413,7 @@ func (pp *PrettyPrinter) Visit(n Node) {
 			pp.printf("WHERE")
 			pp.Visit(n.Where)
 		}
+		pp.printReturning(n.Returning)
 
 	case *DeleteStmt:
 		pp.printf("DELETE FROM")
@@ -83,10 +422,14 @@ func (pp *PrettyPrinter) Visit(n Node) {
 			pp.printf("WHERE")
 			pp.Visit(n.Where)
 		}
+		pp.printReturning(n.Returning)
 
 	case *Ident:
 		pp.printf("Ident(%s)", n.Name)
 
+	case *QualifiedIdent:
+		pp.printf("Ident(%s.%s)", n.Table.Name, n.Name.Name)
+
 	case *BinaryExpr:
 		pp.printf("BinaryExpr(%s)", n.Op)
 		pp.Visit(n.Lhs)
@@ -96,8 +439,70 @@ func (pp *PrettyPrinter) Visit(n Node) {
 		pp.printf("UnaryExpr(%s)", n.Op)
 		pp.Visit(n.Expr)
 
+	case *CaseExpr:
+		pp.printf("CASE")
+		if n.Operand != nil {
+			pp.Visit(n.Operand)
+		}
+		for _, child := range n.Whens {
+			pp.Visit(child)
+		}
+		if n.Else != nil {
+			pp.printf("ELSE")
+			pp.Visit(n.Else)
+		}
+
+	case *WhenClause:
+		pp.printf("WHEN")
+		pp.Visit(n.Cond)
+		pp.printf("THEN")
+		pp.Visit(n.Result)
+
+	case *CastExpr:
+		pp.printf("CAST(%s)", n.Type)
+		pp.Visit(n.Expr)
+
+	case *LikeExpr:
+		pp.printf("LikeExpr(%s)", n.Op)
+		pp.Visit(n.Expr)
+		pp.Visit(n.Pattern)
+		if n.Escape != nil {
+			pp.printf("ESCAPE")
+			pp.Visit(n.Escape)
+		}
+
+	case *BetweenExpr:
+		pp.printf("BetweenExpr")
+		pp.Visit(n.Expr)
+		pp.Visit(n.Low)
+		pp.Visit(n.High)
+
+	case *TupleExpr:
+		pp.printf("TupleExpr")
+		for _, child := range n.Exprs {
+			pp.Visit(child)
+		}
+
+	case *IsExpr:
+		not := ""
+		if n.Not {
+			not = "NOT "
+		}
+		if n.Kind == token.Distinct {
+			pp.printf("IsExpr(%sDISTINCT FROM)", not)
+			pp.Visit(n.Expr)
+			pp.Visit(n.From)
+		} else {
+			pp.printf("IsExpr(%s%s)", not, n.Kind)
+			pp.Visit(n.Expr)
+		}
+
 	case *SelectStarExpr:
-		pp.printf("*")
+		if n.Table != nil {
+			pp.printf("%s.*", n.Table.Name)
+		} else {
+			pp.printf("*")
+		}
 
 	case *IntegerLiteral:
 		pp.printf("Integer(%d)", n.Value)
@@ -114,12 +519,67 @@ func (pp *PrettyPrinter) Visit(n Node) {
 	case *Null:
 		pp.printf("NULL")
 
+	case *Default:
+		pp.printf("DEFAULT")
+
 	case *FunctionCall:
-		pp.printf("FunctionCall")
+		if n.Distinct {
+			pp.printf("FunctionCall DISTINCT")
+		} else {
+			pp.printf("FunctionCall")
+		}
 		pp.Visit(n.Name)
 		for _, arg := range n.Args {
 			pp.Visit(arg)
 		}
+		if n.Filter != nil {
+			pp.printf("FILTER")
+			pp.Visit(n.Filter)
+		}
+		if n.Over != nil {
+			pp.Visit(n.Over)
+		}
+
+	case *WindowDef:
+		pp.printf("WINDOW")
+		pp.Visit(n.Name)
+		pp.Visit(n.Spec)
+
+	case *WindowSpec:
+		pp.printf("OVER")
+		if n.Name != nil {
+			pp.Visit(n.Name)
+		}
+		if len(n.PartitionBy) != 0 {
+			pp.printf("PARTITION BY")
+			for _, child := range n.PartitionBy {
+				pp.Visit(child)
+			}
+		}
+		if len(n.OrderBy) != 0 {
+			pp.printf("ORDER BY")
+			for _, child := range n.OrderBy {
+				pp.Visit(child)
+			}
+		}
+		if n.Frame != nil {
+			pp.Visit(n.Frame)
+		}
+
+	case *WindowFrame:
+		if n.Range {
+			pp.printf("RANGE")
+		} else {
+			pp.printf("ROWS")
+		}
+		pp.Visit(n.Start)
+		pp.Visit(n.End)
+
+	case *FrameBound:
+		pp.printf("%s", n.Kind)
+		if n.Offset != nil {
+			pp.Visit(n.Offset)
+		}
 
 	default:
 		panic(fmt.Sprintf("unknown node type: %t", n))
@@ -16,21 +16,184 @@ func Walk(node Node, fn WalkFunc) {
 	}
 
 	switch node := node.(type) {
+	case *CreateTableStmt:
+		Walk(node.Table, fn)
+		for _, child := range node.Columns {
+			Walk(child, fn)
+		}
+		for _, child := range node.Constraints {
+			Walk(child, fn)
+		}
+		Walk(node.Query, fn)
+
+	case *CreateViewStmt:
+		Walk(node.Name, fn)
+		for _, child := range node.Columns {
+			Walk(child, fn)
+		}
+		Walk(node.Query, fn)
+
+	case *DropViewStmt:
+		for _, child := range node.Views {
+			Walk(child, fn)
+		}
+
+	case *RefreshStmt:
+		Walk(node.View, fn)
+
+	case *RollbackStmt:
+		if node.Savepoint != nil {
+			Walk(node.Savepoint, fn)
+		}
+
+	case *SavepointStmt:
+		Walk(node.Name, fn)
+
+	case *ReleaseStmt:
+		Walk(node.Name, fn)
+
+	case *DropTableStmt:
+		for _, child := range node.Tables {
+			Walk(child, fn)
+		}
+
+	case *TruncateStmt:
+		for _, child := range node.Tables {
+			Walk(child, fn)
+		}
+
+	case *AlterTableStmt:
+		Walk(node.Table, fn)
+		for _, child := range node.Cmds {
+			Walk(child, fn)
+		}
+
+	case *AlterTableCmd:
+		if node.Column != nil {
+			Walk(node.Column, fn)
+		}
+		if node.Definition != nil {
+			Walk(node.Definition, fn)
+		}
+		for _, child := range node.Constraints {
+			Walk(child, fn)
+		}
+		if node.NewName != nil {
+			Walk(node.NewName, fn)
+		}
+
+	case *Constraint:
+		if node.Name != nil {
+			Walk(node.Name, fn)
+		}
+		for _, child := range node.Columns {
+			Walk(child, fn)
+		}
+		Walk(node.Check, fn)
+		if node.RefTable != nil {
+			Walk(node.RefTable, fn)
+		}
+		for _, child := range node.RefColumns {
+			Walk(child, fn)
+		}
+
+	case *ColumnDefinition:
+		Walk(node.Name, fn)
+		Walk(node.DefaultValue, fn)
+
 	case *SelectStmt:
+		for _, child := range node.DistinctOn {
+			Walk(child, fn)
+		}
 		for _, child := range node.Columns {
 			Walk(child, fn)
 		}
+		if node.Into != nil {
+			Walk(node.Into, fn)
+		}
 		Walk(node.Table, fn)
 		Walk(node.Where, fn)
+		for _, child := range node.GroupBy {
+			Walk(child, fn)
+		}
+		Walk(node.Having, fn)
+		for _, child := range node.Windows {
+			Walk(child, fn)
+		}
+		for _, child := range node.OrderBy {
+			Walk(child, fn)
+		}
+		Walk(node.Limit, fn)
+		Walk(node.Offset, fn)
+
+	case *CompoundSelectStmt:
+		Walk(node.Left, fn)
+		Walk(node.Right, fn)
+		for _, child := range node.OrderBy {
+			Walk(child, fn)
+		}
+		Walk(node.Limit, fn)
+		Walk(node.Offset, fn)
+
+	case *WithStmt:
+		for _, child := range node.CTEs {
+			Walk(child, fn)
+		}
+		Walk(node.Query, fn)
+
+	case *CommonTableExpr:
+		Walk(node.Name, fn)
+		for _, child := range node.Columns {
+			Walk(child, fn)
+		}
+		Walk(node.Query, fn)
+
+	case *OrderingTerm:
+		Walk(node.Expr, fn)
+
+	case *SubqueryExpr:
+		Walk(node.Select, fn)
+
+	case *AliasedTableExpr:
+		Walk(node.Expr, fn)
+		Walk(node.Alias, fn)
+
+	case *AliasedExpr:
+		Walk(node.Expr, fn)
+		Walk(node.Alias, fn)
+
+	case *JoinExpr:
+		Walk(node.Left, fn)
+		Walk(node.Right, fn)
+		Walk(node.On, fn)
 
 	case *InsertStmt:
 		Walk(node.Table, fn)
 		for _, child := range node.Columns {
 			Walk(child, fn)
 		}
-		for _, child := range node.Values {
+		for _, row := range node.Values {
+			for _, child := range row {
+				Walk(child, fn)
+			}
+		}
+		Walk(node.Query, fn)
+		if node.OnConflict != nil {
+			Walk(node.OnConflict, fn)
+		}
+		for _, child := range node.Returning {
+			Walk(child, fn)
+		}
+
+	case *OnConflict:
+		for _, child := range node.Columns {
+			Walk(child, fn)
+		}
+		for i, child := range node.Set {
 			Walk(child, fn)
+			Walk(node.Values[i], fn)
 		}
+		Walk(node.Where, fn)
 
 	case *UpdateStmt:
 		Walk(node.Table, fn)
@@ -39,10 +202,16 @@ func Walk(node Node, fn WalkFunc) {
 			Walk(node.Values[i], fn)
 		}
 		Walk(node.Where, fn)
+		for _, child := range node.Returning {
+			Walk(child, fn)
+		}
 
 	case *DeleteStmt:
 		Walk(node.Table, fn)
 		Walk(node.Where, fn)
+		for _, child := range node.Returning {
+			Walk(child, fn)
+		}
 
 	case *BinaryExpr:
 		Walk(node.Lhs, fn)
@@ -51,10 +220,72 @@ func Walk(node Node, fn WalkFunc) {
 	case *UnaryExpr:
 		Walk(node.Expr, fn)
 
+	case *CaseExpr:
+		Walk(node.Operand, fn)
+		for _, child := range node.Whens {
+			Walk(child, fn)
+		}
+		Walk(node.Else, fn)
+
+	case *WhenClause:
+		Walk(node.Cond, fn)
+		Walk(node.Result, fn)
+
+	case *CastExpr:
+		Walk(node.Expr, fn)
+
+	case *LikeExpr:
+		Walk(node.Expr, fn)
+		Walk(node.Pattern, fn)
+		Walk(node.Escape, fn)
+
+	case *BetweenExpr:
+		Walk(node.Expr, fn)
+		Walk(node.Low, fn)
+		Walk(node.High, fn)
+
+	case *TupleExpr:
+		for _, child := range node.Exprs {
+			Walk(child, fn)
+		}
+
+	case *IsExpr:
+		Walk(node.Expr, fn)
+		Walk(node.From, fn)
+
 	case *FunctionCall:
 		Walk(node.Name, fn)
 		for _, arg := range node.Args {
 			Walk(arg, fn)
 		}
+		Walk(node.Filter, fn)
+		if node.Over != nil {
+			Walk(node.Over, fn)
+		}
+
+	case *WindowDef:
+		Walk(node.Name, fn)
+		Walk(node.Spec, fn)
+
+	case *WindowSpec:
+		if node.Name != nil {
+			Walk(node.Name, fn)
+		}
+		for _, child := range node.PartitionBy {
+			Walk(child, fn)
+		}
+		for _, child := range node.OrderBy {
+			Walk(child, fn)
+		}
+		if node.Frame != nil {
+			Walk(node.Frame, fn)
+		}
+
+	case *WindowFrame:
+		Walk(node.Start, fn)
+		Walk(node.End, fn)
+
+	case *FrameBound:
+		Walk(node.Offset, fn)
 	}
 }
@@ -16,6 +16,7 @@ import (
 
 func main() {
 	verbose := flag.Bool("v", false, "verbose output")
+	dir := flag.String("db", "", "directory of a durable database in which to execute the statements")
 	flag.Parse()
 
 	// Read SQL from stdin.
@@ -40,10 +41,20 @@ func main() {
 		}
 	}
 
-	// Execute all the statements in the same environment.
+	// Execute all the statements in the same environment, or in a session of
+	// the durable database.
 	var env eval.Environment
+	exec := func(stmt ast.Node) (*eval.Table, error) { return eval.EvalStmt(&env, stmt) }
+	if *dir != "" {
+		db, err := eval.Open(*dir, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		exec = db.NewSession().Exec
+	}
 	for _, stmt := range stmts {
-		result, err := eval.EvalStmt(&env, stmt)
+		result, err := exec(stmt)
 		if err != nil {
 			fmt.Println(err.Error())
 		}
@@ -0,0 +1,379 @@
+package eval
+
+import (
+	"fmt"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Evaluates an alter table statement. The subcommands are applied in order
+// to a copy of the table, which replaces the table's contents only if all of
+// them succeed and the rows of the copy satisfy its constraints, so that the
+// statement either succeeds or has no effect.
+func evalAlterTableStmt(env *Environment, stmt *ast.AlterTableStmt) {
+	env.checkNotView(stmt.Table, "cannot alter view %q with ALTER TABLE")
+	orig := env.lookupTable(stmt.Table.Name)
+	a := &alteration{env: env, orig: orig, table: orig.clone()}
+	for _, cmd := range stmt.Cmds {
+		a.apply(cmd)
+	}
+	a.commit()
+}
+
+// The state of an alter table statement.
+type alteration struct {
+	env      *Environment
+	orig     *Table   // the table being altered
+	table    *Table   // the altered copy
+	validate bool     // whether the rows must be checked against the constraints
+	after    []func() // changes to other tables, made on commit
+}
+
+// Returns a copy of a table that can be altered without affecting the
+// original. The copy shares the expressions of the original's checks, which
+// must be copied before they are modified.
+func (tab *Table) clone() *Table {
+	c := tab.cloneSchema()
+	for _, row := range tab.Data {
+		c.Data = append(c.Data, append(Row(nil), row...))
+	}
+	return c
+}
+
+// Returns a copy of a table without its rows. The copy shares the
+// expressions of the original's checks.
+func (tab *Table) cloneSchema() *Table {
+	c := &Table{Name: tab.Name, Temporary: tab.Temporary}
+	for _, col := range tab.Columns {
+		cp := *col
+		c.Columns = append(c.Columns, &cp)
+	}
+	for _, key := range tab.Keys {
+		cp := *key
+		cp.Columns = append([]string(nil), key.Columns...)
+		c.Keys = append(c.Keys, &cp)
+	}
+	for _, check := range tab.Checks {
+		cp := *check
+		c.Checks = append(c.Checks, &cp)
+	}
+	for _, fk := range tab.ForeignKeys {
+		cp := *fk
+		cp.Columns = append([]string(nil), fk.Columns...)
+		cp.RefColumns = append([]string(nil), fk.RefColumns...)
+		c.ForeignKeys = append(c.ForeignKeys, &cp)
+	}
+	return c
+}
+
+// Applies a subcommand to the copy of the table.
+func (a *alteration) apply(cmd *ast.AlterTableCmd) {
+	t := a.table
+	if cmd.Kind == ast.AddColumn {
+		name := cmd.Definition.Name
+		if t.colIndex(name.Name) >= 0 {
+			if cmd.IfExists {
+				return
+			}
+			panic(errorf(name, "column %q of relation %q already exists", name.Name, t.Name))
+		}
+		col := newColumn(cmd.Definition)
+		t.Columns = append(t.Columns, col)
+		for i, row := range t.Data {
+			t.Data[i] = append(row, col.defaultValue(a.env))
+		}
+		for _, c := range cmd.Constraints {
+			addConstraint(t, c)
+		}
+		a.validate = true
+		return
+	}
+	if cmd.Kind == ast.RenameTable {
+		a.renameTable(cmd.NewName)
+		return
+	}
+	n := t.colIndex(cmd.Column.Name)
+	if n < 0 {
+		if cmd.Kind == ast.DropColumn && cmd.IfExists {
+			return
+		}
+		panic(errorf(cmd.Column, "column %q of relation %q does not exist", cmd.Column.Name, t.Name))
+	}
+	a.checkViews(cmd)
+	col := t.Columns[n]
+	switch cmd.Kind {
+	case ast.DropColumn:
+		a.dropColumn(cmd, n)
+	case ast.RenameColumn:
+		a.renameColumn(cmd, n)
+	case ast.AlterColumnType:
+		typ := dataTypeFromToken(cmd, cmd.Type)
+		if typ == col.Type {
+			return
+		}
+		if col.AutoInc && typ != Integer {
+			panic(errorf(cmd, "auto-increment column %q must be of type INTEGER", col.Name))
+		}
+		if fk := a.foreignKeyUsing(col.Name); fk != nil {
+			panic(errorf(cmd.Column, "cannot alter type of column %q because it is used by foreign key constraint %q",
+				col.Name, fk.Name))
+		}
+		col.Type = typ
+		for _, row := range t.Data {
+			if row[n] != nil {
+				row[n] = coerceAt(cmd, row[n], typ)
+			}
+		}
+		a.validate = true
+	case ast.SetNotNull:
+		col.Nullable = false
+		a.validate = true
+	case ast.DropNotNull:
+		if key := t.primaryKey(); key != nil && containsName(key.Columns, col.Name) {
+			panic(errorf(cmd.Column, "column %q is in a primary key", col.Name))
+		}
+		col.Nullable = true
+	}
+}
+
+// Views refer to the table's columns by name, so a subcommand that renames or
+// drops a column, or changes its type, is not allowed while a view refers to
+// the column, except that DROP COLUMN ... CASCADE drops such views.
+func (a *alteration) checkViews(cmd *ast.AlterTableCmd) {
+	switch cmd.Kind {
+	case ast.RenameColumn, ast.DropColumn, ast.AlterColumnType:
+	default:
+		return
+	}
+	for _, v := range a.env.dependentViews(a.orig.Name) {
+		if !containsName(a.env.viewColumns(v, a.orig.Name), cmd.Column.Name) {
+			continue
+		}
+		if cmd.Kind == ast.DropColumn && cmd.Cascade {
+			name := v.name
+			a.after = append(a.after, func() { a.env.dropView(name) })
+			continue
+		}
+		panic(errorf(cmd, "cannot alter column %q of table %q because view %q depends on it",
+			cmd.Column.Name, a.orig.Name, v.name))
+	}
+}
+
+// Drops the column at index n, with the table's constraints that involve it.
+// Foreign keys of other tables that refer to the column are dropped only if
+// the subcommand has CASCADE.
+func (a *alteration) dropColumn(cmd *ast.AlterTableCmd, n int) {
+	t := a.table
+	name := t.Columns[n].Name
+	if len(t.Columns) == 1 {
+		panic(errorf(cmd.Column, "cannot drop column %q because it is the only column of table %q", name, t.Name))
+	}
+	for _, ref := range a.env.references(a.orig) {
+		if ref.table == a.orig || !containsName(ref.fk.RefColumns, name) {
+			continue
+		}
+		if !cmd.Cascade {
+			panic(errorf(cmd.Column, "cannot drop column %q of table %q because constraint %q on table %q depends on it",
+				name, t.Name, ref.fk.Name, ref.table.Name))
+		}
+		ref := ref
+		a.after = append(a.after, func() { ref.table.dropForeignKey(ref.fk) })
+	}
+	var keys []*Key
+	for _, key := range t.Keys {
+		if !containsName(key.Columns, name) {
+			keys = append(keys, key)
+		}
+	}
+	var checks []*Check
+	for _, check := range t.Checks {
+		refers := false
+		walkColumnRefs(check.Expr, func(_, col *ast.Ident) {
+			refers = refers || col.Name == name
+		})
+		if !refers {
+			checks = append(checks, check)
+		}
+	}
+	var fks []*ForeignKey
+	for _, fk := range t.ForeignKeys {
+		if !containsName(fk.Columns, name) && !(fk.RefTable == t.Name && containsName(fk.RefColumns, name)) {
+			fks = append(fks, fk)
+		}
+	}
+	t.Keys, t.Checks, t.ForeignKeys = keys, checks, fks
+	t.Columns = append(t.Columns[:n:n], t.Columns[n+1:]...)
+	for i, row := range t.Data {
+		t.Data[i] = append(row[:n:n], row[n+1:]...)
+	}
+}
+
+// Renames the column at index n, and updates the constraints that refer to
+// it.
+func (a *alteration) renameColumn(cmd *ast.AlterTableCmd, n int) {
+	t := a.table
+	oldName, newName := t.Columns[n].Name, cmd.NewName.Name
+	if t.colIndex(newName) >= 0 {
+		panic(errorf(cmd.NewName, "column %q of relation %q already exists", newName, t.Name))
+	}
+	t.Columns[n].Name = newName
+	for _, key := range t.Keys {
+		replaceName(key.Columns, oldName, newName)
+	}
+	for _, fk := range t.ForeignKeys {
+		replaceName(fk.Columns, oldName, newName)
+		if fk.RefTable == t.Name {
+			replaceName(fk.RefColumns, oldName, newName)
+		}
+	}
+	for _, ref := range a.env.references(a.orig) {
+		if ref.table != a.orig {
+			fk := ref.fk
+			a.after = append(a.after, func() { replaceName(fk.RefColumns, oldName, newName) })
+		}
+	}
+	for _, check := range t.Checks {
+		check.Expr = ast.Copy(check.Expr).(ast.Expr)
+		walkColumnRefs(check.Expr, func(_, col *ast.Ident) {
+			if col.Name == oldName {
+				col.Name = newName
+			}
+		})
+	}
+}
+
+// Renames the table, and updates the foreign keys, checks and views that
+// refer to it by name.
+func (a *alteration) renameTable(name *ast.Ident) {
+	t := a.table
+	oldName, newName := t.Name, name.Name
+	_, isTable := a.env.tables[newName]
+	_, isView := a.env.views[newName]
+	if isTable || isView {
+		panic(errorf(name, "relation %q already exists", newName))
+	}
+	for _, fk := range t.ForeignKeys {
+		if fk.RefTable == oldName {
+			fk.RefTable = newName
+		}
+	}
+	for _, ref := range a.env.references(a.orig) {
+		if ref.table != a.orig {
+			fk := ref.fk
+			a.after = append(a.after, func() { fk.RefTable = newName })
+		}
+	}
+	for _, check := range t.Checks {
+		check.Expr = ast.Copy(check.Expr).(ast.Expr)
+		walkColumnRefs(check.Expr, func(table, _ *ast.Ident) {
+			if table != nil && table.Name == oldName {
+				table.Name = newName
+			}
+		})
+	}
+	env, orig := a.env, a.orig
+	a.after = append(a.after, func() {
+		delete(env.tables, oldName)
+		env.tables[newName] = orig
+	})
+	for _, v := range env.dependentViews(oldName) {
+		// Replace the view rather than changing it, since other environments
+		// may share it.
+		cp := v.copyShared()
+		cp.query = renameTableRefs(v.query, oldName, newName)
+		cp.refs = append([]string(nil), v.refs...)
+		replaceName(cp.refs, oldName, newName)
+		if iv := cp.incremental; iv != nil {
+			iv.stmt, iv.table = cp.query.(*ast.SelectStmt), newName
+		}
+		a.after = append(a.after, func() { env.views[cp.name] = cp })
+	}
+	t.Name = newName
+}
+
+// Returns a foreign key of the table, or of another table, that uses the named
+// column of the table, or nil if there is none.
+func (a *alteration) foreignKeyUsing(name string) *ForeignKey {
+	t := a.table
+	for _, fk := range t.ForeignKeys {
+		if containsName(fk.Columns, name) || fk.RefTable == t.Name && containsName(fk.RefColumns, name) {
+			return fk
+		}
+	}
+	for _, ref := range a.env.references(a.orig) {
+		if ref.table != a.orig && containsName(ref.fk.RefColumns, name) {
+			return ref.fk
+		}
+	}
+	return nil
+}
+
+// Checks the altered table if necessary, then replaces the contents of the
+// original table with it, makes the changes to other tables, and rebuilds the
+// incrementally maintained views of the table.
+func (a *alteration) commit() {
+	t := a.table
+	if a.validate {
+		if err := a.env.checkTable(t); err != nil {
+			panic(err)
+		}
+		for n, col := range t.Columns {
+			if col.Nullable {
+				continue
+			}
+			for _, row := range t.Data {
+				if row[n] == nil {
+					panic(&ConstraintError{
+						Table: t.Name,
+						Msg:   fmt.Sprintf("column %q of relation %q contains null values", col.Name, t.Name),
+					})
+				}
+			}
+		}
+		for _, row := range t.Data {
+			t.checkRow(a.env, row)
+		}
+		t.keyIndex() // panics if two rows have the same key
+		for _, fk := range t.ForeignKeys {
+			parent := t
+			if fk.RefTable != t.Name {
+				parent = a.env.lookupTable(fk.RefTable)
+			}
+			cols := t.colIndexes(fk.Columns)
+			for _, row := range t.Data {
+				key := project(row, cols)
+				if !anyNull(key) && !parent.hasKey(fk.RefColumns, key) {
+					panic(&ConstraintError{
+						Table:      t.Name,
+						Constraint: fk.Name,
+						Msg:        fmt.Sprintf("insert or update on table %q violates foreign key constraint %q", t.Name, fk.Name),
+					})
+				}
+			}
+		}
+	}
+	*a.orig = *t
+	for _, fn := range a.after {
+		fn()
+	}
+	a.env.refreshIncrementalViews(a.orig.Name)
+}
+
+// Reports whether names contains name.
+func containsName(names []string, name string) bool {
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces each occurrence of oldName in names with newName.
+func replaceName(names []string, oldName, newName string) {
+	for i, s := range names {
+		if s == oldName {
+			names[i] = newName
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Shorthand for building signatures of the builtin scalar functions.
+func types(ts ...DataType) []DataType { return ts }
+
+var builtinFuncs = map[string]*scalarFunc{}
+
+func init() {
+	for _, fn := range []*scalarFunc{
+		// String functions.
+		{"lower", Signature{Args: types(String), Result: String, Strict: true}, fnLower},
+		{"upper", Signature{Args: types(String), Result: String, Strict: true}, fnUpper},
+		{"length", Signature{Args: types(String), Result: Integer, Strict: true}, fnLength},
+		{"substr", Signature{Args: types(String, Integer, Integer), Variadic: true, Result: String, Strict: true}, fnSubstr},
+		{"trim", Signature{Args: types(String), Result: String, Strict: true}, fnTrim},
+		{"replace", Signature{Args: types(String, String, String), Result: String, Strict: true}, fnReplace},
+		{"position", Signature{Args: types(String, String), Result: Integer, Strict: true}, fnPosition},
+
+		// Math functions.
+		{"abs", Signature{Args: types(InvalidDataType), Strict: true}, fnAbs},
+		{"round", Signature{Args: types(Number, Integer), Variadic: true, Result: Number, Strict: true}, fnRound},
+		{"floor", Signature{Args: types(Number), Result: Number, Strict: true}, fnFloor},
+		{"ceil", Signature{Args: types(Number), Result: Number, Strict: true}, fnCeil},
+		{"ceiling", Signature{Args: types(Number), Result: Number, Strict: true}, fnCeil},
+		{"mod", Signature{Args: types(Integer, Integer), Result: Integer, Strict: true}, fnMod},
+		{"power", Signature{Args: types(Number, Number), Result: Number, Strict: true}, fnPower},
+		{"sqrt", Signature{Args: types(Number), Result: Number, Strict: true}, fnSqrt},
+
+		// Null-handling functions.
+		{"coalesce", Signature{Args: types(InvalidDataType, InvalidDataType), Variadic: true}, fnCoalesce},
+		{"nullif", Signature{Args: types(InvalidDataType, InvalidDataType)}, fnNullif},
+		{"greatest", Signature{Args: types(InvalidDataType, InvalidDataType), Variadic: true}, fnGreatest},
+		{"least", Signature{Args: types(InvalidDataType, InvalidDataType), Variadic: true}, fnLeast},
+
+		// Timestamp functions.
+		{"now", Signature{Result: Timestamp, Strict: true}, fnNow},
+		{"date_trunc", Signature{Args: types(String, Timestamp), Result: Timestamp, Strict: true}, fnDateTrunc},
+		{"date_part", Signature{Args: types(String, Timestamp), Result: Number, Strict: true}, fnDatePart},
+		{"to_timestamp", Signature{Args: types(Number), Result: Timestamp, Strict: true}, fnToTimestamp},
+	} {
+		builtinFuncs[fn.name] = fn
+	}
+}
+
+// Returns an error unless the number of arguments is at most max. Use this for
+// variadic functions that have optional trailing arguments.
+func maxArgs(args []Value, max int) error {
+	if len(args) > max {
+		return fmt.Errorf("too many arguments: got %d, want at most %d", len(args), max)
+	}
+	return nil
+}
+
+func fnLower(args []Value) (Value, error) {
+	return StringValue(strings.ToLower(string(args[0].(StringValue)))), nil
+}
+
+func fnUpper(args []Value) (Value, error) {
+	return StringValue(strings.ToUpper(string(args[0].(StringValue)))), nil
+}
+
+func fnLength(args []Value) (Value, error) {
+	return IntegerValue(utf8.RuneCountInString(string(args[0].(StringValue)))), nil
+}
+
+// Computes substr(s, start [, count]). As in PostgreSQL, positions are
+// one-based, and the range may extend beyond either end of the string.
+func fnSubstr(args []Value) (Value, error) {
+	if err := maxArgs(args, 3); err != nil {
+		return nil, err
+	}
+	s := []rune(string(args[0].(StringValue)))
+	start := int64(args[1].(IntegerValue))
+	end := int64(len(s)) + 1
+	if len(args) == 3 {
+		count := int64(args[2].(IntegerValue))
+		if count < 0 {
+			return nil, errors.New("negative substring length not allowed")
+		}
+		end = start + count
+	}
+	start = clampInt64(start, 1, int64(len(s))+1)
+	end = clampInt64(end, start, int64(len(s))+1)
+	return StringValue(s[start-1 : end-1]), nil
+}
+
+func clampInt64(n, min, max int64) int64 {
+	switch {
+	case n < min:
+		return min
+	case n > max:
+		return max
+	}
+	return n
+}
+
+func fnTrim(args []Value) (Value, error) {
+	return StringValue(strings.Trim(string(args[0].(StringValue)), " ")), nil
+}
+
+func fnReplace(args []Value) (Value, error) {
+	s, from, to := args[0].(StringValue), args[1].(StringValue), args[2].(StringValue)
+	return StringValue(strings.Replace(string(s), string(from), string(to), -1)), nil
+}
+
+// Computes position(substring, s): the one-based position of the first
+// occurrence of substring in s, or zero if there is none.
+func fnPosition(args []Value) (Value, error) {
+	sub, s := string(args[0].(StringValue)), string(args[1].(StringValue))
+	i := strings.Index(s, sub)
+	if i < 0 {
+		return IntegerValue(0), nil
+	}
+	return IntegerValue(utf8.RuneCountInString(s[:i]) + 1), nil
+}
+
+func fnAbs(args []Value) (Value, error) {
+	switch v := args[0].(type) {
+	case IntegerValue:
+		if v < 0 {
+			return -v, nil
+		}
+		return v, nil
+	case NumberValue:
+		return NumberValue(math.Abs(float64(v))), nil
+	}
+	return nil, fmt.Errorf("argument must be numeric, not %s", args[0])
+}
+
+// Computes round(x [, digits]). Halfway cases are rounded away from zero.
+func fnRound(args []Value) (Value, error) {
+	if err := maxArgs(args, 2); err != nil {
+		return nil, err
+	}
+	x := float64(args[0].(NumberValue))
+	if len(args) == 1 {
+		return NumberValue(math.Round(x)), nil
+	}
+	scale := math.Pow(10, float64(args[1].(IntegerValue)))
+	return NumberValue(math.Round(x*scale) / scale), nil
+}
+
+func fnFloor(args []Value) (Value, error) {
+	return NumberValue(math.Floor(float64(args[0].(NumberValue)))), nil
+}
+
+func fnCeil(args []Value) (Value, error) {
+	return NumberValue(math.Ceil(float64(args[0].(NumberValue)))), nil
+}
+
+func fnMod(args []Value) (Value, error) {
+	x, y := args[0].(IntegerValue), args[1].(IntegerValue)
+	if y == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return x % y, nil
+}
+
+func fnPower(args []Value) (Value, error) {
+	x, y := float64(args[0].(NumberValue)), float64(args[1].(NumberValue))
+	return NumberValue(math.Pow(x, y)), nil
+}
+
+func fnSqrt(args []Value) (Value, error) {
+	x := float64(args[0].(NumberValue))
+	if x < 0 {
+		return nil, errors.New("cannot take square root of a negative number")
+	}
+	return NumberValue(math.Sqrt(x)), nil
+}
+
+// Computes coalesce(x, ...): the first argument that is not null.
+func fnCoalesce(args []Value) (Value, error) {
+	for _, v := range args {
+		if v != nil {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// Computes nullif(x, y): null if x equals y; otherwise x.
+func fnNullif(args []Value) (Value, error) {
+	x, y := args[0], args[1]
+	if x == nil || y == nil {
+		return x, nil
+	}
+	c, ok := compare(x, y)
+	if !ok {
+		return nil, fmt.Errorf("cannot compare %s and %s", x, y)
+	}
+	if c == 0 {
+		return nil, nil
+	}
+	return x, nil
+}
+
+// Computes greatest(x, ...), ignoring null arguments.
+func fnGreatest(args []Value) (Value, error) {
+	return extremum(args, 1)
+}
+
+// Computes least(x, ...), ignoring null arguments.
+func fnLeast(args []Value) (Value, error) {
+	return extremum(args, -1)
+}
+
+// Returns the greatest (sign > 0) or least (sign < 0) non-null value in args,
+// or null if every value is null.
+func extremum(args []Value, sign int) (Value, error) {
+	var result Value
+	for _, v := range args {
+		if v == nil {
+			continue
+		}
+		if result == nil {
+			result = v
+			continue
+		}
+		c, ok := compare(v, result)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s and %s", v, result)
+		}
+		if c*sign > 0 {
+			result = v
+		}
+	}
+	return result, nil
+}
+
+func fnNow(args []Value) (Value, error) {
+	return TimestampValue(time.Now()), nil
+}
+
+// Computes date_trunc(unit, t): t truncated to the given precision.
+func fnDateTrunc(args []Value) (Value, error) {
+	unit := strings.ToLower(string(args[0].(StringValue)))
+	t := time.Time(args[1].(TimestampValue))
+	var (
+		year, day      = t.Year(), t.Day()
+		month          = t.Month()
+		hour, min, sec = t.Clock()
+		truncated      time.Time
+	)
+	switch unit {
+	case "year":
+		truncated = time.Date(year, 1, 1, 0, 0, 0, 0, t.Location())
+	case "month":
+		truncated = time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	case "day":
+		truncated = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	case "hour":
+		truncated = time.Date(year, month, day, hour, 0, 0, 0, t.Location())
+	case "minute":
+		truncated = time.Date(year, month, day, hour, min, 0, 0, t.Location())
+	case "second":
+		truncated = time.Date(year, month, day, hour, min, sec, 0, t.Location())
+	default:
+		return nil, fmt.Errorf("unit %q not recognized", unit)
+	}
+	return TimestampValue(truncated), nil
+}
+
+// Computes date_part(field, t): a subfield of t, such as its year or hour.
+func fnDatePart(args []Value) (Value, error) {
+	field := strings.ToLower(string(args[0].(StringValue)))
+	t := time.Time(args[1].(TimestampValue))
+	var n float64
+	switch field {
+	case "year":
+		n = float64(t.Year())
+	case "month":
+		n = float64(t.Month())
+	case "day":
+		n = float64(t.Day())
+	case "hour":
+		n = float64(t.Hour())
+	case "minute":
+		n = float64(t.Minute())
+	case "second":
+		n = float64(t.Second()) + float64(t.Nanosecond())/1e9
+	case "dow":
+		n = float64(t.Weekday())
+	case "doy":
+		n = float64(t.YearDay())
+	case "epoch":
+		n = float64(t.UnixNano()) / 1e9
+	default:
+		return nil, fmt.Errorf("field %q not recognized", field)
+	}
+	return NumberValue(n), nil
+}
+
+// Computes to_timestamp(seconds): the time that is the given number of seconds
+// after the Unix epoch.
+func fnToTimestamp(args []Value) (Value, error) {
+	secs := float64(args[0].(NumberValue))
+	whole, frac := math.Modf(secs)
+	return TimestampValue(time.Unix(int64(whole), int64(frac*1e9)).UTC()), nil
+}
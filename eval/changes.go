@@ -0,0 +1,281 @@
+package eval
+
+import "sort"
+
+// The changes that a statement makes to the tables of an environment. A
+// statement records its changes here instead of modifying tables directly.
+// When it is done, commit applies the actions of any foreign keys that refer
+// to changed rows, then checks every constraint, and only then modifies the
+// tables, so that the statement either succeeds or has no effect.
+type changeSet struct {
+	env     *Environment
+	tables  []*tableChange // in order of first change
+	pending []rowChange    // changes whose referential actions are pending
+}
+
+// The changes to one table, recorded as deltas from its rows, so that the
+// cost of a statement depends on the number of rows it changes rather than
+// the size of the table.
+type tableChange struct {
+	table    *Table
+	changes  map[int]Row // new values of the updated existing rows, by index; nil if deleted
+	deleted  int         // number of deleted existing rows
+	inserted []Row
+
+	// The table's rows after the changes, the claims on their array, and the
+	// indexes among them of the updated and inserted rows; set by commit once
+	// all changes are made.
+	data    []Row
+	slots   *rowSlots
+	changed []int
+
+	keys []map[string]bool // by key, the rowKeys of the changed rows; see changeSet.hasKey
+}
+
+// A change to an existing row of a table. The new value is nil if the row was
+// deleted.
+type rowChange struct {
+	tc       *tableChange
+	old, new Row
+}
+
+func newChangeSet(env *Environment) *changeSet {
+	return &changeSet{env: env}
+}
+
+// Returns the changes to a table, creating them if necessary.
+func (cs *changeSet) change(table *Table) *tableChange {
+	if tc := cs.find(table); tc != nil {
+		return tc
+	}
+	tc := &tableChange{table: table, changes: make(map[int]Row)}
+	cs.tables = append(cs.tables, tc)
+	return tc
+}
+
+// Returns the changes to a table, or nil if there are none.
+func (cs *changeSet) find(table *Table) *tableChange {
+	for _, tc := range cs.tables {
+		if tc.table == table {
+			return tc
+		}
+	}
+	return nil
+}
+
+// Returns the rows of a table after the changes. Must not be called until
+// commit has computed them.
+func (cs *changeSet) data(table *Table) []Row {
+	if tc := cs.find(table); tc != nil {
+		return tc.data
+	}
+	return table.Data
+}
+
+// Replaces the value of the existing row at index i. Does nothing if the row
+// has been deleted.
+func (cs *changeSet) update(tc *tableChange, i int, row Row) {
+	old := tc.row(i)
+	if old == nil {
+		return
+	}
+	cs.pending = append(cs.pending, rowChange{tc, old, row})
+	tc.changes[i] = row
+}
+
+// Deletes the existing row at index i. Does nothing if the row has already
+// been deleted.
+func (cs *changeSet) delete(tc *tableChange, i int) {
+	old := tc.row(i)
+	if old == nil {
+		return
+	}
+	cs.pending = append(cs.pending, rowChange{tc, old, nil})
+	tc.remove(i)
+}
+
+// Deletes the existing row at index i, without applying the actions of the
+// foreign keys that refer to it.
+func (tc *tableChange) remove(i int) {
+	if tc.row(i) != nil {
+		tc.changes[i] = nil
+		tc.deleted++
+	}
+}
+
+// Adds a new row to the table.
+func (tc *tableChange) insert(row Row) {
+	tc.inserted = append(tc.inserted, row)
+}
+
+// Returns the current value of the existing row at index i, or nil if it has
+// been deleted.
+func (tc *tableChange) row(i int) Row {
+	if row, ok := tc.changes[i]; ok {
+		return row
+	}
+	return tc.table.Data[i]
+}
+
+// Returns the indexes of the updated and deleted existing rows, in order.
+func (tc *tableChange) changedIndexes() []int {
+	indexes := make([]int, 0, len(tc.changes))
+	for i := range tc.changes {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// Computes the table's rows after the changes. If rows were only inserted,
+// they are appended to the table's rows, in place if no other version of the
+// table has claimed the space beyond them (see appendRows).
+func (tc *tableChange) computeData() {
+	old := tc.table.Data
+	tc.changed = nil
+	if len(tc.changes) == 0 {
+		tc.data, tc.slots = appendRows(old, tc.table.slots, tc.inserted)
+		for i := range tc.inserted {
+			tc.changed = append(tc.changed, len(old)+i)
+		}
+		return
+	}
+	tc.data, tc.slots = make([]Row, 0, len(old)-tc.deleted+len(tc.inserted)), nil
+	for i, row := range old {
+		if newRow, ok := tc.changes[i]; ok {
+			if newRow == nil {
+				continue
+			}
+			row = newRow
+			tc.changed = append(tc.changed, len(tc.data))
+		}
+		tc.data = append(tc.data, row)
+	}
+	for _, row := range tc.inserted {
+		tc.changed = append(tc.changed, len(tc.data))
+		tc.data = append(tc.data, row)
+	}
+}
+
+// Applies the referential actions of foreign keys, checks constraints,
+// maintains the incrementally maintained views, and modifies the tables.
+// Updated rows are replaced, not modified in place, so that snapshots of the
+// environment may share rows with it.
+func (cs *changeSet) commit() {
+	cs.applyRefActions()
+	for _, tc := range cs.tables {
+		tc.computeData()
+		tc.check(cs.env)
+	}
+	cs.checkForeignKeys()
+	cs.maintainViews()
+	for _, tc := range cs.tables {
+		tc.updateIndex()
+		if len(tc.changes) != 0 {
+			tc.table.base = nil
+		}
+		tc.table.Data, tc.table.slots = tc.data, tc.slots
+		if cs.env.logRows && !tc.table.Temporary && (len(tc.changes) != 0 || len(tc.inserted) != 0) {
+			cs.env.rowLog = append(cs.env.rowLog, &rowChanges{tc.table.Name, tc.changes, tc.inserted})
+		}
+	}
+}
+
+// Panics unless the updated and inserted rows satisfy the table's checks and
+// unique keys. The new rows are checked against each other and against the
+// index of the rows that did not change.
+func (tc *tableChange) check(env *Environment) {
+	t := tc.table
+	var idx *keyIndex
+	var seen []map[string]bool
+	if len(t.Keys) != 0 && len(tc.changed) != 0 {
+		idx = t.keyIndex()
+		seen = make([]map[string]bool, len(t.Keys))
+		for k := range seen {
+			seen[k] = make(map[string]bool)
+		}
+	}
+	for _, i := range tc.changed {
+		row := tc.data[i]
+		t.checkRow(env, row)
+		for k, key := range t.Keys {
+			v, ok := idx.key(k, row)
+			if !ok {
+				continue
+			}
+			if seen[k][v] {
+				panic(t.uniqueViolation(key))
+			}
+			seen[k][v] = true
+			if j := idx.find(k, v); j >= 0 {
+				if _, changed := tc.changes[j]; !changed {
+					panic(t.uniqueViolation(key))
+				}
+			}
+		}
+	}
+}
+
+// Gives the table the index of its rows after the changes, if rows were only
+// inserted; otherwise the index is discarded, and built again when needed.
+func (tc *tableChange) updateIndex() {
+	t := tc.table
+	if len(tc.changes) == 0 && t.index.describes(t) {
+		t.index = t.index.extend(tc.data)
+	} else {
+		t.index = nil
+	}
+}
+
+// Reports whether one of the rows of a table after the changes has the given
+// values, none of which is null, in the named columns, which must be those
+// of a unique key. Must not be called until commit has computed the rows.
+func (cs *changeSet) hasKey(table *Table, names []string, values []Value) bool {
+	k, v := table.keyFor(names, values)
+	tc := cs.find(table)
+	if i := table.keyIndex().find(k, v); i >= 0 {
+		if tc == nil {
+			return true
+		}
+		if _, changed := tc.changes[i]; !changed {
+			return true
+		}
+	}
+	if tc == nil {
+		return false
+	}
+	if tc.keys == nil {
+		tc.keys = make([]map[string]bool, len(table.Keys))
+	}
+	if tc.keys[k] == nil {
+		idx := table.keyIndex()
+		tc.keys[k] = make(map[string]bool)
+		for _, i := range tc.changed {
+			if v, ok := idx.key(k, tc.data[i]); ok {
+				tc.keys[k][v] = true
+			}
+		}
+	}
+	return tc.keys[k][v]
+}
+
+// Updates the incrementally maintained views of the changed tables. If that
+// fails, rebuilds the views from the tables, which have not been modified
+// yet, so that the statement has no effect on them.
+func (cs *changeSet) maintainViews() {
+	var views []*view
+	defer func() {
+		if r := recover(); r != nil {
+			for _, v := range views {
+				v.refresh(cs.env)
+			}
+			panic(r)
+		}
+	}()
+	for _, tc := range cs.tables {
+		for _, v := range cs.env.incrementalViews(tc.table.Name) {
+			views = append(views, v)
+			v.incremental.apply(cs.env, tc)
+		}
+	}
+}
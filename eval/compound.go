@@ -0,0 +1,161 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+	"github.com/dcowgill/toysqleval/token"
+)
+
+// Evaluates a query, which is a select statement, a compound select statement,
+// or a query with a WITH clause. Column names that cannot be resolved in the query are looked up
+// in the outer namespace.
+func evalQueryStmt(outer namespace, stmt ast.QueryStmt) *Table {
+	switch stmt := stmt.(type) {
+	case *ast.SelectStmt:
+		return evalSelectStmt(outer, stmt)
+	case *ast.CompoundSelectStmt:
+		return evalCompoundSelectStmt(outer, stmt)
+	case *ast.WithStmt:
+		return evalWithStmt(outer, stmt)
+	}
+	panic(errorf(stmt, "invalid query: %T", stmt))
+}
+
+// Evaluates a UNION, INTERSECT or EXCEPT of two queries. Unless ALL is given,
+// duplicate rows are removed from the result. For the purpose of comparing
+// rows, nulls are equal to each other.
+func evalCompoundSelectStmt(outer namespace, stmt *ast.CompoundSelectStmt) *Table {
+	left := evalQueryStmt(outer, stmt.Left)
+	right := evalQueryStmt(outer, stmt.Right)
+	columns := compoundColumns(stmt, left.Columns, right.Columns)
+	lrows := coerceRows(left.Data, columns)
+	rrows := coerceRows(right.Data, columns)
+
+	var rows []Row
+	switch stmt.Op {
+	case token.Union:
+		rows = append(lrows, rrows...)
+		if !stmt.All {
+			rows = distinctRows(rows, 0, len(columns))
+		}
+	case token.Intersect, token.Except:
+		// With ALL, each row on the right cancels one matching row on the left.
+		counts := make(map[string]int)
+		for _, row := range rrows {
+			counts[rowKey(row)]++
+		}
+		if !stmt.All {
+			lrows = distinctRows(lrows, 0, len(columns))
+		}
+		for _, row := range lrows {
+			k := rowKey(row)
+			inRight := counts[k] > 0
+			if inRight && stmt.All {
+				counts[k]--
+			}
+			if inRight == (stmt.Op == token.Intersect) {
+				rows = append(rows, row)
+			}
+		}
+	default:
+		panic(errorf(stmt, "invalid set operator: %s", stmt.Op))
+	}
+
+	// Sort, then apply the offset and limit. The sort keys may refer only to
+	// output columns, so we temporarily append them to each row.
+	if len(stmt.OrderBy) != 0 {
+		n := len(columns)
+		keys := make([]int, len(stmt.OrderBy))
+		for i, term := range stmt.OrderBy {
+			keys[i] = outputColumnIndex(stmt, term.Expr, columns)
+		}
+		for i, row := range rows {
+			row = append(row[:n:n], make(Row, len(keys))...)
+			for j, k := range keys {
+				row[n+j] = row[k]
+			}
+			rows[i] = row
+		}
+		sortRows(stmt.OrderBy, rows, n)
+		for i, row := range rows {
+			rows[i] = row[:n]
+		}
+	}
+	rows = limitRows(outer, stmt.Limit, stmt.Offset, rows)
+	return &Table{Columns: columns, Data: rows}
+}
+
+// Describes the result columns of a compound select statement. The columns
+// take their names from the left query. Panics unless both queries have the
+// same number of columns, and each pair of columns has a common type.
+func compoundColumns(stmt *ast.CompoundSelectStmt, left, right []*Column) []*Column {
+	if len(left) != len(right) {
+		panic(errorf(stmt.Right, "each %s query must have the same number of columns", stmt.Op))
+	}
+	columns := make([]*Column, len(left))
+	for i, l := range left {
+		r := right[i]
+		t, ok := commonType(l.Type, r.Type)
+		if !ok {
+			panic(errorf(stmt.Right, "%s types %s and %s cannot be matched", stmt.Op, l.Type, r.Type))
+		}
+		nullable := l.Nullable
+		switch stmt.Op {
+		case token.Union:
+			nullable = l.Nullable || r.Nullable
+		case token.Intersect:
+			nullable = l.Nullable && r.Nullable
+		}
+		columns[i] = &Column{Name: l.Name, Type: t, Nullable: nullable}
+	}
+	return columns
+}
+
+// Returns the type to which values of types a and b can both be converted.
+// InvalidDataType, which is the type of e.g. a column of nulls, is compatible
+// with any type.
+func commonType(a, b DataType) (DataType, bool) {
+	switch {
+	case a == b || b == InvalidDataType:
+		return a, true
+	case a == InvalidDataType:
+		return b, true
+	case (a == Integer && b == Number) || (a == Number && b == Integer):
+		return Number, true
+	}
+	return InvalidDataType, false
+}
+
+// Returns a copy of rows in which every value has the type of its column.
+func coerceRows(rows []Row, columns []*Column) []Row {
+	result := make([]Row, len(rows))
+	for i, row := range rows {
+		result[i] = make(Row, len(row))
+		for j, value := range row {
+			if t := columns[j].Type; value != nil && t != InvalidDataType {
+				value = coerce(value, t)
+			}
+			result[i][j] = value
+		}
+	}
+	return result
+}
+
+// Returns the index of the output column to which an ORDER BY key of a
+// compound select refers, either by name or by one-based position.
+func outputColumnIndex(stmt *ast.CompoundSelectStmt, expr ast.Expr, columns []*Column) int {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		if expr.Value < 1 || expr.Value > int64(len(columns)) {
+			panic(errorf(expr, "ORDER BY position %d is not in select list", expr.Value))
+		}
+		return int(expr.Value - 1)
+	case *ast.Ident:
+		for i, col := range columns {
+			if col.Name == expr.Name {
+				return i
+			}
+		}
+		panic(errorf(expr, "column %q does not exist", expr.Name))
+	}
+	panic(errorf(expr, "invalid %s ORDER BY clause: only result column names or positions are allowed", stmt.Op))
+}
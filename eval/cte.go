@@ -0,0 +1,136 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+	"github.com/dcowgill/toysqleval/token"
+)
+
+// Evaluates a query with a WITH clause. Each common table expression is
+// evaluated once, in order, and may refer to the ones before it; the tables
+// they define shadow any tables of the same name for the rest of the query.
+func evalWithStmt(outer namespace, stmt *ast.WithStmt) *Table {
+	ns := &withTables{tables: make(map[string]*Table), outer: outer}
+	for _, cte := range stmt.CTEs {
+		name := cte.Name.Name
+		if _, ok := ns.tables[name]; ok {
+			panic(errorf(cte, "WITH query name %q specified more than once", name))
+		}
+		if stmt.Recursive && referencesTable(cte.Query, name) {
+			ns.tables[name] = evalRecursiveCTE(ns, cte)
+		} else {
+			ns.tables[name] = namedCTETable(cte, evalQueryStmt(ns, cte.Query))
+		}
+	}
+	return evalQueryStmt(ns, stmt.Query)
+}
+
+// Returns a copy of a query's result whose name is the name of a common table
+// expression, and whose columns are renamed by the expression's column list.
+func namedCTETable(cte *ast.CommonTableExpr, result *Table) *Table {
+	if len(cte.Columns) > len(result.Columns) {
+		panic(errorf(cte, "WITH query %q has %d columns available but %d columns specified",
+			cte.Name.Name, len(result.Columns), len(cte.Columns)))
+	}
+	table := &Table{Name: cte.Name.Name, Data: result.Data}
+	for i, col := range result.Columns {
+		c := *col
+		if i < len(cte.Columns) {
+			c.Name = cte.Columns[i].Name
+		}
+		table.Columns = append(table.Columns, &c)
+	}
+	return table
+}
+
+// Evaluates a recursive common table expression, which must have the form
+// "initial UNION [ALL] recursive", where only the recursive term refers to the
+// expression's own name. The initial term is evaluated first; then the
+// recursive term is evaluated repeatedly, each time with the name bound to
+// the rows produced by the previous iteration, until it produces no new rows.
+// Without ALL, rows that were already produced are discarded.
+func evalRecursiveCTE(ns *withTables, cte *ast.CommonTableExpr) *Table {
+	name := cte.Name.Name
+	query, ok := cte.Query.(*ast.CompoundSelectStmt)
+	if !ok || query.Op != token.Union {
+		panic(errorf(cte, "recursive query %q does not have the form initial UNION [ALL] recursive", name))
+	}
+	if len(query.OrderBy) != 0 || query.Limit != nil || query.Offset != nil {
+		panic(errorf(cte, "ORDER BY, LIMIT and OFFSET are not allowed in recursive query %q", name))
+	}
+	if referencesTable(query.Left, name) {
+		panic(errorf(query.Left, "recursive reference to query %q must not appear within its initial term", name))
+	}
+	result := namedCTETable(cte, evalQueryStmt(ns, query.Left))
+	for _, col := range result.Columns {
+		col.Nullable = true // we cannot infer anything about the recursive term
+	}
+	seen := make(map[string]bool)
+	working := result.Data
+	if !query.All {
+		working = distinctRows(working, 0, len(result.Columns))
+		for _, row := range working {
+			seen[rowKey(row)] = true
+		}
+	}
+	result.Data = working
+
+	limit := ns.environment().RecursionLimit
+	if limit == 0 {
+		limit = DefaultRecursionLimit
+	}
+	for i := 0; len(working) != 0; i++ {
+		if i == limit {
+			panic(errorf(cte, "recursive query %q did not terminate within %d iterations", name, limit))
+		}
+		// Evaluate the recursive term against the previous iteration's rows.
+		ns.tables[name] = &Table{Name: name, Columns: result.Columns, Data: working}
+		step := evalQueryStmt(ns, query.Right)
+		compoundColumns(query, result.Columns, step.Columns) // check compatibility
+		working = nil
+		for _, row := range coerceRows(step.Data, result.Columns) {
+			if !query.All {
+				k := rowKey(row)
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+			}
+			working = append(working, row)
+		}
+		result.Data = append(result.Data, working...)
+	}
+	return result
+}
+
+// Reports whether a query refers to the named table in a FROM clause,
+// including in subqueries.
+func referencesTable(query ast.Node, name string) bool {
+	found := false
+	var fn ast.WalkFunc
+	fn = func(node ast.Node) ast.WalkFunc {
+		if found {
+			return nil // prune search
+		}
+		if stmt, ok := node.(*ast.SelectStmt); ok && tableExprReferences(stmt.Table, name) {
+			found = true
+			return nil
+		}
+		return fn
+	}
+	ast.Walk(query, fn)
+	return found
+}
+
+// Reports whether a table expression refers to the named table, excluding
+// subqueries, which referencesTable finds on its own.
+func tableExprReferences(expr ast.Expr, name string) bool {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name == name
+	case *ast.AliasedTableExpr:
+		return tableExprReferences(expr.Expr, name)
+	case *ast.JoinExpr:
+		return tableExprReferences(expr.Left, name) || tableExprReferences(expr.Right, name)
+	}
+	return false
+}
@@ -1,15 +1,64 @@
 package eval
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
 
 // Column contains column metadata.
 type Column struct {
-	Name     string
-	Type     DataType
-	Default  Value
-	Nullable bool
-	AutoInc  bool
-	NextVal  int
+	Name        string
+	Type        DataType
+	Default     Value
+	DefaultExpr ast.Expr // evaluated on each insert; overrides Default
+	Nullable    bool
+	AutoInc     bool
+	NextVal     int
+	// If true, the column's values are always generated by its sequence, and
+	// inserts and updates may not specify them; see AutoInc.
+	GeneratedAlways bool
+
+	// The sequence of an auto-increment column of a table in a Database,
+	// shared by the sessions' copies of the column, or nil if the table is
+	// not shared; NextVal is then the sequence.
+	seq *sequence
+}
+
+// A sequence shared by concurrent sessions. As in PostgreSQL, a value drawn
+// from it is not returned to it if the transaction rolls back, so that
+// concurrent transactions never draw the same value.
+type sequence struct {
+	next int64
+}
+
+// The number of elements of an array of rows that tables have claimed. The
+// versions of a table share the array that holds its rows, each of them
+// seeing a prefix of it, and a version appends rows in place only if it
+// claims the elements past its own rows first, so that every element is
+// written once, and no version sees the rows of another. Two versions whose
+// rows have the same length and start at the same address thus have the same
+// rows; see sameRows.
+type rowSlots struct {
+	n int64
+}
+
+// Returns rows, which belong to an array whose claims are given, followed by
+// more rows, and the claims on the array of the result. Appends in place if
+// the elements past rows are free; otherwise copies the rows to a new array,
+// with room for as many more.
+func appendRows(rows []Row, slots *rowSlots, more []Row) ([]Row, *rowSlots) {
+	if len(more) == 0 {
+		return rows, slots
+	}
+	n := len(rows) + len(more)
+	if slots != nil && n <= cap(rows) && atomic.CompareAndSwapInt64(&slots.n, int64(len(rows)), int64(n)) {
+		return append(rows, more...), slots
+	}
+	data := make([]Row, 0, 2*n)
+	data = append(append(data, rows...), more...)
+	return data, &rowSlots{n: int64(n)}
 }
 
 // Row is an array of values.
@@ -17,9 +66,59 @@ type Row []Value
 
 // Table contains table metadata plus its rows.
 type Table struct {
-	Name    string
-	Columns []*Column
-	Data    []Row
+	Name        string
+	Columns     []*Column
+	Keys        []*Key        // unique keys
+	Checks      []*Check      // check constraints
+	ForeignKeys []*ForeignKey // references to other tables
+	Data        []Row
+
+	index *keyIndex // the index of Data, if it has been built; see keyIndex
+	slots *rowSlots // the claims on the spare capacity of Data; nil if it may not be used
+	base  []Row     // the rows when the table was copied, if Data consists of them followed by new rows; see copyShared
+
+	// Temporary tables are created by CREATE TEMPORARY TABLE. Foreign keys
+	// may not refer from temporary to permanent tables, or vice versa.
+	Temporary bool
+}
+
+// Key is a set of columns whose values must be unique among the rows of a
+// table. Rows with a null in any of the columns are exempt, except that the
+// columns of a primary key may not be null.
+type Key struct {
+	Name    string // defaults to "<table>_<columns>_key" or "<table>_pkey"
+	Columns []string
+	Primary bool
+}
+
+// Check is a condition that every row of a table must satisfy. A row
+// satisfies the condition unless it is false; null is not a violation.
+type Check struct {
+	Name string // defaults to "<table>_<column>_check"
+	Expr ast.Expr
+}
+
+// ForeignKey is a set of columns whose values must match those of a unique
+// key of a row in the referenced table, which may be the same table. Rows
+// with a null in any of the columns are exempt.
+type ForeignKey struct {
+	Name       string // defaults to "<table>_<columns>_fkey"
+	Columns    []string
+	RefTable   string
+	RefColumns []string // defaults to the referenced table's primary key
+	OnDelete   ast.RefAction
+	OnUpdate   ast.RefAction
+}
+
+// Removes a foreign key from the table.
+func (t *Table) dropForeignKey(fk *ForeignKey) {
+	var fks []*ForeignKey
+	for _, other := range t.ForeignKeys {
+		if other != fk {
+			fks = append(fks, other)
+		}
+	}
+	t.ForeignKeys = fks
 }
 
 // Returns the index of the named column, or -1 if the column does not exist.
@@ -32,59 +131,294 @@ func (t *Table) colIndex(name string) int {
 	return -1
 }
 
-func (tab *Table) insert(names []string, values []Value) {
-	// Verify that the number of column names matches the number of values. No
-	// names is equivalent to specifying every column in table order.
-	numTargets := len(names)
-	if numTargets == 0 {
-		numTargets = len(tab.Columns)
+// Returns the indexes of the named columns.
+func (t *Table) colIndexes(names []string) []int {
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		indexes[i] = t.colIndex(name)
+	}
+	return indexes
+}
+
+// Returns the unique key of the table whose columns are exactly the given
+// columns, in any order, or nil if there is no such key.
+func (t *Table) keyWithColumns(names []string) *Key {
+next:
+	for _, key := range t.Keys {
+		if len(key.Columns) != len(names) {
+			continue
+		}
+		for _, col := range key.Columns {
+			found := false
+			for _, name := range names {
+				found = found || col == name
+			}
+			if !found {
+				continue next
+			}
+		}
+		return key
+	}
+	return nil
+}
+
+// Returns the table's primary key, or nil if it has none.
+func (t *Table) primaryKey() *Key {
+	for _, key := range t.Keys {
+		if key.Primary {
+			return key
+		}
+	}
+	return nil
+}
+
+// Returns the names of the table's columns, in order.
+func (t *Table) columnNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// Returns the value of a column that was not given a value, or whose value
+// was DEFAULT: the next value of its sequence if it is an auto-increment
+// column, else its default value.
+func (col *Column) defaultValue(env *Environment) Value {
+	switch {
+	case col.Type == Integer && col.AutoInc && col.seq != nil:
+		return IntegerValue(atomic.AddInt64(&col.seq.next, 1) - 1)
+	case col.Type == Integer && col.AutoInc:
+		v := IntegerValue(col.NextVal)
+		col.NextVal++
+		return v
+	case col.DefaultExpr != nil:
+		return evalExpr(emptyNamespace{env}, col.DefaultExpr)
+	}
+	return col.Default
+}
+
+// Creates a row to be inserted into the table, given the values of the named
+// columns; the other columns get their default values. Panics if the row is
+// invalid. The row is not added to the table.
+func (tab *Table) newRow(env *Environment, names []string, values []Value) Row {
+	// Verify that the number of column names matches the number of values.
+	if len(names) != len(values) {
+		panic(fmt.Errorf("INSERT has %d expressions but %d target columns", len(values), len(names)))
 	}
-	if numTargets != len(values) {
-		panic(fmt.Errorf("INSERT has %d expressions but %d target columns", len(values), numTargets))
+
+	// Verify that every name refers to a valid column.
+	for _, name := range names {
+		i := tab.colIndex(name)
+		if i < 0 {
+			panic(fmt.Errorf("column %q of relation %q does not exist", name, tab.Name))
+		}
+		if tab.Columns[i].GeneratedAlways {
+			panic(fmt.Errorf("cannot insert a non-DEFAULT value into column %q", name))
+		}
 	}
 
 	// Create the row in proper column order.
 	row := make([]Value, len(tab.Columns))
-	if len(names) != 0 {
-		// Verify that every name refers to a valid column.
-		for _, name := range names {
-			if tab.colIndex(name) < 0 {
-				panic(fmt.Errorf("column %q of relation %q does not exist", name, tab.Name))
+next:
+	for i, col := range tab.Columns {
+		for j, name := range names {
+			if col.Name == name {
+				row[i] = values[j]
+				continue next
 			}
 		}
-	next:
-		for i, col := range tab.Columns {
-			for j, name := range names {
-				if col.Name == name {
-					row[i] = values[j]
-					continue next
-				}
-			}
-			// If the column was not specified in the insert statement, the
-			// auto-increment setting and default value become relevant.
-			if col.Type == Integer && col.AutoInc {
-				row[i] = IntegerValue(col.NextVal)
-				col.NextVal++
-			} else if col.Default != nil {
-				row[i] = col.Default
-			}
-		}
-	} else {
-		// No names were given, so the values must be in table order.
-		copy(row, values)
+		// If the column was not specified in the insert statement, the
+		// auto-increment setting and default value become relevant.
+		row[i] = col.defaultValue(env)
 	}
 
-	// Enforce not-null constraints and coerce to the target data type.
+	tab.checkRow(env, row)
+	return row
+}
+
+// Coerces the values in a row to the types of their columns, in place, and
+// enforces not-null and check constraints.
+func (tab *Table) checkRow(env *Environment, row Row) {
 	for i, value := range row {
 		col := tab.Columns[i]
 		if value != nil {
 			row[i] = coerce(value, col.Type)
 		} else if !col.Nullable {
-			panic(fmt.Errorf("null value in column %q violates not-null constraint", col.Name))
+			panic(&ConstraintError{
+				Table: tab.Name,
+				Msg:   fmt.Sprintf("null value in column %q violates not-null constraint", col.Name),
+			})
+		}
+	}
+	if len(tab.Checks) == 0 {
+		return
+	}
+	ns := &currentRow{tableScope(tab, tab.Name), row, emptyNamespace{env}}
+	for _, check := range tab.Checks {
+		if v := evalExpr(ns, check.Expr); v != nil && !bool(v.toBoolean()) {
+			panic(&ConstraintError{
+				Table:      tab.Name,
+				Constraint: check.Name,
+				Msg:        fmt.Sprintf("new row for relation %q violates check constraint %q", tab.Name, check.Name),
+			})
+		}
+	}
+}
+
+// Returns the values of the given columns of a row.
+func project(row Row, cols []int) []Value {
+	values := make([]Value, len(cols))
+	for i, n := range cols {
+		values[i] = row[n]
+	}
+	return values
+}
+
+// An index of the rows of a table by their values in the columns of each of
+// the table's unique keys, which finds the row that has given values without
+// scanning the table. Rows with a null in a key's columns are not indexed,
+// since they never conflict.
+//
+// An index is never modified once it has been built, so that the copies of a
+// table can share it. When rows are appended to the table, the new index is a
+// layer over the old one that indexes only the new rows; layers are merged
+// when they grow to the size of the one below, so that there are few of them.
+type keyIndex struct {
+	data   []Row            // the rows that the index describes
+	cols   [][]int          // the columns of each key, in the order of the table's keys
+	first  int              // the index in data of the first row of this layer
+	rows   []map[string]int // by key, the index in data of each row of this layer by the rowKey of its values
+	parent *keyIndex        // the index of data[:first]; nil if first is 0
+}
+
+// Returns the index of the table's rows, building it if the table has no
+// index that describes its rows. Panics if two rows have the same values in
+// the columns of a key.
+func (tab *Table) keyIndex() *keyIndex {
+	if tab.index.describes(tab) {
+		return tab.index
+	}
+	idx := &keyIndex{data: tab.Data}
+	for _, key := range tab.Keys {
+		idx.cols = append(idx.cols, tab.colIndexes(key.Columns))
+		idx.rows = append(idx.rows, make(map[string]int, len(tab.Data)))
+	}
+	for i, row := range tab.Data {
+		for k, key := range tab.Keys {
+			if v, ok := idx.key(k, row); ok {
+				if _, dup := idx.rows[k][v]; dup {
+					panic(tab.uniqueViolation(key))
+				}
+				idx.rows[k][v] = i
+			}
+		}
+	}
+	tab.index = idx
+	return idx
+}
+
+// Reports whether the index describes the rows of the table. The index of a
+// table whose keys or columns change is discarded (see cloneSchema).
+func (idx *keyIndex) describes(tab *Table) bool {
+	return idx != nil && sameRows(idx.data, tab.Data) && len(idx.cols) == len(tab.Keys)
+}
+
+// Returns the rowKey of a row's values in the columns of the k'th key, or
+// false if any of them is null.
+func (idx *keyIndex) key(k int, row Row) (string, bool) {
+	values := project(row, idx.cols[k])
+	if anyNull(values) {
+		return "", false
+	}
+	return rowKey(values), true
+}
+
+// Returns the index of the row whose values in the columns of the k'th key
+// have the given rowKey, or -1 if there is none.
+func (idx *keyIndex) find(k int, v string) int {
+	for ; idx != nil; idx = idx.parent {
+		if i, ok := idx.rows[k][v]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the number of rows in the layer.
+func (idx *keyIndex) size() int {
+	return len(idx.data) - idx.first
+}
+
+// Returns the index of data, which consists of the rows that the index
+// describes followed by new rows.
+func (idx *keyIndex) extend(data []Row) *keyIndex {
+	if len(data) == len(idx.data) {
+		return idx
+	}
+	layer := &keyIndex{data: data, cols: idx.cols, first: len(idx.data), parent: idx}
+	for k := range idx.cols {
+		m := make(map[string]int, layer.size())
+		for i := layer.first; i < len(data); i++ {
+			if v, ok := layer.key(k, data[i]); ok {
+				m[v] = i
+			}
+		}
+		layer.rows = append(layer.rows, m)
+	}
+	for p := layer.parent; p != nil && p.size() <= layer.size(); p = layer.parent {
+		merged := &keyIndex{data: data, cols: idx.cols, first: p.first, parent: p.parent}
+		for k := range idx.cols {
+			m := make(map[string]int, len(p.rows[k])+len(layer.rows[k]))
+			for v, i := range p.rows[k] {
+				m[v] = i
+			}
+			for v, i := range layer.rows[k] {
+				m[v] = i
+			}
+			merged.rows = append(merged.rows, m)
 		}
+		layer = merged
+	}
+	return layer
+}
 
+// Returns the position among the table's keys of the key whose columns are
+// the named columns, in any order, and the rowKey of the given values of the
+// named columns in the order of the key's columns. Panics if there is no such
+// key.
+func (tab *Table) keyFor(names []string, values []Value) (int, string) {
+	for k, key := range tab.Keys {
+		if len(key.Columns) != len(names) {
+			continue
+		}
+		ordered := make([]Value, 0, len(names))
+		for _, col := range key.Columns {
+			for j, name := range names {
+				if name == col {
+					ordered = append(ordered, values[j])
+				}
+			}
+		}
+		if len(ordered) == len(names) {
+			return k, rowKey(ordered)
+		}
 	}
+	panic(fmt.Errorf("there is no unique constraint matching given keys for referenced table %q", tab.Name))
+}
 
-	// Append the row to the table.
-	tab.Data = append(tab.Data, row)
+// Reports whether one of the table's rows has the given values, none of which
+// is null, in the named columns, which must be those of a unique key.
+func (tab *Table) hasKey(names []string, values []Value) bool {
+	k, v := tab.keyFor(names, values)
+	return tab.keyIndex().find(k, v) >= 0
+}
+
+// Returns the error that reports a violation of a unique key.
+func (tab *Table) uniqueViolation(key *Key) error {
+	return &ConstraintError{
+		Table:      tab.Name,
+		Constraint: key.Name,
+		Msg:        fmt.Sprintf("duplicate key value violates unique constraint %q", key.Name),
+	}
 }
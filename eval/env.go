@@ -1,12 +1,39 @@
 package eval
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
 
 // Environment represents an evaluation context for SQL statements.
 type Environment struct {
-	tables map[string]*Table // key is table name
+	// RecursionLimit is the maximum number of iterations of a recursive
+	// query; zero means DefaultRecursionLimit. A query that exceeds the limit
+	// fails, on the assumption that it would never terminate.
+	RecursionLimit int
+
+	tables map[string]*Table      // key is table name
+	views  map[string]*view       // key is view name
+	funcs  map[string]*scalarFunc // user-defined functions; key is name
+	txn    *transaction           // nil unless a transaction is open
+
+	// The changes that statements made to the rows of tables, in order, if
+	// logRows is set, which a durable database logs when the transaction
+	// commits; see storage.append.
+	logRows bool
+	rowLog  []*rowChanges
+
+	// The select statements in which to replace "*" as they are evaluated;
+	// see view.expandQuery.
+	expanding map[*ast.SelectStmt]bool
 }
 
+// DefaultRecursionLimit is the default value of Environment.RecursionLimit.
+const DefaultRecursionLimit = 1000
+
 func (env *Environment) CreateTable(table *Table) error {
 	// Check for duplicate tables.
 	for name := range env.tables {
@@ -14,6 +41,23 @@ func (env *Environment) CreateTable(table *Table) error {
 			return fmt.Errorf("relation %q already exists", name)
 		}
 	}
+	if _, ok := env.views[table.Name]; ok {
+		return fmt.Errorf("relation %q already exists", table.Name)
+	}
+	if err := env.checkTable(table); err != nil {
+		return err
+	}
+	// OK: add the table.
+	if env.tables == nil {
+		env.tables = make(map[string]*Table)
+	}
+	env.tables[table.Name] = table
+	return nil
+}
+
+// Checks the columns and constraints of a table that is being created or
+// altered, and names the unnamed constraints.
+func (env *Environment) checkTable(table *Table) error {
 	// Check for duplicate columns.
 	seen := make(map[string]bool)
 	for _, col := range table.Columns {
@@ -22,18 +66,225 @@ func (env *Environment) CreateTable(table *Table) error {
 		}
 		seen[col.Name] = true
 	}
-	// OK: add the table.
-	if env.tables == nil {
-		env.tables = make(map[string]*Table)
+	// Check that keys refer to existing columns, and name the constraints.
+	names := make(map[string]bool)
+	for _, key := range table.Keys {
+		if key.Name != "" {
+			if names[key.Name] {
+				return fmt.Errorf("constraint %q for relation %q already exists", key.Name, table.Name)
+			}
+			names[key.Name] = true
+		}
+	}
+	for _, check := range table.Checks {
+		if check.Name != "" {
+			if names[check.Name] {
+				return fmt.Errorf("constraint %q for relation %q already exists", check.Name, table.Name)
+			}
+			names[check.Name] = true
+		}
+	}
+	for _, fk := range table.ForeignKeys {
+		if fk.Name != "" {
+			if names[fk.Name] {
+				return fmt.Errorf("constraint %q for relation %q already exists", fk.Name, table.Name)
+			}
+			names[fk.Name] = true
+		}
+	}
+	hasPrimaryKey := false
+	for _, key := range table.Keys {
+		if len(key.Columns) == 0 {
+			return fmt.Errorf("key of relation %q has no columns", table.Name)
+		}
+		for j, name := range key.Columns {
+			i := table.colIndex(name)
+			if i < 0 {
+				return fmt.Errorf("column %q named in key does not exist", name)
+			}
+			for _, prev := range key.Columns[:j] {
+				if prev == name {
+					return fmt.Errorf("column %q appears twice in key", name)
+				}
+			}
+			if key.Primary {
+				table.Columns[i].Nullable = false
+			}
+		}
+		if key.Primary {
+			if hasPrimaryKey {
+				return fmt.Errorf("multiple primary keys for table %q are not allowed", table.Name)
+			}
+			hasPrimaryKey = true
+		}
+		if key.Name == "" {
+			if key.Primary {
+				key.Name = uniqueName(names, table.Name+"_pkey")
+			} else {
+				key.Name = uniqueName(names, table.Name+"_"+strings.Join(key.Columns, "_")+"_key")
+			}
+		}
+	}
+	for _, check := range table.Checks {
+		if check.Name == "" {
+			// Name the check after the first column to which it refers.
+			base := table.Name + "_check"
+			if col := firstColumnRef(table, check.Expr); col != "" {
+				base = table.Name + "_" + col + "_check"
+			}
+			check.Name = uniqueName(names, base)
+		}
+	}
+	for _, fk := range table.ForeignKeys {
+		if fk.Name == "" {
+			fk.Name = uniqueName(names, table.Name+"_"+strings.Join(fk.Columns, "_")+"_fkey")
+		}
+		if err := env.checkForeignKey(table, fk); err != nil {
+			return err
+		}
 	}
-	env.tables[table.Name] = table
 	return nil
 }
 
-// Retrieves a table by name.
+// Checks that a foreign key of a new table refers to a unique key of an
+// existing table, or of the new table itself, with columns of the same types.
+// Fills in the referenced columns if they were omitted.
+func (env *Environment) checkForeignKey(table *Table, fk *ForeignKey) error {
+	ref := table
+	if fk.RefTable != table.Name {
+		var ok bool
+		if ref, ok = env.tables[fk.RefTable]; !ok {
+			if _, ok := env.views[fk.RefTable]; ok {
+				return fmt.Errorf("referenced relation %q is not a table", fk.RefTable)
+			}
+			return fmt.Errorf("relation %q does not exist", fk.RefTable)
+		}
+	}
+	switch {
+	case table.Temporary && !ref.Temporary:
+		return fmt.Errorf("constraints on temporary tables may reference only temporary tables")
+	case !table.Temporary && ref.Temporary:
+		return fmt.Errorf("constraints on permanent tables may reference only permanent tables")
+	}
+	if len(fk.RefColumns) == 0 {
+		key := ref.primaryKey()
+		if key == nil {
+			return fmt.Errorf("there is no primary key for referenced table %q", ref.Name)
+		}
+		fk.RefColumns = key.Columns
+	}
+	if len(fk.Columns) != len(fk.RefColumns) {
+		return fmt.Errorf("number of referencing and referenced columns for foreign key disagree")
+	}
+	for _, name := range fk.Columns {
+		if table.colIndex(name) < 0 {
+			return fmt.Errorf("column %q referenced in foreign key constraint does not exist", name)
+		}
+	}
+	for _, name := range fk.RefColumns {
+		if ref.colIndex(name) < 0 {
+			return fmt.Errorf("column %q referenced in foreign key constraint does not exist", name)
+		}
+	}
+	if ref.keyWithColumns(fk.RefColumns) == nil {
+		return fmt.Errorf("there is no unique constraint matching given keys for referenced table %q", ref.Name)
+	}
+	for i, name := range fk.Columns {
+		col, refCol := table.Columns[table.colIndex(name)], ref.Columns[ref.colIndex(fk.RefColumns[i])]
+		if col.Type != refCol.Type {
+			return fmt.Errorf("foreign key constraint %q cannot be implemented: "+
+				"key columns %q and %q are of incompatible types: %s and %s",
+				fk.Name, name, refCol.Name, col.Type, refCol.Type)
+		}
+	}
+	return nil
+}
+
+// DropTable removes a table from the environment. If other tables have
+// foreign keys that refer to the table, or views depend on it, DropTable
+// fails unless cascade is true, in which case it removes those foreign keys
+// and views.
+func (env *Environment) DropTable(name string, cascade bool) error {
+	if err := env.checkIsTable(name); err != nil {
+		return err
+	}
+	table := env.tables[name]
+	if views := env.dependentViews(name); len(views) != 0 {
+		if !cascade {
+			return fmt.Errorf("cannot drop table %q because view %q depends on it", name, views[0].name)
+		}
+		for _, v := range views {
+			env.dropView(v.name)
+		}
+	}
+	for _, ref := range env.references(table) {
+		if ref.table == table {
+			continue
+		}
+		if !cascade {
+			return fmt.Errorf("cannot drop table %q because constraint %q on table %q depends on it",
+				name, ref.fk.Name, ref.table.Name)
+		}
+		ref.table.dropForeignKey(ref.fk)
+	}
+	delete(env.tables, name)
+	return nil
+}
+
+// Returns name, or if name is in use, the first of name1, name2, etc., that
+// is not. Marks the result as in use.
+func uniqueName(used map[string]bool, name string) string {
+	result := name
+	for i := 1; used[result]; i++ {
+		result = name + strconv.Itoa(i)
+	}
+	used[result] = true
+	return result
+}
+
+// Returns the name of the first column of the table to which an expression
+// refers, or "" if there is none.
+func firstColumnRef(table *Table, expr ast.Expr) string {
+	var name string
+	walkColumnRefs(expr, func(_, col *ast.Ident) {
+		if name == "" && table.colIndex(col.Name) >= 0 {
+			name = col.Name
+		}
+	})
+	return name
+}
+
+// Calls fn for each column reference in an expression, in order, with the
+// table name and column name of the reference. The table name is nil if the
+// reference is not qualified. Function names are not column references.
+func walkColumnRefs(expr ast.Expr, fn func(table, col *ast.Ident)) {
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.Ident:
+			fn(nil, node)
+		case *ast.QualifiedIdent:
+			fn(node.Table, node.Name)
+			return nil
+		case *ast.FunctionCall:
+			for _, arg := range node.Args {
+				ast.Walk(arg, walk) // but not the function's name
+			}
+			return nil
+		}
+		return walk
+	}
+	ast.Walk(expr, walk)
+}
+
+// Retrieves a table by name. If the name refers to a view, evaluates the
+// view.
 func (env *Environment) lookupTable(name string) *Table {
 	if tab, ok := env.tables[name]; ok {
 		return tab
 	}
+	if v, ok := env.views[name]; ok {
+		return v.eval(env)
+	}
 	panic(fmt.Errorf("relation %q does not exist", name))
 }
@@ -22,3 +22,28 @@ func (err *Error) Error() string {
 func errorf(node ast.Node, format string, args ...interface{}) error {
 	return &Error{Msg: fmt.Sprintf(format, args...), Pos: node.Pos()}
 }
+
+// ConstraintError is an error that occurs when a statement would violate a
+// constraint on a table.
+type ConstraintError struct {
+	Table      string
+	Constraint string // name of the constraint; empty for NOT NULL
+	Msg        string
+}
+
+// Error implements the error interface.
+func (err *ConstraintError) Error() string {
+	return err.Msg
+}
+
+// SerializationError is an error that occurs when a transaction cannot be
+// committed because a concurrent transaction committed conflicting changes
+// first. The transaction has been rolled back, and may be retried.
+type SerializationError struct {
+	Msg string
+}
+
+// Error implements the error interface.
+func (err *SerializationError) Error() string {
+	return err.Msg
+}
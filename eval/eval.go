@@ -5,10 +5,18 @@ import (
 	"github.com/dcowgill/toysqleval/token"
 )
 
-// EvalStmt evaluates a statement and returns the result.
+// EvalStmt evaluates a statement and returns the result. A statement that
+// fails has no effect, even within a transaction.
 func EvalStmt(env *Environment, stmt ast.Node) (table *Table, err error) {
+	var before *snapshot
+	if mayChange(stmt) {
+		before = env.snapshot()
+	}
 	defer func() {
 		if r := recover(); r != nil {
+			if before != nil {
+				env.restore(before)
+			}
 			if e, ok := r.(error); ok {
 				err = e
 			} else {
@@ -20,190 +28,785 @@ func EvalStmt(env *Environment, stmt ast.Node) (table *Table, err error) {
 	case *ast.CreateTableStmt:
 		evalCreateTableStmt(env, stmt)
 		return
-	case *ast.SelectStmt:
-		table = evalSelectStmt(env, stmt)
+	case *ast.SelectStmt, *ast.CompoundSelectStmt, *ast.WithStmt:
+		if sel, ok := stmt.(*ast.SelectStmt); ok && sel.Into != nil {
+			evalSelectIntoStmt(env, sel)
+			return
+		}
+		table = evalQueryStmt(emptyNamespace{env}, stmt)
 		return
 	case *ast.InsertStmt:
-		evalInsertStmt(env, stmt)
+		table = evalInsertStmt(env, stmt)
 		return
 	case *ast.UpdateStmt:
-		evalUpdateStmt(env, stmt)
+		table = evalUpdateStmt(env, stmt)
 		return
 	case *ast.DeleteStmt:
-		evalDeleteStmt(env, stmt)
+		table = evalDeleteStmt(env, stmt)
+		return
+	case *ast.CreateViewStmt:
+		evalCreateViewStmt(env, stmt)
+		return
+	case *ast.DropViewStmt:
+		evalDropViewStmt(env, stmt)
+		return
+	case *ast.RefreshStmt:
+		evalRefreshStmt(env, stmt)
+		return
+	case *ast.BeginStmt:
+		evalBeginStmt(env, stmt)
+		return
+	case *ast.CommitStmt:
+		evalCommitStmt(env, stmt)
+		return
+	case *ast.RollbackStmt:
+		evalRollbackStmt(env, stmt)
+		return
+	case *ast.SavepointStmt:
+		evalSavepointStmt(env, stmt)
+		return
+	case *ast.ReleaseStmt:
+		evalReleaseStmt(env, stmt)
+		return
+	case *ast.DropTableStmt:
+		evalDropTableStmt(env, stmt)
+		return
+	case *ast.TruncateStmt:
+		evalTruncateStmt(env, stmt)
+		return
+	case *ast.AlterTableStmt:
+		evalAlterTableStmt(env, stmt)
 		return
 	}
 	return nil, errorf(stmt, "cannot evaluate non-statement %t", stmt)
 }
 
+// Reports whether a statement may change the tables or views of the
+// environment. Queries do not, except for SELECT ... INTO, and neither do
+// transaction control statements, which restore snapshots themselves.
+func mayChange(stmt ast.Node) bool {
+	switch stmt := stmt.(type) {
+	case *ast.SelectStmt:
+		return stmt.Into != nil
+	case *ast.CompoundSelectStmt, *ast.WithStmt:
+		return false
+	case *ast.BeginStmt, *ast.CommitStmt, *ast.RollbackStmt, *ast.SavepointStmt, *ast.ReleaseStmt:
+		return false
+	}
+	return true
+}
+
 // Evaluates a create table statement.
 func evalCreateTableStmt(env *Environment, stmt *ast.CreateTableStmt) {
-	table := &Table{Name: stmt.Table.Name}
+	if stmt.IfNotExists {
+		_, isTable := env.tables[stmt.Table.Name]
+		_, isView := env.views[stmt.Table.Name]
+		if isTable || isView {
+			return
+		}
+	}
+	if stmt.Query != nil {
+		result := evalQueryStmt(emptyNamespace{env}, stmt.Query)
+		createTableAs(env, stmt.Table.Name, stmt.Temporary, result)
+		return
+	}
+	table := &Table{Name: stmt.Table.Name, Temporary: stmt.Temporary}
 	for _, col := range stmt.Columns {
-		table.Columns = append(table.Columns, &Column{
-			Name:     col.Name.Name,
-			Type:     dataTypeFromToken(col, col.Type),
-			Nullable: col.Nullable,
-		})
+		table.Columns = append(table.Columns, newColumn(col))
+	}
+	for _, c := range stmt.Constraints {
+		addConstraint(table, c)
+	}
+	if err := env.CreateTable(table); err != nil {
+		panic(err)
+	}
+}
+
+// Evaluates a SELECT ... INTO statement, which creates a table from the
+// result of the query.
+func evalSelectIntoStmt(env *Environment, stmt *ast.SelectStmt) {
+	query := *stmt
+	query.Into = nil
+	result := evalSelectStmt(emptyNamespace{env}, &query)
+	createTableAs(env, stmt.Into.Name, stmt.IntoTemporary, result)
+}
+
+// Creates a table that holds the result of a query, for CREATE TABLE AS and
+// SELECT ... INTO. The columns have the types inferred for the result, and
+// are nullable. A column whose type is unknown, e.g. because all its values
+// are null, holds strings.
+func createTableAs(env *Environment, name string, temporary bool, result *Table) {
+	table := &Table{Name: name, Temporary: temporary}
+	for _, col := range result.Columns {
+		t := col.Type
+		if t == InvalidDataType {
+			t = String
+		}
+		table.Columns = append(table.Columns, &Column{Name: col.Name, Type: t, Nullable: true})
+	}
+	for _, row := range result.Data {
+		row = append(Row(nil), row...)
+		table.checkRow(env, row)
+		table.Data = append(table.Data, row)
 	}
 	if err := env.CreateTable(table); err != nil {
 		panic(err)
 	}
 }
 
-// Evaluates a select statement.
-func evalSelectStmt(env *Environment, stmt *ast.SelectStmt) *Table {
-	tableExpr, ok := stmt.Table.(*ast.Ident)
-	if !ok {
-		panic(errorf(stmt, "table subexpressions not supported"))
+// Evaluates a drop table statement. The tables are dropped together, so
+// foreign keys between them do not require CASCADE.
+func evalDropTableStmt(env *Environment, stmt *ast.DropTableStmt) {
+	dropped := make(map[string]bool)
+	for _, name := range stmt.Tables {
+		if _, ok := env.tables[name.Name]; ok {
+			dropped[name.Name] = true
+		} else if _, ok := env.views[name.Name]; ok {
+			panic(errorf(name, "%q is not a table", name.Name))
+		} else if !stmt.IfExists {
+			panic(errorf(name, "table %q does not exist", name.Name))
+		}
+	}
+	if !stmt.Cascade {
+		for _, name := range stmt.Tables {
+			if !dropped[name.Name] {
+				continue
+			}
+			env.checkViewDependents(name, dropped)
+			for _, ref := range env.references(env.tables[name.Name]) {
+				if !dropped[ref.table.Name] {
+					panic(errorf(name, "cannot drop table %q because constraint %q on table %q depends on it",
+						name.Name, ref.fk.Name, ref.table.Name))
+				}
+			}
+		}
 	}
-	table := env.lookupTable(tableExpr.Name)
+	for _, name := range stmt.Tables {
+		if _, ok := env.tables[name.Name]; ok {
+			if err := env.DropTable(name.Name, true); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
 
-	// Expand "select *".
-	projection := make([]ast.Expr, 0, len(stmt.Columns))
-	for _, expr := range stmt.Columns {
-		if _, ok := expr.(*ast.SelectStarExpr); ok {
-			for _, col := range table.Columns {
-				projection = append(projection, &ast.Ident{NamePos: expr.Pos(), Name: col.Name})
+// Evaluates a truncate statement, which deletes every row of the tables
+// without applying the actions of foreign keys. A table may not be truncated
+// unless the tables that refer to it are truncated too.
+func evalTruncateStmt(env *Environment, stmt *ast.TruncateStmt) {
+	tables := make([]*Table, len(stmt.Tables))
+	truncated := make(map[string]bool)
+	for i, name := range stmt.Tables {
+		env.checkNotView(name, "cannot truncate view %q")
+		tables[i] = env.lookupTable(name.Name)
+		truncated[name.Name] = true
+	}
+	for i, table := range tables {
+		for _, ref := range env.references(table) {
+			if !truncated[ref.table.Name] {
+				panic(errorf(stmt.Tables[i], "cannot truncate table %q because constraint %q on table %q refers to it",
+					table.Name, ref.fk.Name, ref.table.Name))
 			}
-		} else {
+		}
+	}
+	for _, table := range tables {
+		table.Data, table.base = nil, nil
+		env.refreshIncrementalViews(table.Name)
+	}
+}
+
+// Returns the column described by a column definition.
+func newColumn(col *ast.ColumnDefinition) *Column {
+	c := &Column{
+		Name:            col.Name.Name,
+		Type:            dataTypeFromToken(col, col.Type),
+		Nullable:        col.Nullable,
+		AutoInc:         col.AutoIncrement,
+		GeneratedAlways: col.GeneratedAlways,
+	}
+	if col.AutoIncrement {
+		if c.Type != Integer {
+			panic(errorf(col, "auto-increment column %q must be of type INTEGER", c.Name))
+		}
+		if col.DefaultValue != nil {
+			panic(errorf(col, "both default and auto-increment specified for column %q", c.Name))
+		}
+		c.NextVal = 1
+	}
+	if col.DefaultValue != nil {
+		validateDefaultExpr(col.DefaultValue)
+		c.DefaultExpr = col.DefaultValue
+	}
+	return c
+}
+
+// Adds a key, check or foreign key to a table. The constraint is validated
+// when the table is created or altered.
+func addConstraint(table *Table, c *ast.Constraint) {
+	var name string
+	if c.Name != nil {
+		name = c.Name.Name
+	}
+	switch c.Kind {
+	case token.Primary, token.Unique:
+		key := &Key{Name: name, Primary: c.Kind == token.Primary}
+		for _, col := range c.Columns {
+			key.Columns = append(key.Columns, col.Name)
+		}
+		table.Keys = append(table.Keys, key)
+	case token.Check:
+		validateCheckExpr(table, c.Check)
+		table.Checks = append(table.Checks, &Check{Name: name, Expr: c.Check})
+	case token.Foreign:
+		fk := &ForeignKey{
+			Name:     name,
+			RefTable: c.RefTable.Name,
+			OnDelete: c.OnDelete,
+			OnUpdate: c.OnUpdate,
+		}
+		for _, col := range c.Columns {
+			fk.Columns = append(fk.Columns, col.Name)
+		}
+		for _, col := range c.RefColumns {
+			fk.RefColumns = append(fk.RefColumns, col.Name)
+		}
+		table.ForeignKeys = append(table.ForeignKeys, fk)
+	}
+}
+
+// Panics unless an expression may be the default value of a column, which is
+// evaluated without reference to any row.
+func validateDefaultExpr(expr ast.Expr) {
+	var fn ast.WalkFunc
+	fn = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.Ident, *ast.QualifiedIdent:
+			panic(errorf(node, "cannot use column reference in DEFAULT expression"))
+		case *ast.SubqueryExpr:
+			panic(errorf(node, "cannot use subquery in DEFAULT expression"))
+		case *ast.FunctionCall:
+			for _, arg := range node.Args {
+				ast.Walk(arg, fn) // but not the function's name
+			}
+			return nil
+		}
+		return fn
+	}
+	ast.Walk(expr, fn)
+	if containsAggFunc(expr) {
+		panic(errorf(expr, "aggregate functions are not allowed in DEFAULT expressions"))
+	}
+	if containsWindowFunc(expr) {
+		panic(errorf(expr, "window functions are not allowed in DEFAULT expressions"))
+	}
+}
+
+// Panics unless an expression may be the condition of a check constraint on a
+// table, which is evaluated against a single row of the table.
+func validateCheckExpr(table *Table, expr ast.Expr) {
+	var fn ast.WalkFunc
+	fn = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.Ident:
+			if table.colIndex(node.Name) < 0 {
+				panic(errorf(node, "column %q does not exist", node.Name))
+			}
+		case *ast.QualifiedIdent:
+			if node.Table.Name != table.Name {
+				panic(errorf(node, "missing FROM-clause entry for table %q", node.Table.Name))
+			}
+			if table.colIndex(node.Name.Name) < 0 {
+				panic(errorf(node, "column %s.%s does not exist", node.Table.Name, node.Name.Name))
+			}
+			return nil
+		case *ast.SubqueryExpr:
+			panic(errorf(node, "cannot use subquery in check constraint"))
+		case *ast.FunctionCall:
+			for _, arg := range node.Args {
+				ast.Walk(arg, fn) // but not the function's name
+			}
+			return nil
+		}
+		return fn
+	}
+	ast.Walk(expr, fn)
+	if containsAggFunc(expr) {
+		panic(errorf(expr, "aggregate functions are not allowed in check constraints"))
+	}
+	if containsWindowFunc(expr) {
+		panic(errorf(expr, "window functions are not allowed in check constraints"))
+	}
+}
+
+// Evaluates a select statement. Column names that cannot be resolved in the
+// FROM clause are looked up in the outer namespace.
+func evalSelectStmt(outer namespace, stmt *ast.SelectStmt) *Table {
+	if stmt.Into != nil {
+		panic(errorf(stmt.Into, "SELECT ... INTO is not allowed here"))
+	}
+	rel := evalTableExpr(outer, stmt.Table)
+	if outer.environment().expanding[stmt] {
+		stmt.Columns = expandStars(stmt.Columns, rel.scope)
+	}
+	projection, names := expandProjection(stmt.Columns, rel.scope)
+
+	// Append the ORDER BY keys, then the DISTINCT ON keys, to the projection
+	// as hidden columns, so that both code paths below compute them alongside
+	// the visible columns.
+	numVisible := len(projection)
+	orderBy := resolveOrderBy(stmt.OrderBy, projection, names)
+	if stmt.Distinct && len(stmt.DistinctOn) == 0 {
+		validateDistinctOrderBy(orderBy, projection)
+	}
+	projection = append(projection, orderBy...)
+	distinctOn := resolveOutputRefs("DISTINCT ON", stmt.DistinctOn, projection[:numVisible], names)
+	projection = append(projection, distinctOn...)
+
+	// Append the inputs of any window functions, which must be computed
+	// before the window functions themselves.
+	windows := findWindowCalls(stmt, projection)
+	numOutputs := len(projection)
+	for _, w := range windows {
+		w.start = len(projection)
+		projection = append(projection, w.inputs()...)
+	}
+
+	// Different code path for selects with aggregate functions or grouping.
+	var outputs []*outputRow
+	if isAggregateSelect(stmt, projection) {
+		outputs = evalAggregateSelectStmt(outer, stmt, rel, projection)
+	} else {
+		outputs = evalPlainSelectStmt(outer, stmt, rel, projection)
+	}
+	rows := evalOutputRows(outer, outputs, windows, numOutputs)
+
+	// Sort, then remove duplicates, then apply the offset and limit, then drop
+	// the hidden columns.
+	sortRows(stmt.OrderBy, rows, numVisible)
+	if stmt.Distinct {
+		keyStart, keyEnd := 0, numVisible
+		if len(stmt.DistinctOn) != 0 {
+			keyStart, keyEnd = numVisible+len(orderBy), numVisible+len(orderBy)+len(distinctOn)
+		}
+		rows = distinctRows(rows, keyStart, keyEnd)
+	}
+	rows = limitRows(outer, stmt.Limit, stmt.Offset, rows)
+	for i, row := range rows {
+		rows[i] = row[:numVisible]
+	}
+	ns := &currentRow{rel.scope, nil, outer}
+	return &Table{Columns: resultColumns(ns, projection[:numVisible], names, rows), Data: rows}
+}
+
+// Expands "*" and "t.*" in a projection to the columns in scope, removes
+// aliases, and returns the resulting expressions and the names of the result
+// columns.
+func expandProjection(exprs []ast.Expr, sc scope) ([]ast.Expr, []string) {
+	exprs = expandStars(exprs, sc)
+	projection := make([]ast.Expr, 0, len(exprs))
+	names := make([]string, 0, len(exprs))
+	for _, expr := range exprs {
+		switch expr := expr.(type) {
+		case *ast.AliasedExpr:
+			projection = append(projection, expr.Expr)
+			names = append(names, expr.Alias.Name)
+		default:
 			projection = append(projection, expr)
+			names = append(names, columnName(expr))
 		}
 	}
+	return projection, names
+}
 
-	// Different code path for selects with aggregate functions.
+// Returns a projection in which "*" and "t.*" are replaced by references to
+// the columns in scope.
+func expandStars(exprs []ast.Expr, sc scope) []ast.Expr {
+	expanded := make([]ast.Expr, 0, len(exprs))
+	for _, expr := range exprs {
+		star, ok := expr.(*ast.SelectStarExpr)
+		if !ok {
+			expanded = append(expanded, expr)
+			continue
+		}
+		if star.Table != nil && !sc.hasTable(star.Table.Name) {
+			panic(errorf(star, "missing FROM-clause entry for table %q", star.Table.Name))
+		}
+		for _, c := range sc {
+			if star.Table == nil || star.Table.Name == c.table {
+				expanded = append(expanded, &ast.QualifiedIdent{
+					Table: &ast.Ident{NamePos: star.Pos(), Name: c.table},
+					Name:  &ast.Ident{NamePos: star.Pos(), Name: c.col.Name},
+				})
+			}
+		}
+	}
+	return expanded
+}
+
+// Reports whether a select statement requires aggregation.
+func isAggregateSelect(stmt *ast.SelectStmt, projection []ast.Expr) bool {
+	if len(stmt.GroupBy) != 0 || stmt.Having != nil {
+		return true
+	}
 	for _, expr := range projection {
 		if containsAggFunc(expr) {
-			return evalAggregateSelectStmt(env, stmt, table, projection)
+			return true
 		}
 	}
+	return false
+}
 
-	// Generate the result set: select first, then project.
-	var results []Row
-	for _, row := range table.Data {
-		ns := &currentRow{table, row}
-		if stmt.Where != nil {
-			if !bool(evalExpr(ns, stmt.Where).toBoolean()) {
-				continue // row does not match
-			}
+// A row of the result of a select statement, before it has been evaluated:
+// the projected expressions and the namespace in which to evaluate them.
+type outputRow struct {
+	ns    namespace
+	exprs []ast.Expr
+}
+
+// Evaluates the output rows of a select statement. The first numOutputs
+// expressions of each row are the result columns; the rest are the inputs of
+// the window functions, which are evaluated first.
+func evalOutputRows(outer namespace, outputs []*outputRow, windows []*windowCall, numOutputs int) []Row {
+	rows := make([]Row, len(outputs))
+	for i, out := range outputs {
+		rows[i] = make(Row, len(out.exprs))
+		for j := numOutputs; j < len(out.exprs); j++ {
+			rows[i][j] = evalExpr(out.ns, out.exprs[j])
+		}
+	}
+	values := evalWindowCalls(outer, windows, rows)
+	for i, out := range outputs {
+		ns := out.ns
+		if values != nil {
+			ns = &windowRow{ns, values[i]}
 		}
-		result := make(Row, len(projection))
-		for i, expr := range projection {
-			result[i] = evalExpr(ns, expr)
+		for j := 0; j < numOutputs; j++ {
+			rows[i][j] = evalExpr(ns, out.exprs[j])
 		}
-		results = append(results, result)
 	}
+	return rows
+}
 
-	// Create column names for the result set.
-	meta := make([]*Column, len(projection))
-	for i, expr := range projection {
-		name := "?"
-		if ident, ok := expr.(*ast.Ident); ok {
-			name = ident.Name
+// Evaluates a select statement that does not require aggregation, returning
+// one output row per row that satisfies the where clause.
+func evalPlainSelectStmt(outer namespace, stmt *ast.SelectStmt, rel *relation, projection []ast.Expr) []*outputRow {
+	if stmt.Where != nil && containsWindowFunc(stmt.Where) {
+		panic(errorf(stmt.Where, "window functions are not allowed in WHERE"))
+	}
+	var outputs []*outputRow
+	for _, row := range rel.rows {
+		ns := &currentRow{rel.scope, row, outer}
+		if stmt.Where != nil {
+			if !isTrue(evalExpr(ns, stmt.Where)) {
+				continue // row does not match
+			}
 		}
-		meta[i] = &Column{Name: name}
+		outputs = append(outputs, &outputRow{ns, projection})
 	}
-
-	return &Table{Columns: meta, Data: results}
+	return outputs
 }
 
 // Evaluates a select statement whose projection includes one or more aggregate
-// functions, but does not have a GROUP BY clause.
-func evalAggregateSelectStmt(env *Environment, stmt *ast.SelectStmt, table *Table, projection []ast.Expr) *Table {
-	// Rewrite each projection, accumulating aggFuncs.
-	var rewriter aggFuncRewriter
-	for i, expr := range projection {
-		validateAggExpr(expr)
-		projection[i] = rewriter.rewrite(expr)
+// functions, or which has a GROUP BY or HAVING clause, returning one output
+// row per group.
+func evalAggregateSelectStmt(outer namespace, stmt *ast.SelectStmt, rel *relation, projection []ast.Expr) []*outputRow {
+	// Verify that every column reference is either grouped or aggregated.
+	for _, expr := range stmt.GroupBy {
+		if containsAggFunc(expr) {
+			panic(errorf(expr, "aggregate functions are not allowed in GROUP BY"))
+		}
+		if containsWindowFunc(expr) {
+			panic(errorf(expr, "window functions are not allowed in GROUP BY"))
+		}
+	}
+	if stmt.Where != nil && containsWindowFunc(stmt.Where) {
+		panic(errorf(stmt.Where, "window functions are not allowed in WHERE"))
+	}
+	if stmt.Having != nil && containsWindowFunc(stmt.Having) {
+		panic(errorf(stmt.Having, "window functions are not allowed in HAVING"))
 	}
-	// Pass every row that satisfies the where clause to every aggregate.
-	matched := false
-	for _, row := range table.Data {
-		ns := &currentRow{table, row}
+	for _, expr := range projection {
+		validateAggExpr(expr, stmt.GroupBy)
+	}
+	if stmt.Having != nil {
+		validateAggExpr(stmt.Having, stmt.GroupBy)
+	}
+	// Partition the rows that satisfy the where clause into groups, passing
+	// each row to its group's aggregates. Without a GROUP BY clause, every row
+	// belongs to the same group. Groups are kept in order of first appearance.
+	var groups []*rowGroup
+	index := make(map[string]*rowGroup)
+	for _, row := range rel.rows {
+		ns := &currentRow{rel.scope, row, outer}
 		if stmt.Where != nil {
-			if !bool(evalExpr(ns, stmt.Where).toBoolean()) {
+			if !isTrue(evalExpr(ns, stmt.Where)) {
 				continue
 			}
 		}
-		for _, fn := range rewriter.funcs {
+		key := make([]Value, len(stmt.GroupBy))
+		for i, expr := range stmt.GroupBy {
+			key[i] = evalExpr(ns, expr)
+		}
+		g, ok := index[rowKey(key)]
+		if !ok {
+			g = newRowGroup(ns, projection, stmt.Having)
+			index[rowKey(key)] = g
+			groups = append(groups, g)
+		}
+		for _, fn := range g.funcs {
 			fn.step(ns)
 		}
-		matched = true
 	}
-	// Build the result row using the output of the aggregate functions. If we
-	// did not match a single row, however, return an empty result set.
-	var data []Row
-	if matched {
-		result := make(Row, len(projection))
-		for i, expr := range projection {
-			result[i] = evalExpr(emptyNamespace{}, expr)
+	// Without a GROUP BY clause, there is exactly one group even if no rows
+	// matched, so that e.g. "SELECT count(*) FROM t WHERE false" returns zero.
+	if len(stmt.GroupBy) == 0 && len(groups) == 0 {
+		ns := &currentRow{rel.scope, make(Row, len(rel.scope)), outer}
+		groups = append(groups, newRowGroup(ns, projection, stmt.Having))
+	}
+	// Build an output row for each group that satisfies the having clause.
+	var outputs []*outputRow
+	for _, g := range groups {
+		if g.having != nil {
+			if !isTrue(evalExpr(g.ns, g.having)) {
+				continue
+			}
 		}
-		data = []Row{result}
+		outputs = append(outputs, &outputRow{g.ns, g.projection})
 	}
-	// Create the table metadata and return the result.
-	meta := make([]*Column, len(projection))
-	for i := range projection {
-		meta[i] = &Column{Name: "?"}
+	return outputs
+}
+
+// Represents one group of rows in an aggregate select statement. Each group
+// has its own copies of the aggregate functions in the projection and in the
+// having clause, so that they accumulate only the group's rows.
+type rowGroup struct {
+	ns         namespace  // the first row in the group
+	projection []ast.Expr // rewritten projection
+	having     ast.Expr   // rewritten having clause, or nil
+	funcs      []aggFunc  // aggregates in projection and having
+}
+
+// Creates a new group whose first row is ns.
+func newRowGroup(ns namespace, projection []ast.Expr, having ast.Expr) *rowGroup {
+	var rewriter aggFuncRewriter
+	g := &rowGroup{ns: ns, projection: make([]ast.Expr, len(projection))}
+	for i, expr := range projection {
+		g.projection[i] = rewriter.rewrite(expr)
+	}
+	if having != nil {
+		g.having = rewriter.rewrite(having)
 	}
-	return &Table{Columns: meta, Data: data}
+	g.funcs = rewriter.funcs
+	return g
 }
 
-// Evaluates an insert statement.
-func evalInsertStmt(env *Environment, stmt *ast.InsertStmt) {
+// Evaluates an insert statement. Returns the result of its RETURNING clause,
+// which covers the rows it inserted or updated, or nil if it has none.
+func evalInsertStmt(env *Environment, stmt *ast.InsertStmt) *Table {
+	env.checkNotView(stmt.Table, "cannot insert into view %q")
 	table := env.lookupTable(stmt.Table.Name)
-	names := make([]string, len(stmt.Columns))
-	for i, col := range stmt.Columns {
-		names[i] = col.Name
+	returning := newReturningClause(table, stmt.Returning)
+	upsert := newUpsert(env, table, stmt.OnConflict)
+	names := table.columnNames() // the default target columns
+	if len(stmt.Columns) != 0 {
+		names = make([]string, len(stmt.Columns))
+		for i, col := range stmt.Columns {
+			if table.colIndex(col.Name) < 0 {
+				panic(errorf(col, "column %q of relation %q does not exist", col.Name, table.Name))
+			}
+			for _, prev := range names[:i] {
+				if prev == col.Name {
+					panic(errorf(col, "column %q specified more than once", col.Name))
+				}
+			}
+			names[i] = col.Name
+		}
+	}
+	// Build every row before inserting any, so that "INSERT INTO t SELECT ...
+	// FROM t" does not see its own rows.
+	var rows []Row
+	if stmt.Query != nil {
+		result := evalQueryStmt(emptyNamespace{env}, stmt.Query)
+		for _, values := range result.Data {
+			rows = append(rows, table.newRow(env, names, values))
+		}
+	} else {
+		for _, exprs := range stmt.Values {
+			targets, values := evalValuesRow(env, names, exprs)
+			rows = append(rows, table.newRow(env, targets, values))
+		}
 	}
-	values := make([]Value, len(stmt.Values))
-	for i, expr := range stmt.Values {
-		values[i] = evalExpr(emptyNamespace{}, expr) // no symbol table here
+	// Conflicts between the new rows, and with the existing rows, are found
+	// by the upsert as the rows are inserted, and otherwise by commit.
+	cs := newChangeSet(env)
+	tc := cs.change(table)
+	var changed []Row
+	for _, row := range rows {
+		if upsert == nil {
+			tc.insert(row)
+			changed = append(changed, row)
+			continue
+		}
+		if i := upsert.findConflict(tc, row); i >= 0 {
+			if updated := upsert.resolve(cs, tc, i, row); updated != nil {
+				changed = append(changed, updated)
+			}
+			continue
+		}
+		upsert.insert(tc, row)
+		changed = append(changed, row)
 	}
-	table.insert(names, values)
+	cs.commit()
+	return returning.eval(env, changed)
 }
 
-// Evaluates an update statement.
-func evalUpdateStmt(env *Environment, stmt *ast.UpdateStmt) {
+// Evaluates a row of the VALUES list of an insert statement, whose target
+// columns are named by names. Returns the names and values of the columns
+// whose value is not DEFAULT; the others will get their default values.
+func evalValuesRow(env *Environment, names []string, exprs []ast.Expr) ([]string, []Value) {
+	if len(exprs) != len(names) {
+		return names, make([]Value, len(exprs)) // newRow will report the error
+	}
+	targets := make([]string, 0, len(exprs))
+	values := make([]Value, 0, len(exprs))
+	for i, expr := range exprs {
+		if _, ok := expr.(*ast.Default); ok {
+			continue
+		}
+		targets = append(targets, names[i])
+		values = append(values, evalExpr(emptyNamespace{env}, expr)) // no symbol table here
+	}
+	return targets, values
+}
+
+// Evaluates an update statement. Returns the result of its RETURNING clause,
+// or nil if it has none.
+func evalUpdateStmt(env *Environment, stmt *ast.UpdateStmt) *Table {
+	env.checkNotView(stmt.Table, "cannot update view %q")
 	table := env.lookupTable(stmt.Table.Name)
-	for _, row := range table.Data {
+	returning := newReturningClause(table, stmt.Returning)
+	sc := tableScope(table, table.Name)
+	columns := make([]int, len(stmt.Columns))
+	for i, name := range stmt.Columns {
+		if columns[i] = table.colIndex(name.Name); columns[i] < 0 {
+			panic(errorf(name, "column %q of relation %q does not exist", name.Name, table.Name))
+		}
+	}
+	// Record the new rows in a change set, which checks them all before
+	// modifying the table, so that the statement either succeeds or has no
+	// effect.
+	cs := newChangeSet(env)
+	tc := cs.change(table)
+	var indexes []int
+	for i, row := range table.Data {
 		// First step: select.
-		ns := &currentRow{table, row}
+		ns := &currentRow{sc, row, emptyNamespace{env}}
 		if stmt.Where != nil {
-			if !bool(evalExpr(ns, stmt.Where).toBoolean()) {
+			if !isTrue(evalExpr(ns, stmt.Where)) {
 				continue
 			}
 		}
-		// Second step: apply the SET clause.
-		for i, name := range stmt.Columns {
-			n := table.colIndex(name.Name)
-			if n < 0 {
-				panic(errorf(name, "column %q of relation %q does not exist", name.Name, table.Name))
-			}
-			row[n] = evalExpr(ns, stmt.Values[i])
+		// Second step: apply the SET clause. Every expression sees the old row.
+		newRow := append(Row{}, row...)
+		for j, n := range columns {
+			newRow[n] = evalAssignment(ns, table.Columns[n], stmt.Values[j])
 		}
+		cs.update(tc, i, newRow)
+		indexes = append(indexes, i)
 	}
+	cs.commit()
+	updated := make([]Row, len(indexes))
+	for j, i := range indexes {
+		updated[j] = tc.row(i)
+	}
+	return returning.eval(env, updated)
 }
 
-// Evaluates a delete statement.
-func evalDeleteStmt(env *Environment, stmt *ast.DeleteStmt) {
+// Evaluates the new value of a column in the SET clause of an UPDATE or ON
+// CONFLICT DO UPDATE, in which DEFAULT stands for the column's default value.
+func evalAssignment(ns namespace, col *Column, expr ast.Expr) Value {
+	if _, ok := expr.(*ast.Default); ok {
+		return col.defaultValue(ns.environment())
+	}
+	if col.GeneratedAlways {
+		panic(errorf(expr, "column %q can only be updated to DEFAULT", col.Name))
+	}
+	return evalExpr(ns, expr)
+}
+
+// Evaluates a delete statement. Returns the result of its RETURNING clause,
+// or nil if it has none.
+func evalDeleteStmt(env *Environment, stmt *ast.DeleteStmt) *Table {
+	env.checkNotView(stmt.Table, "cannot delete from view %q")
 	table := env.lookupTable(stmt.Table.Name)
-	var newData []Row
-	for _, row := range table.Data {
-		ns := &currentRow{table, row}
+	returning := newReturningClause(table, stmt.Returning)
+	sc := tableScope(table, table.Name)
+	cs := newChangeSet(env)
+	tc := cs.change(table)
+	var deleted []Row
+	for i, row := range table.Data {
+		ns := &currentRow{sc, row, emptyNamespace{env}}
 		if stmt.Where != nil {
-			if !bool(evalExpr(ns, stmt.Where).toBoolean()) {
-				newData = append(newData, row)
+			if !isTrue(evalExpr(ns, stmt.Where)) {
+				continue
 			}
 		}
+		cs.delete(tc, i)
+		deleted = append(deleted, row)
 	}
-	table.Data = newData
+	cs.commit()
+	return returning.eval(env, deleted)
+}
+
+// The RETURNING clause of a data-modifying statement, which is evaluated for
+// each of the rows that the statement inserted, updated or deleted.
+type returningClause struct {
+	scope      scope
+	projection []ast.Expr
+	names      []string
+}
+
+// Validates the RETURNING clause of a statement that modifies a table, before
+// the statement has any effect. Returns nil if there is no RETURNING clause.
+func newReturningClause(table *Table, exprs []ast.Expr) *returningClause {
+	if len(exprs) == 0 {
+		return nil
+	}
+	sc := tableScope(table, table.Name)
+	projection, names := expandProjection(exprs, sc)
+	for _, expr := range projection {
+		if containsAggFunc(expr) {
+			panic(errorf(expr, "aggregate functions are not allowed in RETURNING"))
+		}
+		if containsWindowFunc(expr) {
+			panic(errorf(expr, "window functions are not allowed in RETURNING"))
+		}
+	}
+	return &returningClause{sc, projection, names}
+}
+
+// Evaluates the RETURNING clause for the given rows. Returns nil if rc is nil.
+func (rc *returningClause) eval(env *Environment, rows []Row) *Table {
+	if rc == nil {
+		return nil
+	}
+	result := make([]Row, len(rows))
+	for i, row := range rows {
+		ns := &currentRow{rc.scope, row, emptyNamespace{env}}
+		result[i] = make(Row, len(rc.projection))
+		for j, expr := range rc.projection {
+			result[i][j] = evalExpr(ns, expr)
+		}
+	}
+	ns := &currentRow{rc.scope, nil, emptyNamespace{env}}
+	return &Table{Columns: resultColumns(ns, rc.projection, rc.names, result), Data: result}
 }
 
 // Evaluates an expression.
 func evalExpr(ns namespace, expr ast.Expr) Value {
 	switch expr := expr.(type) {
-	case *ast.Ident:
-		return ns.lookup(expr.Name)
+	case *ast.Ident, *ast.QualifiedIdent:
+		return ns.lookup(expr)
 	case *ast.IntegerLiteral:
 		return IntegerValue(expr.Value)
 	case *ast.NumberLiteral:
@@ -219,51 +822,175 @@ func evalExpr(ns namespace, expr ast.Expr) Value {
 		return evalBinaryExpr(ns, expr)
 	case *ast.UnaryExpr:
 		return evalUnaryExpr(ns, expr)
+	case *ast.IsExpr:
+		return evalIsExpr(ns, expr)
+	case *ast.LikeExpr:
+		return evalLikeExpr(ns, expr)
+	case *ast.BetweenExpr:
+		return evalBetweenExpr(ns, expr)
+	case *ast.CaseExpr:
+		return evalCaseExpr(ns, expr)
+	case *ast.CastExpr:
+		value := evalExpr(ns, expr.Expr)
+		if value == nil {
+			return nil
+		}
+		return coerceAt(expr, value, dataTypeFromToken(expr, expr.Type))
+	case *ast.SubqueryExpr:
+		return evalScalarSubquery(ns, expr)
 	case *ast.FunctionCall:
-		panic(errorf(expr, "non-aggregate functions are not implemented"))
+		if expr.Over != nil {
+			return ns.windowValue(expr)
+		}
+		return evalFunctionCall(ns, expr)
 	case aggFunc:
 		return expr.finalize()
+	case *ast.Default:
+		panic(errorf(expr, "DEFAULT is not allowed in this context"))
 	}
 	panic(errorf(expr, "cannot evaluate expression of type %T", expr))
 }
 
 // Evaluates a binary expression.
 func evalBinaryExpr(ns namespace, expr *ast.BinaryExpr) Value {
+	if expr.Op == token.In {
+		return evalInExpr(ns, expr)
+	}
 	lhs := evalExpr(ns, expr.Lhs)
 	rhs := evalExpr(ns, expr.Rhs)
 	switch expr.Op {
 	case token.And, token.Or:
-		return BooleanValue(logicalBooleanOp(expr, lhs, rhs))
+		return logicalBooleanOp(expr, lhs, rhs)
 	case token.Equal, token.GreaterThan, token.GreaterThanOrEqualTo,
 		token.LessThan, token.LessThanOrEqualTo, token.NotEqual:
-		return BooleanValue(comparisonOp(expr, lhs, rhs))
+		return comparisonOp(expr, lhs, rhs)
 	case token.Plus, token.Minus, token.Mul, token.Div:
 		return arithmeticOp(expr, lhs, rhs)
 	case token.Concat:
 		return concatOp(expr, lhs, rhs)
+	case token.RegexMatch, token.RegexIMatch, token.NotRegexMatch, token.NotRegexIMatch:
+		return regexMatchOp(expr, lhs, rhs)
 	}
 	panic(errorf(expr, "invalid binary operator: %s", expr.Op))
 }
 
-// Computes (lhs && rhs) or (lhs || rhs), depending on op.
-func logicalBooleanOp(expr *ast.BinaryExpr, lhs, rhs Value) bool {
-	x := bool(lhs.toBoolean())
-	y := bool(rhs.toBoolean())
+// Computes (lhs AND rhs) or (lhs OR rhs), depending on op, using SQL's
+// three-valued logic, in which null means "unknown".
+func logicalBooleanOp(expr *ast.BinaryExpr, lhs, rhs Value) Value {
 	switch expr.Op {
 	case token.And:
-		return x && y
+		return and3(lhs, rhs)
 	case token.Or:
-		return x || y
+		return or3(lhs, rhs)
 	}
 	panic(errorf(expr, "invalid logical boolean op: %s", expr.Op))
 }
 
+// Computes (lhs AND rhs) using three-valued logic: the result is false if
+// either side is false, even if the other is unknown.
+func and3(lhs, rhs Value) Value {
+	x, y := lhs != nil && bool(lhs.toBoolean()), rhs != nil && bool(rhs.toBoolean())
+	switch {
+	case lhs != nil && !x, rhs != nil && !y:
+		return BooleanValue(false)
+	case lhs == nil || rhs == nil:
+		return nil
+	}
+	return BooleanValue(true)
+}
+
+// Computes (lhs OR rhs) using three-valued logic: the result is true if either
+// side is true, even if the other is unknown.
+func or3(lhs, rhs Value) Value {
+	x, y := lhs != nil && bool(lhs.toBoolean()), rhs != nil && bool(rhs.toBoolean())
+	switch {
+	case x, y:
+		return BooleanValue(true)
+	case lhs == nil || rhs == nil:
+		return nil
+	}
+	return BooleanValue(false)
+}
+
+// Reports whether a value is true. Null ("unknown") is not true, so rows for
+// which a WHERE, HAVING or ON condition is unknown do not match.
+func isTrue(v Value) bool {
+	return v != nil && bool(v.toBoolean())
+}
+
+// Evaluates an "IS [NOT] ..." predicate. Unlike most predicates, the result is
+// never null.
+func evalIsExpr(ns namespace, expr *ast.IsExpr) Value {
+	value := evalExpr(ns, expr.Expr)
+	var result bool
+	switch expr.Kind {
+	case token.Null:
+		result = value == nil
+	case token.Unknown:
+		if value != nil {
+			value.toBoolean() // panics unless value is a boolean
+		}
+		result = value == nil
+	case token.True:
+		result = isTrue(value)
+	case token.False:
+		result = value != nil && !bool(value.toBoolean())
+	case token.Distinct:
+		other := evalExpr(ns, expr.From)
+		switch {
+		case value == nil || other == nil:
+			result = value != other
+		default:
+			result = compareValues(expr, value, other) != 0
+		}
+	default:
+		panic(errorf(expr, "invalid IS predicate: %s", expr.Kind))
+	}
+	if expr.Not {
+		result = !result
+	}
+	return BooleanValue(result)
+}
+
+// Evaluates a CASE expression. The result is that of the first WHEN clause
+// whose condition is true or, in a simple CASE, whose value equals the
+// operand; if there is none, the result is the ELSE value, or else null.
+func evalCaseExpr(ns namespace, expr *ast.CaseExpr) Value {
+	var operand Value
+	if expr.Operand != nil {
+		operand = evalExpr(ns, expr.Operand)
+	}
+	for _, when := range expr.Whens {
+		cond := evalExpr(ns, when.Cond)
+		if expr.Operand == nil {
+			if !isTrue(cond) {
+				continue
+			}
+		} else if operand == nil || cond == nil || compareValues(when.Cond, operand, cond) != 0 {
+			continue
+		}
+		return evalExpr(ns, when.Result)
+	}
+	if expr.Else != nil {
+		return evalExpr(ns, expr.Else)
+	}
+	return nil
+}
+
 // Evaluates a unary expression.
 func evalUnaryExpr(ns namespace, expr *ast.UnaryExpr) Value {
+	if expr.Op == token.Exists {
+		return evalExistsSubquery(ns, expr)
+	}
 	value := evalExpr(ns, expr.Expr)
 	switch expr.Op {
 	case token.Plus, token.Minus:
 		return unaryArithOp(expr, value)
+	case token.Not:
+		if value == nil {
+			return nil
+		}
+		return !value.toBoolean()
 	}
 	panic(errorf(expr, "invalid unary operator: %s", expr.Op))
 }
@@ -1,15 +1,23 @@
 package eval_test
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 	"unicode"
 
+	"github.com/dcowgill/toysqleval/ast"
 	"github.com/dcowgill/toysqleval/eval"
 	"github.com/dcowgill/toysqleval/lexer"
 	"github.com/dcowgill/toysqleval/parser"
@@ -138,3 +146,1016 @@ func must(err error) {
 		panic(err)
 	}
 }
+
+// Verifies that user-defined scalar functions can be registered and called.
+func TestRegisterFunc(t *testing.T) {
+	var env eval.Environment
+	sig := eval.Signature{Args: []eval.DataType{eval.Integer}, Result: eval.Integer, Strict: true}
+	double := func(args []eval.Value) (eval.Value, error) {
+		return args[0].(eval.IntegerValue) * 2, nil
+	}
+	must(env.RegisterFunc("Double", sig, double))
+	if err := env.RegisterFunc("double", sig, double); err == nil {
+		t.Fatalf("registered function twice, want error")
+	}
+	if err := env.RegisterFunc("sum", sig, double); err == nil {
+		t.Fatalf("registered function named after an aggregate, want error")
+	}
+	stmts, err := parser.Parse(lexer.New("select double(21), double('4'), double(null);"))
+	must(err)
+	result, err := eval.EvalStmt(&env, stmts[0])
+	must(err)
+	row := result.Data[0]
+	if row[0] != eval.IntegerValue(42) || row[1] != eval.IntegerValue(8) || row[2] != nil {
+		t.Fatalf("wrong result: %v", row)
+	}
+}
+
+// Verifies that the columns of a result carry their inferred types.
+func TestResultColumns(t *testing.T) {
+	var env eval.Environment
+	stmts, err := parser.Parse(lexer.New(`
+		create table t (id integer not null, name varchar, score number);
+		select id, id + 1 as next, name || '!', score * 2 s, count(*) over_all,
+			sum(id), coalesce(name, '?'), id > 0, cast(id as varchar), (select 1.5)
+		from t group by id, name, score;
+		select t.id, u.id from t left join t u on t.id = u.id;
+	`))
+	must(err)
+	var results []*eval.Table
+	for _, stmt := range stmts {
+		result, err := eval.EvalStmt(&env, stmt)
+		must(err)
+		results = append(results, result)
+	}
+	tests := []struct {
+		table    *eval.Table
+		col      int
+		name     string
+		typ      eval.DataType
+		nullable bool
+	}{
+		{results[1], 0, "id", eval.Integer, false},
+		{results[1], 1, "next", eval.Integer, false},
+		{results[1], 2, "?column?", eval.String, true},
+		{results[1], 3, "s", eval.Number, true},
+		{results[1], 4, "over_all", eval.Integer, false},
+		{results[1], 5, "sum", eval.Integer, true},
+		{results[1], 6, "coalesce", eval.String, false},
+		{results[1], 7, "?column?", eval.Boolean, false},
+		{results[1], 8, "id", eval.String, false},
+		{results[1], 9, "?column?", eval.InvalidDataType, true}, // no rows
+		{results[2], 0, "id", eval.Integer, false},
+		{results[2], 1, "id", eval.Integer, true},
+	}
+	for _, tt := range tests {
+		col := tt.table.Columns[tt.col]
+		if col.Name != tt.name || col.Type != tt.typ || col.Nullable != tt.nullable {
+			t.Errorf("column %d: got (%q, %s, %v), want (%q, %s, %v)", tt.col,
+				col.Name, col.Type, col.Nullable, tt.name, tt.typ, tt.nullable)
+		}
+	}
+}
+
+// Verifies that CREATE TABLE AS and SELECT ... INTO create tables whose
+// columns have the inferred types of the query's result.
+func TestCreateTableAs(t *testing.T) {
+	var env eval.Environment
+	stmts, err := parser.Parse(lexer.New(`
+		create table t (id integer not null, name varchar, score number);
+		insert into t values (1, 'a', 1.5), (2, null, 2);
+		create table u as select id, name, score * 2 as s, id > 1 as big, null as nothing from t;
+		select id, count(*) n, max(score) into temp v from t group by id;
+		select * from u;
+		select * from v;
+	`))
+	must(err)
+	var results []*eval.Table
+	for _, stmt := range stmts {
+		result, err := eval.EvalStmt(&env, stmt)
+		must(err)
+		results = append(results, result)
+	}
+	want := []struct {
+		table *eval.Table
+		names []string
+		types []eval.DataType
+	}{
+		{results[4], []string{"id", "name", "s", "big", "nothing"},
+			[]eval.DataType{eval.Integer, eval.String, eval.Number, eval.Boolean, eval.String}},
+		{results[5], []string{"id", "n", "max"},
+			[]eval.DataType{eval.Integer, eval.Integer, eval.Number}},
+	}
+	for _, w := range want {
+		if len(w.table.Columns) != len(w.names) {
+			t.Fatalf("got %d columns, want %d", len(w.table.Columns), len(w.names))
+		}
+		for i, col := range w.table.Columns {
+			if col.Name != w.names[i] || col.Type != w.types[i] || !col.Nullable {
+				t.Errorf("column %d: got (%q, %s, %v), want (%q, %s, true)", i,
+					col.Name, col.Type, col.Nullable, w.names[i], w.types[i])
+			}
+		}
+		if len(w.table.Data) != 2 {
+			t.Errorf("got %d rows, want 2", len(w.table.Data))
+		}
+	}
+}
+
+// Verifies that a recursive query fails with an *eval.Error once it exceeds
+// the environment's recursion limit.
+func TestRecursionLimit(t *testing.T) {
+	env := eval.Environment{RecursionLimit: 10}
+	stmts, err := parser.Parse(lexer.New(`
+		with recursive r (n) as (select 1 union all select n + 1 from r where n < 10) select max(n) from r;
+		with recursive r (n) as (select 1 union all select n + 1 from r where n < 11) select max(n) from r;
+	`))
+	must(err)
+	result, err := eval.EvalStmt(&env, stmts[0])
+	must(err)
+	if n := result.Data[0][0]; n != eval.IntegerValue(10) {
+		t.Fatalf("got max(n) = %v, want 10", n)
+	}
+	_, err = eval.EvalStmt(&env, stmts[1])
+	if _, ok := err.(*eval.Error); !ok {
+		t.Fatalf("got error %v, want an *eval.Error", err)
+	}
+}
+
+// Verifies that INSERT ... RETURNING reports the values that were generated
+// for auto-increment columns.
+func TestInsertReturning(t *testing.T) {
+	var env eval.Environment
+	must(env.CreateTable(&eval.Table{Name: "t", Columns: []*eval.Column{
+		{Name: "id", Type: eval.Integer, AutoInc: true, NextVal: 100},
+		{Name: "name", Type: eval.String, Nullable: true},
+	}}))
+	stmts, err := parser.Parse(lexer.New(`
+		insert into t (name) values ('a'), ('b') returning id, name;
+		insert into t values (default, 'c') returning id;
+		insert into t (name) values ('d');
+	`))
+	must(err)
+	var ids []eval.Value
+	for _, stmt := range stmts {
+		result, err := eval.EvalStmt(&env, stmt)
+		must(err)
+		if result == nil {
+			continue
+		}
+		for _, row := range result.Data {
+			ids = append(ids, row[0])
+		}
+	}
+	if len(ids) != 3 || ids[0] != eval.IntegerValue(100) || ids[1] != eval.IntegerValue(101) || ids[2] != eval.IntegerValue(102) {
+		t.Fatalf("got ids %v, want [100 101 102]", ids)
+	}
+}
+
+// Verifies INSERT ... ON CONFLICT against a table with unique keys.
+func TestUpsert(t *testing.T) {
+	var env eval.Environment
+	must(env.CreateTable(&eval.Table{
+		Name: "kv",
+		Columns: []*eval.Column{
+			{Name: "k", Type: eval.String},
+			{Name: "v", Type: eval.Integer, Nullable: true},
+			{Name: "tag", Type: eval.String, Nullable: true},
+		},
+		Keys: []*eval.Key{{Columns: []string{"k"}}, {Name: "kv_tag", Columns: []string{"tag"}}},
+	}))
+	tests := []struct {
+		sql string
+		err string // expected error, if any
+	}{
+		{"insert into kv values ('a', 1, 'x'), ('b', 2, null);", ""},
+		{"insert into kv values ('a', 10, null);", `duplicate key value violates unique constraint "kv_k_key"`},
+		{"insert into kv values ('c', 3, 'x');", `duplicate key value violates unique constraint "kv_tag"`},
+		{"insert into kv values ('c', 3, null), ('c', 4, null);", `duplicate key value violates unique constraint "kv_k_key"`},
+		{"insert into kv values ('a', 10, null), ('c', 3, null), ('c', 4, null) on conflict do nothing;", ""},
+		{"insert into kv values ('d', 5, 'x') on conflict (k) do nothing;", `duplicate key value violates unique constraint "kv_tag"`},
+		{"insert into kv values ('a', 5, null) on conflict (v) do nothing;", "there is no unique constraint matching the ON CONFLICT specification"},
+		{"insert into kv values ('b', 20, null), ('e', 5, null) on conflict (k) do update set v = kv.v + excluded.v;", ""},
+		{"insert into kv values ('a', 0, null) on conflict (k) do update set v = excluded.v where kv.v > 1;", ""},
+		{"insert into kv values ('e', 1, null), ('e', 2, null) on conflict (k) do update set v = 0;", "ON CONFLICT DO UPDATE command cannot affect row a second time"},
+		{"insert into kv values ('b', 0, null) on conflict (k) do update set tag = 'x';", `duplicate key value violates unique constraint "kv_tag"`},
+		{"insert into kv values ('b', 0, null) on conflict (k) do update set v = v;", `column reference "v" is ambiguous`},
+	}
+	for _, tt := range tests {
+		stmts, err := parser.Parse(lexer.New(tt.sql))
+		must(err)
+		_, err = eval.EvalStmt(&env, stmts[0])
+		switch {
+		case err == nil && tt.err != "":
+			t.Errorf("%s: got no error, want %q", tt.sql, tt.err)
+		case err != nil && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: got error %q, want %q", tt.sql, err, tt.err)
+		case err != nil && tt.err == "":
+			t.Errorf("%s: got error %q", tt.sql, err)
+		}
+	}
+	stmts, err := parser.Parse(lexer.New("select k, v, tag from kv order by k;"))
+	must(err)
+	result, err := eval.EvalStmt(&env, stmts[0])
+	must(err)
+	sb := new(strings.Builder)
+	pprint.Table(sb, result)
+	expect := `
+ k   | v  | tag
+-----+----+-----
+ "a" | 1  | "x"
+ "b" | 22 |
+ "c" | 3  |
+ "e" | 5  |
+`
+	if actual := deleteTrailingWhitespace(sb.String()); actual != expect[1:] {
+		t.Fatalf("wrong result:\n%s\nwant:\n%s", actual, expect[1:])
+	}
+}
+
+// Verifies that constraint violations are reported as *eval.ConstraintError
+// values that name the violated constraint.
+func TestConstraintError(t *testing.T) {
+	var env eval.Environment
+	stmts, err := parser.Parse(lexer.New(`
+		create table t (id integer primary key, n integer constraint positive check (n > 0));
+		insert into t values (1, 1);
+		insert into t values (1, 2);
+		update t set n = 0;
+	`))
+	must(err)
+	var names []string
+	for _, stmt := range stmts {
+		_, err := eval.EvalStmt(&env, stmt)
+		if err, ok := err.(*eval.ConstraintError); ok {
+			if err.Table != "t" {
+				t.Errorf("got table %q, want %q", err.Table, "t")
+			}
+			names = append(names, err.Constraint)
+		} else if err != nil {
+			t.Fatalf("got error %v, want an *eval.ConstraintError", err)
+		}
+	}
+	if len(names) != 2 || names[0] != "t_pkey" || names[1] != "positive" {
+		t.Fatalf("got constraint names %q, want [t_pkey positive]", names)
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	var env eval.Environment
+	stmts, err := parser.Parse(lexer.New(`
+		create table parent (id integer primary key);
+		create table child (id integer primary key, parent integer references parent);
+		insert into parent values (1);
+		insert into child values (1, 1);
+	`))
+	must(err)
+	for _, stmt := range stmts {
+		if _, err := eval.EvalStmt(&env, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := env.DropTable("parent", false); err == nil {
+		t.Fatal("dropped a table that another table references")
+	}
+	if err := env.DropTable("parent", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.DropTable("parent", true); err == nil {
+		t.Fatal("dropped a table that does not exist")
+	}
+	// The foreign key is gone, so child rows may refer to anything.
+	stmts, err = parser.Parse(lexer.New(`insert into child values (2, 99);`))
+	must(err)
+	if _, err := eval.EvalStmt(&env, stmts[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementalView(t *testing.T) {
+	var env eval.Environment
+	run := func(sql string) *eval.Table {
+		stmts, err := parser.Parse(lexer.New(sql + ";"))
+		must(err)
+		result, err := eval.EvalStmt(&env, stmts[0])
+		if err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+		return result
+	}
+	rowStrings := func(table *eval.Table) []string {
+		var rows []string
+		for _, row := range table.Data {
+			rows = append(rows, fmt.Sprint(row))
+		}
+		sort.Strings(rows)
+		return rows
+	}
+	run(`create table t (id integer primary key, g integer, x integer)`)
+	queries := map[string]string{
+		"groups": `select g, count(*) n, count(x) nx, sum(x), min(x), max(x) from t where mod(id, 3) <> 0 group by g having count(*) > 1`,
+		"totals": `select count(*), sum(x), min(x), max(x) from t`,
+		"plain":  `select id, x * 2 as y from t where x > 5`,
+	}
+	for name, query := range queries {
+		run("create incremental materialized view " + name + " as " + query)
+	}
+	rng := rand.New(rand.NewSource(1))
+	x := func() string {
+		if rng.Intn(5) == 0 {
+			return "null"
+		}
+		return fmt.Sprint(rng.Intn(20))
+	}
+	for i := 0; i < 500; i++ {
+		var stmt string
+		switch rng.Intn(3) {
+		case 0:
+			stmt = fmt.Sprintf("insert into t values (%d, %d, %s)", i, rng.Intn(4), x())
+		case 1:
+			stmt = fmt.Sprintf("update t set x = %s, g = %d where mod(id, 7) = %d", x(), rng.Intn(4), rng.Intn(7))
+		case 2:
+			stmt = fmt.Sprintf("delete from t where x = %d", rng.Intn(20))
+		}
+		run(stmt)
+		for name, query := range queries {
+			got, want := rowStrings(run("select * from "+name)), rowStrings(run(query))
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("after %q, view %s:\ngot  %v\nwant %v", stmt, name, got, want)
+			}
+		}
+	}
+}
+
+func TestRollbackDropTable(t *testing.T) {
+	var env eval.Environment
+	run := func(sql string) {
+		stmts, err := parser.Parse(lexer.New(sql))
+		must(err)
+		for _, stmt := range stmts {
+			if _, err := eval.EvalStmt(&env, stmt); err != nil {
+				t.Fatalf("%s: %s", sql, err)
+			}
+		}
+	}
+	run(`
+		create table t (id integer primary key);
+		insert into t values (1), (2);
+		begin;
+	`)
+	if err := env.DropTable("t", false); err != nil {
+		t.Fatal(err)
+	}
+	run(`rollback;`)
+	stmts, err := parser.Parse(lexer.New(`select count(*) from t;`))
+	must(err)
+	result, err := eval.EvalStmt(&env, stmts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(result.Data); got != "[[2]]" {
+		t.Errorf("got %s, want [[2]]", got)
+	}
+}
+
+// Parses and evaluates a statement in a session.
+func exec(s *eval.Session, sql string) (*eval.Table, error) {
+	stmts, err := parser.Parse(lexer.New(sql + ";"))
+	must(err)
+	return s.Exec(stmts[0])
+}
+
+func TestSessionIsolation(t *testing.T) {
+	var db eval.Database
+	s1, s2 := db.NewSession(), db.NewSession()
+	for _, sql := range []string{
+		`create table t (id integer primary key, x integer)`,
+		`insert into t values (1, 10), (2, 20)`,
+		`begin`,
+	} {
+		if _, err := exec(s1, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(s *eval.Session) string {
+		result, err := exec(s, `select count(*), sum(x) from t`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(result.Data)
+	}
+	if got := count(s1); got != "[[2 30]]" {
+		t.Fatalf("got %s, want [[2 30]]", got)
+	}
+	// A transaction sees its own changes, but not those of transactions that
+	// committed after it started, nor they its changes until it commits.
+	if _, err := exec(s2, `insert into t values (3, 30)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec(s1, `update t set x = x + 1 where id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(s1); got != "[[2 31]]" {
+		t.Errorf("got %s, want [[2 31]]", got)
+	}
+	if got := count(s2); got != "[[3 60]]" {
+		t.Errorf("got %s, want [[3 60]]", got)
+	}
+	if _, err := exec(s1, `commit`); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(s2); got != "[[3 61]]" {
+		t.Errorf("got %s, want [[3 61]]", got)
+	}
+}
+
+func TestSessionConflict(t *testing.T) {
+	var db eval.Database
+	s1, s2 := db.NewSession(), db.NewSession()
+	for _, sql := range []string{
+		`create table t (id integer primary key, x integer)`,
+		`insert into t values (1, 10), (2, 20)`,
+	} {
+		if _, err := exec(s1, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		first, second string
+		conflict      bool
+	}{
+		{`update t set x = x + 1 where id = 1`, `update t set x = x + 1 where id = 2`, false},
+		{`update t set x = x + 1 where id = 1`, `delete from t where id = 1`, true},
+		{`delete from t where id = 2`, `update t set x = 0`, true},
+		{`insert into t values (3, 30)`, `insert into t values (4, 40)`, false},
+		{`insert into t values (5, 50)`, `insert into t values (5, 50)`, false}, // but a unique violation
+		{`create table u1 (y integer)`, `select * from t`, false},
+		{`create table u2 (y integer)`, `update t set x = x + 1 where id = 3`, false},
+		{`create temp table tmp (y integer)`, `insert into t values (6, 60)`, false},
+		{`insert into t values (7, 70)`, `create table u3 (y integer)`, false},
+		{`create table u4 (y integer)`, `create table u5 (y integer)`, false},
+		{`create table u6 (y integer)`, `create table u6 (z integer)`, true},
+		{`insert into t values (8, 80)`, `alter table t add column z integer`, true},
+		{`alter table t add column y integer`, `select * from t where false`, false}, // changed nothing
+		{`alter table t drop column y`, `update t set x = x where id = 1`, true},
+	}
+	for _, test := range tests {
+		if _, err := exec(s2, `begin`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exec(s2, test.second); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := exec(s1, test.first); err != nil {
+			t.Fatal(err)
+		}
+		_, err := exec(s2, `commit`)
+		if _, ok := err.(*eval.SerializationError); ok != test.conflict {
+			t.Errorf("%s, then %s: got error %v, want conflict = %v", test.first, test.second, err, test.conflict)
+		}
+	}
+	result, err := exec(s1, `select id, x from t order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(result.Data), "[[1 12] [3 31] [4 40] [5 50] [6 60] [7 70] [8 80]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	result, err = exec(s1, `select count(*) from u3 cross join u5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verifies that each session has temporary tables of its own, which survive
+// its transactions but are not seen by other sessions.
+func TestSessionTemporaryTables(t *testing.T) {
+	var db eval.Database
+	s1, s2, s3 := db.NewSession(), db.NewSession(), db.NewSession()
+	tests := []struct {
+		s    *eval.Session
+		sql  string
+		want string // the result's rows, if err is empty
+		err  string // expected error, if any
+	}{
+		{s1, `create temp table tmp (x integer)`, "[]", ""},
+		{s1, `insert into tmp values (1)`, "[]", ""},
+		{s2, `select * from tmp`, "", `relation "tmp" does not exist`},
+		{s2, `create temp table tmp (y integer)`, "[]", ""},
+		{s2, `insert into tmp values (2), (3)`, "[]", ""},
+		{s1, `create view tv as select x + 1 as y from tmp`, "[]", ""},
+		{s2, `select * from tv`, "", `relation "tv" does not exist`},
+		{s3, `create table tmp (z varchar)`, "[]", ""},
+		{s3, `insert into tmp values ('a'), ('b'), ('c')`, "[]", ""},
+		{s1, `begin`, "[]", ""},
+		{s1, `insert into tmp values (5)`, "[]", ""},
+		{s1, `rollback`, "[]", ""},
+		{s1, `select * from tv`, "[[2]]", ""},
+		{s2, `select count(*) from tmp`, "[[2]]", ""},
+		{s3, `select count(*) from tmp`, "[[3]]", ""},
+		{s1, `drop table tmp cascade`, "[]", ""},
+		{s1, `select count(*) from tmp`, "[[3]]", ""},
+		{s1, `create temp table tmp (w integer)`, "", `relation "tmp" already exists`},
+		{s3, `select count(*) from tmp`, "[[3]]", ""},
+	}
+	for _, test := range tests {
+		result, err := exec(test.s, test.sql)
+		var got string
+		if result != nil {
+			got = fmt.Sprint(result.Data)
+		} else if err == nil {
+			got = "[]"
+		}
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %q", test.sql, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("%s: got error %v", test.sql, err)
+		case test.err == "" && got != test.want:
+			t.Errorf("%s: got %s, want %s", test.sql, got, test.want)
+		}
+	}
+}
+
+// Transfers money between accounts in many concurrent sessions, retrying
+// transactions that fail with serialization errors, while other sessions
+// check that the total never changes. Run with -race.
+func TestSessionConcurrency(t *testing.T) {
+	const accounts, writers, readers, transfers = 10, 8, 4, 50
+	var db eval.Database
+	setup := db.NewSession()
+	if _, err := exec(setup, `create table acct (id integer primary key, balance integer check (balance >= 0))`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec(setup, `create table log (n serial primary key, src integer references acct, dst integer references acct)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < accounts; i++ {
+		if _, err := exec(setup, fmt.Sprintf(`insert into acct values (%d, 100)`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, writers+readers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			s := db.NewSession()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < transfers; {
+				src, dst := rng.Intn(accounts), rng.Intn(accounts)
+				var err error
+				for _, sql := range []string{
+					`begin`,
+					fmt.Sprintf(`update acct set balance = balance - 1 where id = %d`, src),
+					fmt.Sprintf(`update acct set balance = balance + 1 where id = %d`, dst),
+					fmt.Sprintf(`insert into log (src, dst) values (%d, %d)`, src, dst),
+					`commit`,
+				} {
+					if _, err = exec(s, sql); err != nil {
+						break
+					}
+				}
+				switch err.(type) {
+				case nil:
+					i++
+				case *eval.SerializationError:
+					// retry
+				default:
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	var readerWG sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readerWG.Add(1)
+		go func() {
+			defer readerWG.Done()
+			s := db.NewSession()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				result, err := exec(s, `select sum(balance) from acct`)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if got := fmt.Sprint(result.Data); got != fmt.Sprintf("[[%d]]", accounts*100) {
+					errs <- fmt.Errorf("total is %s", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readerWG.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	result, err := exec(setup, `select count(*), count(distinct n) from log`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("[[%d %d]]", writers*transfers, writers*transfers)
+	if got := fmt.Sprint(result.Data); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// Verifies that the cost of committing an insert does not depend on the size
+// of the table, by comparing the memory that inserts allocate when the table
+// is small and when it is large.
+func TestSessionInsertScaling(t *testing.T) {
+	checkInsertScaling(t, func() *eval.Database { return new(eval.Database) })
+}
+
+// Likewise for a durable database, which logs the inserted rows rather than
+// the table.
+func TestStorageInsertScaling(t *testing.T) {
+	checkInsertScaling(t, func() *eval.Database {
+		db, err := eval.Open(t.TempDir(), &eval.StorageOptions{Sync: eval.SyncNever, CheckpointSize: -1})
+		must(err)
+		return db
+	})
+}
+
+// Compares the memory that inserts allocate in a small table and in a large
+// one, each in a database that newDB returns.
+func checkInsertScaling(t *testing.T, newDB func() *eval.Database) {
+	const inserts = 1000
+	alloc := func(size int) uint64 {
+		db := newDB()
+		defer db.Close()
+		s := db.NewSession()
+		if _, err := exec(s, `create table t (id integer primary key, x integer)`); err != nil {
+			t.Fatal(err)
+		}
+		values := make([]string, size)
+		for i := range values {
+			values[i] = fmt.Sprintf("(%d, 0)", i)
+		}
+		if _, err := exec(s, `insert into t values `+strings.Join(values, ", ")); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := size; i < size+inserts; i++ {
+			if _, err := exec(s, fmt.Sprintf(`insert into t values (%d, 0)`, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	small, large := alloc(inserts), alloc(20*inserts)
+	if large > 2*small {
+		t.Errorf("%d inserts allocated %d bytes into a table of %d rows, but %d bytes into one of %d rows",
+			inserts, small, inserts, large, 20*inserts)
+	}
+}
+
+// Checks that the statements of the test files survive a round trip through
+// ast.Marshal and ast.Unmarshal.
+func TestMarshalAST(t *testing.T) {
+	for _, tt := range loadTestFiles() {
+		stmts, err := parser.Parse(lexer.New(readFile(tt.input)))
+		must(err)
+		for _, stmt := range stmts {
+			data, err := ast.Marshal(stmt)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			node, err := ast.Unmarshal(data)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(node, stmt) {
+				t.Fatalf("%s: statement at %s changed in round trip", tt.name, stmt.Pos())
+			}
+		}
+	}
+}
+
+// Statements that the storage tests commit, one at a time unless they are in
+// a transaction.
+var storageWorkload = []string{
+	`create table dept (id serial primary key, name varchar not null unique, created timestamp default now())`,
+	`create table emp (id serial primary key, name varchar, dept integer references dept on delete cascade, salary number check (salary > 0), active boolean default true)`,
+	`insert into dept (name, created) values ('eng', '2001-02-03T04:05:06.789Z'), ('ops', '1999-12-31T23:59:59-05:00')`,
+	`insert into dept (name) values ('qa')`,
+	`insert into emp (name, dept, salary) values ('ann', 1, 100.5), ('bob', 1, 1e10), ('cat', 2, 0.125), ('dan', null, 7)`,
+	`create view payroll as select d.name as dept, sum(e.salary) as total from emp e join dept d on e.dept = d.id group by d.name`,
+	`create materialized view snapshot as select name, salary from emp`,
+	`create incremental materialized view headcount as select dept, count(*) as n from emp group by dept`,
+	`begin`,
+	`update emp set salary = salary * 2 where dept = 1`,
+	`savepoint s`,
+	`delete from emp`,
+	`rollback to savepoint s`,
+	`insert into emp (name, dept, salary, active) values ('eve', 2, 3, false)`,
+	`commit`,
+	`begin`,
+	`delete from dept where name = 'ops'`,
+	`rollback`,
+	`delete from dept where name = 'ops'`,
+	`create temporary table scratch (x integer)`,
+	`insert into scratch values (1)`,
+	`alter table emp add column title varchar default 'staff'`,
+	`update emp set title = 'lead', active = null where name = 'ann'`,
+	`refresh materialized view snapshot`,
+	`insert into emp (name, dept, salary) values ('fay', 1, 42)`,
+	`create table log (n integer)`,
+	`insert into log values (1), (2), (3)`,
+	`truncate log`,
+	`alter table log rename column n to m`,
+	`insert into log values (4)`,
+	`delete from emp where id = 2`,
+	`begin`,
+	`create table tags (tag varchar primary key, dept integer references dept)`,
+	`insert into tags values ('a', 1), ('b', 3)`,
+	`update dept set name = 'rnd' where id = 1`,
+	`commit`,
+	`create view tagged as select tag, dept from tags where dept = 1`,
+	`alter table tags rename to labels`,
+	`insert into labels values ('c', 1)`,
+	`create table color (name varchar primary key)`,
+	`insert into color values ('red')`,
+	`create table paint (color varchar references color, n integer)`,
+	`insert into paint values ('red', 1)`,
+	`alter table color rename to colour`,
+	`insert into paint values ('red', 2)`,
+	`drop table log`,
+}
+
+// Queries whose results describe the state of the database in the storage
+// tests.
+var storageQueries = []string{
+	`select id, name, created is null from dept order by id`,
+	`select * from emp order by id`,
+	`select * from payroll order by dept`,
+	`select * from snapshot order by name`,
+	`select * from headcount order by dept`,
+	`select * from log`,
+	`select * from labels order by tag`,
+	`select * from tagged order by tag`,
+	`select * from paint order by n`,
+	`insert into paint values ('blue', 3)`,
+	`update emp set salary = -1`,
+	`update emp set dept = 99`,
+}
+
+// Returns the results of storageQueries in a session of the database. The
+// statements that succeed are rolled back. None of them draws values from
+// sequences, which rolling back would not return.
+func dumpDatabase(db *eval.Database) string {
+	s := db.NewSession()
+	var b strings.Builder
+	exec(s, `begin`)
+	for _, sql := range storageQueries {
+		result, err := exec(s, sql)
+		switch {
+		case err != nil:
+			fmt.Fprintln(&b, err)
+		case result != nil:
+			pprint.Table(&b, result)
+		default:
+			fmt.Fprintln(&b, "OK")
+		}
+	}
+	exec(s, `rollback`)
+	return b.String()
+}
+
+// Runs the storage workload in a durable database in dir, and returns the
+// size of the log and the state of the database after each statement,
+// starting with the empty database.
+func runStorageWorkload(t *testing.T, dir string, opts *eval.StorageOptions) (sizes []int64, dumps []string) {
+	db, err := eval.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := db.NewSession()
+	for i := -1; i < len(storageWorkload); i++ {
+		if i >= 0 {
+			if _, err := exec(s, storageWorkload[i]); err != nil {
+				t.Fatalf("%s: %v", storageWorkload[i], err)
+			}
+		}
+		fi, err := os.Stat(filepath.Join(dir, "wal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, fi.Size())
+		dumps = append(dumps, dumpDatabase(db))
+	}
+	return sizes, dumps
+}
+
+// Opens the durable database in dir, and checks its state.
+func checkRecovery(t *testing.T, dir string, want string) *eval.Database {
+	t.Helper()
+	db, err := eval.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpDatabase(db); got != want {
+		db.Close()
+		t.Fatalf("recovered\n%s\nwant\n%s", got, want)
+	}
+	return db
+}
+
+// Simulates crashes by truncating the log at arbitrary offsets, and checks
+// that the database recovers to the state after the last commit whose
+// record is complete, and that it can then be changed and recovered again.
+func TestStorageCrash(t *testing.T) {
+	dir := t.TempDir()
+	sizes, dumps := runStorageWorkload(t, dir, &eval.StorageOptions{CheckpointSize: -1})
+	wal, err := ioutil.ReadFile(filepath.Join(dir, "wal"))
+	must(err)
+	if _, err := os.Stat(filepath.Join(dir, "snapshot")); !os.IsNotExist(err) {
+		t.Fatalf("want no snapshot, got error %v", err)
+	}
+	// Truncate the log at the end of each record, one byte either side, and
+	// at random offsets.
+	offsets := []int{0}
+	for _, size := range sizes {
+		offsets = append(offsets, int(size)-1, int(size), int(size)+1)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		offsets = append(offsets, rng.Intn(len(wal)))
+	}
+	crash := t.TempDir()
+	for _, offset := range offsets {
+		if offset < 0 || offset > len(wal) {
+			continue
+		}
+		must(ioutil.WriteFile(filepath.Join(crash, "wal"), wal[:offset], 0666))
+		i := len(sizes) - 1
+		for sizes[i] > int64(offset) {
+			i--
+		}
+		db := checkRecovery(t, crash, dumps[i])
+		s := db.NewSession()
+		if _, err := exec(s, `create table after_crash (x integer)`); err != nil {
+			t.Fatal(err)
+		}
+		must(db.Close())
+		db = checkRecovery(t, crash, dumps[i])
+		if _, err := exec(db.NewSession(), `select * from after_crash`); err != nil {
+			t.Fatalf("offset %d: commit after recovery was lost: %v", offset, err)
+		}
+		must(db.Close())
+		os.Remove(filepath.Join(crash, "snapshot"))
+	}
+
+	// Corrupt the length, then the contents, of each record. Only the last
+	// record may be discarded; otherwise the log cannot be opened, and is left
+	// as it is.
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i] == sizes[i-1] {
+			continue // no record
+		}
+		for _, offset := range []int64{sizes[i-1] + 1, (sizes[i-1] + sizes[i]) / 2} {
+			bad := append([]byte(nil), wal...)
+			bad[offset] ^= 0x40
+			must(ioutil.WriteFile(filepath.Join(crash, "wal"), bad, 0666))
+			if sizes[i] == int64(len(wal)) {
+				must(checkRecovery(t, crash, dumps[i-1]).Close())
+				continue
+			}
+			if db, err := eval.Open(crash, nil); err == nil {
+				db.Close()
+				t.Fatalf("offset %d: opened log with corrupt record", offset)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(crash, "wal"))
+			must(err)
+			if !bytes.Equal(got, bad) {
+				t.Fatalf("offset %d: log with corrupt record was changed", offset)
+			}
+		}
+	}
+}
+
+// Checks recovery from checkpoints, with each sync policy, including after a
+// crash between writing the snapshot and emptying the log.
+func TestStorageCheckpoint(t *testing.T) {
+	for _, opts := range []*eval.StorageOptions{
+		{Sync: eval.SyncAlways, CheckpointSize: 1},
+		{Sync: eval.SyncInterval, SyncInterval: time.Millisecond, CheckpointSize: 500},
+		{Sync: eval.SyncNever},
+	} {
+		dir := t.TempDir()
+		_, dumps := runStorageWorkload(t, dir, opts)
+		want := dumps[len(dumps)-1]
+		db := checkRecovery(t, dir, want)
+		wal, err := ioutil.ReadFile(filepath.Join(dir, "wal"))
+		must(err)
+		must(db.Checkpoint())
+		must(db.Close())
+		must(ioutil.WriteFile(filepath.Join(dir, "wal"), wal, 0666))
+		db = checkRecovery(t, dir, want)
+
+		// Temporary tables are not stored, and the sequences continue where
+		// they left off.
+		s := db.NewSession()
+		if _, err := exec(s, `select * from scratch`); err == nil {
+			t.Error("temporary table was recovered")
+		}
+		result, err := exec(s, `insert into emp (name, salary) values ('gus', 1) returning id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(result.Data); got != "[[7]]" {
+			t.Errorf("got id %s, want 7", got)
+		}
+		want = dumpDatabase(db)
+		must(db.Close())
+		checkRecovery(t, dir, want).Close()
+	}
+}
+
+// Checks that a change to the schema logs the relations whose definitions it
+// changes, not the whole database.
+func TestStorageSchemaChange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := eval.Open(dir, &eval.StorageOptions{CheckpointSize: -1})
+	must(err)
+	defer db.Close()
+	s := db.NewSession()
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = fmt.Sprintf("(%d)", i)
+	}
+	for _, sql := range []string{
+		`create table big (n integer)`,
+		`insert into big values ` + strings.Join(values, ", "),
+	} {
+		if _, err := exec(s, sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walSize := func() int64 {
+		fi, err := os.Stat(filepath.Join(dir, "wal"))
+		must(err)
+		return fi.Size()
+	}
+	before := walSize()
+	if _, err := exec(s, `create table small (n integer)`); err != nil {
+		t.Fatal(err)
+	}
+	if n := walSize() - before; n > 500 {
+		t.Errorf("creating a table logged %d bytes", n)
+	}
+}
+
+// Commits from several sessions while the database is checkpointed, and
+// checks that no commit is lost.
+func TestStorageConcurrentCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db, err := eval.Open(dir, &eval.StorageOptions{Sync: eval.SyncNever, CheckpointSize: 2000})
+	must(err)
+	if _, err := exec(db.NewSession(), `create table t (n integer)`); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := db.NewSession()
+			for j := 0; j < 100; j++ {
+				if _, err := exec(s, fmt.Sprintf(`insert into t values (%d)`, i*100+j)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	must(db.Close())
+	if _, err := os.Stat(filepath.Join(dir, "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	db, err = eval.Open(dir, nil)
+	must(err)
+	defer db.Close()
+	result, err := exec(db.NewSession(), `select count(*), sum(n) from t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(result.Data); got != "[[400 79800]]" {
+		t.Errorf("got %s, want [[400 79800]]", got)
+	}
+}
@@ -0,0 +1,175 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// A foreign key, as seen from the table to which it refers.
+type reference struct {
+	table *Table // the referencing table
+	fk    *ForeignKey
+}
+
+// Returns the foreign keys that refer to a table, ordered by the names of the
+// referencing tables.
+func (env *Environment) references(table *Table) []reference {
+	names := make([]string, 0, len(env.tables))
+	for name := range env.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var refs []reference
+	for _, name := range names {
+		for _, fk := range env.tables[name].ForeignKeys {
+			if fk.RefTable == table.Name {
+				refs = append(refs, reference{env.tables[name], fk})
+			}
+		}
+	}
+	return refs
+}
+
+// Applies the actions of the foreign keys that refer to deleted or updated
+// rows. Since the actions may change more rows, repeats until there are no
+// more changes.
+func (cs *changeSet) applyRefActions() {
+	for len(cs.pending) > 0 {
+		change := cs.pending[0]
+		cs.pending = cs.pending[1:]
+		for _, ref := range cs.env.references(change.tc.table) {
+			cs.applyRefAction(change, ref)
+		}
+	}
+}
+
+// Applies a foreign key's action to the rows that referred to a row before it
+// was deleted or updated. Does nothing if the row's key did not change.
+func (cs *changeSet) applyRefAction(change rowChange, ref reference) {
+	parent := change.tc.table
+	refCols := parent.colIndexes(ref.fk.RefColumns)
+	oldKey := project(change.old, refCols)
+	action := ref.fk.OnDelete
+	if change.new != nil {
+		newKey := project(change.new, refCols)
+		if sameValues(oldKey, newKey) {
+			return
+		}
+		action = ref.fk.OnUpdate
+	}
+	if action == ast.NoAction || anyNull(oldKey) {
+		return // NO ACTION is checked by checkForeignKeys
+	}
+	cols := ref.table.colIndexes(ref.fk.Columns)
+	current := cs.find(ref.table)
+	for i, row := range ref.table.Data {
+		if current != nil {
+			row = current.row(i)
+		}
+		if row == nil || !sameValues(project(row, cols), oldKey) {
+			continue
+		}
+		if action == ast.Restrict {
+			panic(&ConstraintError{
+				Table:      parent.Name,
+				Constraint: ref.fk.Name,
+				Msg: fmt.Sprintf("update or delete on table %q violates foreign key constraint %q on table %q",
+					parent.Name, ref.fk.Name, ref.table.Name),
+			})
+		}
+		tc := cs.change(ref.table)
+		if action == ast.Cascade && change.new == nil {
+			cs.delete(tc, i)
+			continue
+		}
+		newRow := append(Row{}, tc.row(i)...)
+		for j, n := range cols {
+			switch action {
+			case ast.Cascade:
+				newRow[n] = change.new[refCols[j]]
+			case ast.SetNull:
+				newRow[n] = nil
+			case ast.SetDefault:
+				newRow[n] = ref.table.Columns[n].defaultValue(cs.env)
+			}
+		}
+		cs.update(tc, i, newRow)
+	}
+}
+
+// Panics unless the foreign keys of the changed tables, and the foreign keys
+// that refer to them, are satisfied.
+func (cs *changeSet) checkForeignKeys() {
+	for _, tc := range cs.tables {
+		// The changed rows must refer to existing rows.
+		for _, fk := range tc.table.ForeignKeys {
+			parent := cs.env.lookupTable(fk.RefTable)
+			cols := tc.table.colIndexes(fk.Columns)
+			for _, i := range tc.changed {
+				key := project(tc.data[i], cols)
+				if !anyNull(key) && !cs.hasKey(parent, fk.RefColumns, key) {
+					panic(&ConstraintError{
+						Table:      tc.table.Name,
+						Constraint: fk.Name,
+						Msg:        fmt.Sprintf("insert or update on table %q violates foreign key constraint %q", tc.table.Name, fk.Name),
+					})
+				}
+			}
+		}
+		// Rows that refer to the table must not refer to the keys of updated
+		// or deleted rows that no longer exist.
+		if len(tc.changes) == 0 {
+			continue
+		}
+		for _, ref := range cs.env.references(tc.table) {
+			refCols := tc.table.colIndexes(ref.fk.RefColumns)
+			gone := make(map[string]bool)
+			for i := range tc.changes {
+				key := project(tc.table.Data[i], refCols)
+				if !anyNull(key) && !cs.hasKey(tc.table, ref.fk.RefColumns, key) {
+					gone[rowKey(key)] = true
+				}
+			}
+			if len(gone) == 0 {
+				continue
+			}
+			cols := ref.table.colIndexes(ref.fk.Columns)
+			for _, row := range cs.data(ref.table) {
+				key := project(row, cols)
+				if !anyNull(key) && gone[rowKey(key)] {
+					panic(&ConstraintError{
+						Table:      tc.table.Name,
+						Constraint: ref.fk.Name,
+						Msg: fmt.Sprintf("update or delete on table %q violates foreign key constraint %q on table %q",
+							tc.table.Name, ref.fk.Name, ref.table.Name),
+					})
+				}
+			}
+		}
+	}
+}
+
+// Reports whether any of the values is null.
+func anyNull(values []Value) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether two lists of values are equal. Nulls are never equal.
+func sameValues(a, b []Value) bool {
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			return false
+		}
+		if c, ok := compare(a[i], b[i]); !ok || c != 0 {
+			return false
+		}
+	}
+	return true
+}
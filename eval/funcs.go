@@ -14,27 +14,64 @@ type aggFunc interface {
 
 	step(ns namespace)
 	finalize() Value
+
+	// Removes the contribution of a row that was passed to step, so that an
+	// incrementally maintained view need not recompute the aggregate when a
+	// row is deleted. Reports false if that is not possible, e.g. because the
+	// row held the minimum value; the aggregate must then be recomputed.
+	unstep(ns namespace) bool
 }
 
 // Implements the COUNT function.
 type countAggFunc struct {
-	expr   ast.Expr
-	isStar bool // true if COUNT(*)
-	count  int
+	expr     ast.Expr
+	isStar   bool     // true if COUNT(*)
+	distinct valueSet // non-nil if COUNT(DISTINCT ...)
+	count    int
 }
 
-func newCountAggFunc(node ast.Node, args []ast.Expr) aggFunc {
-	validateArgCount(node, "count", args, 1)
-	_, isStar := args[0].(*ast.SelectStarExpr)
-	return &countAggFunc{expr: args[0], isStar: isStar}
+func newCountAggFunc(call *ast.FunctionCall) aggFunc {
+	validateArgCount(call, "count", call.Args, 1)
+	fn := &countAggFunc{expr: call.Args[0]}
+	_, fn.isStar = fn.expr.(*ast.SelectStarExpr)
+	if call.Distinct {
+		if fn.isStar {
+			panic(errorf(call, "COUNT(DISTINCT *) is not allowed"))
+		}
+		fn.distinct = make(valueSet)
+	}
+	return fn
 }
 
 func (fn *countAggFunc) Pos() token.Pos { return fn.expr.Pos() }
 
 func (fn *countAggFunc) step(ns namespace) {
-	if fn.isStar || evalExpr(ns, fn.expr) != nil {
+	if fn.isStar {
 		fn.count++
+		return
+	}
+	value := evalExpr(ns, fn.expr)
+	if value == nil {
+		return
+	}
+	if fn.distinct != nil && !fn.distinct.add(value) {
+		return // already counted
 	}
+	fn.count++
+}
+
+func (fn *countAggFunc) unstep(ns namespace) bool {
+	if fn.isStar {
+		fn.count--
+		return true
+	}
+	if fn.distinct != nil {
+		return false // other rows may have the same value
+	}
+	if evalExpr(ns, fn.expr) != nil {
+		fn.count--
+	}
+	return true
 }
 
 func (fn *countAggFunc) finalize() Value {
@@ -48,16 +85,18 @@ type minMaxAggFunc struct {
 	ival    int64
 	isFloat bool
 	isMin   bool
+	seen    bool // true if any non-null value was seen
 }
 
-func newMinAggFunc(node ast.Node, args []ast.Expr) aggFunc {
-	validateArgCount(node, "min", args, 1)
-	return &minMaxAggFunc{expr: args[0], ival: math.MaxInt64, isMin: true}
+// N.B. DISTINCT has no effect on MIN and MAX, so it is allowed but ignored.
+func newMinAggFunc(call *ast.FunctionCall) aggFunc {
+	validateArgCount(call, "min", call.Args, 1)
+	return &minMaxAggFunc{expr: call.Args[0], ival: math.MaxInt64, isMin: true}
 }
 
-func newMaxAggFunc(node ast.Node, args []ast.Expr) aggFunc {
-	validateArgCount(node, "max", args, 1)
-	return &minMaxAggFunc{expr: args[0], ival: math.MinInt64}
+func newMaxAggFunc(call *ast.FunctionCall) aggFunc {
+	validateArgCount(call, "max", call.Args, 1)
+	return &minMaxAggFunc{expr: call.Args[0], ival: math.MinInt64}
 }
 
 func (fn *minMaxAggFunc) Pos() token.Pos { return fn.expr.Pos() }
@@ -76,18 +115,23 @@ func (fn *minMaxAggFunc) setInt(n int64) {
 
 func (fn *minMaxAggFunc) setFloat(n float64) {
 	if fn.isMin {
-		if fn.fval < n {
+		if n < fn.fval {
 			fn.fval = n
 		}
 	} else {
-		if fn.fval > n {
+		if n > fn.fval {
 			fn.fval = n
 		}
 	}
 }
 
 func (fn *minMaxAggFunc) step(ns namespace) {
-	switch value := evalExpr(ns, fn.expr).(type) {
+	value := evalExpr(ns, fn.expr)
+	if value == nil {
+		return
+	}
+	fn.seen = true
+	switch value := value.(type) {
 	case IntegerValue:
 		if fn.isFloat {
 			fn.setFloat(float64(value))
@@ -100,15 +144,32 @@ func (fn *minMaxAggFunc) step(ns namespace) {
 			fn.fval = float64(fn.ival)
 		}
 		fn.setFloat(float64(value))
-	case nil:
-		return
 	default:
 		panic(errorf(fn.expr, "cannot compute MIN of %s", value))
 	}
 }
 
+// A value other than the minimum (or maximum) can be removed without changing
+// the result.
+func (fn *minMaxAggFunc) unstep(ns namespace) bool {
+	switch value := evalExpr(ns, fn.expr).(type) {
+	case nil:
+		return true
+	case IntegerValue:
+		if fn.isFloat {
+			return float64(value) != fn.fval
+		}
+		return int64(value) != fn.ival
+	case NumberValue:
+		return fn.isFloat && float64(value) != fn.fval
+	}
+	return false
+}
+
 func (fn *minMaxAggFunc) finalize() Value {
 	switch {
+	case !fn.seen:
+		return nil
 	case fn.isFloat:
 		return NumberValue(fn.fval)
 	default:
@@ -118,21 +179,35 @@ func (fn *minMaxAggFunc) finalize() Value {
 
 // Implements the SUM function.
 type sumAggFunc struct {
-	expr    ast.Expr
-	fsum    float64
-	isum    int64
-	isFloat bool
+	expr     ast.Expr
+	distinct valueSet // non-nil if SUM(DISTINCT ...)
+	fsum     float64
+	isum     int64
+	isFloat  bool
+	n        int // number of non-null values summed
 }
 
-func newSumAggFunc(node ast.Node, args []ast.Expr) aggFunc {
-	validateArgCount(node, "sum", args, 1)
-	return &sumAggFunc{expr: args[0]}
+func newSumAggFunc(call *ast.FunctionCall) aggFunc {
+	validateArgCount(call, "sum", call.Args, 1)
+	fn := &sumAggFunc{expr: call.Args[0]}
+	if call.Distinct {
+		fn.distinct = make(valueSet)
+	}
+	return fn
 }
 
 func (fn *sumAggFunc) Pos() token.Pos { return fn.expr.Pos() }
 
 func (fn *sumAggFunc) step(ns namespace) {
-	switch value := evalExpr(ns, fn.expr).(type) {
+	value := evalExpr(ns, fn.expr)
+	if value == nil {
+		return
+	}
+	if fn.distinct != nil && !fn.distinct.add(value) {
+		return // already added
+	}
+	fn.n++
+	switch value := value.(type) {
 	case IntegerValue:
 		if fn.isFloat {
 			fn.fsum += float64(value)
@@ -145,15 +220,40 @@ func (fn *sumAggFunc) step(ns namespace) {
 			fn.fsum += float64(fn.isum)
 		}
 		fn.fsum += float64(value)
-	case nil:
-		return
 	default:
 		panic(errorf(fn.expr, "cannot compute SUM of %s", value))
 	}
 }
 
+func (fn *sumAggFunc) unstep(ns namespace) bool {
+	if fn.distinct != nil {
+		return false // other rows may have the same value
+	}
+	switch value := evalExpr(ns, fn.expr).(type) {
+	case nil:
+		return true
+	case IntegerValue:
+		if fn.isFloat {
+			fn.fsum -= float64(value)
+		} else {
+			fn.isum -= int64(value)
+		}
+	case NumberValue:
+		if !fn.isFloat {
+			return false
+		}
+		fn.fsum -= float64(value)
+	default:
+		return false
+	}
+	fn.n--
+	return true
+}
+
 func (fn *sumAggFunc) finalize() Value {
 	switch {
+	case fn.n == 0:
+		return nil
 	case fn.isFloat:
 		return NumberValue(fn.fsum)
 	default:
@@ -161,8 +261,28 @@ func (fn *sumAggFunc) finalize() Value {
 	}
 }
 
+// Wraps an aggregate function that has a FILTER clause, so that it sees only
+// the rows for which the filter condition is true.
+type filterAggFunc struct {
+	aggFunc
+	filter ast.Expr
+}
+
+func (fn *filterAggFunc) step(ns namespace) {
+	if isTrue(evalExpr(ns, fn.filter)) {
+		fn.aggFunc.step(ns)
+	}
+}
+
+func (fn *filterAggFunc) unstep(ns namespace) bool {
+	if isTrue(evalExpr(ns, fn.filter)) {
+		return fn.aggFunc.unstep(ns)
+	}
+	return true
+}
+
 // A function that creates new aggregator functions.
-type aggFuncConstructor func(ast.Node, []ast.Expr) aggFunc
+type aggFuncConstructor func(*ast.FunctionCall) aggFunc
 
 var builtinAggFuncs = map[string]aggFuncConstructor{
 	"count": newCountAggFunc,
@@ -200,16 +320,46 @@ func (st *aggFuncRewriter) rewrite(expr ast.Expr) ast.Expr {
 		return &ast.BinaryExpr{Lhs: st.rewrite(expr.Lhs), Op: expr.Op, Rhs: st.rewrite(expr.Rhs)}
 	case *ast.UnaryExpr:
 		return &ast.UnaryExpr{StartPos: expr.StartPos, Expr: st.rewrite(expr.Expr), Op: expr.Op}
+	case *ast.IsExpr:
+		return &ast.IsExpr{Expr: st.rewrite(expr.Expr), Not: expr.Not, Kind: expr.Kind, From: st.rewrite(expr.From)}
+	case *ast.LikeExpr:
+		return &ast.LikeExpr{Expr: st.rewrite(expr.Expr), Op: expr.Op, Pattern: st.rewrite(expr.Pattern), Escape: st.rewrite(expr.Escape)}
+	case *ast.BetweenExpr:
+		return &ast.BetweenExpr{Expr: st.rewrite(expr.Expr), Low: st.rewrite(expr.Low), High: st.rewrite(expr.High)}
+	case *ast.TupleExpr:
+		exprs := make([]ast.Expr, len(expr.Exprs))
+		for i, e := range expr.Exprs {
+			exprs[i] = st.rewrite(e)
+		}
+		return &ast.TupleExpr{StartPos: expr.StartPos, Exprs: exprs}
+	case *ast.CaseExpr:
+		result := &ast.CaseExpr{StartPos: expr.StartPos, Operand: st.rewrite(expr.Operand), Else: st.rewrite(expr.Else)}
+		for _, when := range expr.Whens {
+			result.Whens = append(result.Whens, &ast.WhenClause{Cond: st.rewrite(when.Cond), Result: st.rewrite(when.Result)})
+		}
+		return result
+	case *ast.CastExpr:
+		return &ast.CastExpr{StartPos: expr.StartPos, Expr: st.rewrite(expr.Expr), Type: expr.Type}
 	case *ast.FunctionCall:
+		if expr.Over != nil {
+			// The inputs of a window function are rewritten separately.
+			return expr
+		}
 		funcName := expr.Name.Name
 		if constructor := builtinAggFuncs[funcName]; constructor != nil {
-			newNode := constructor(expr, expr.Args)
+			newNode := constructor(expr)
+			if expr.Filter != nil {
+				newNode = &filterAggFunc{newNode, expr.Filter}
+			}
 			st.funcs = append(st.funcs, newNode)
 			return newNode
-		} else {
-			// For now, other kinds of functions are not supported.
-			panic(errorf(expr, "unknown function: %s", funcName))
 		}
+		// A scalar function, whose arguments may contain aggregates.
+		args := make([]ast.Expr, len(expr.Args))
+		for i, arg := range expr.Args {
+			args[i] = st.rewrite(arg)
+		}
+		return &ast.FunctionCall{Name: expr.Name, Distinct: expr.Distinct, Args: args, Filter: expr.Filter}
 	}
 	return expr // rewrite unnecessary
 }
@@ -222,8 +372,11 @@ func containsAggFunc(node ast.Node) bool {
 		if found {
 			return nil // prune search
 		}
+		if _, ok := node.(*ast.SubqueryExpr); ok {
+			return nil // subqueries have their own aggregates
+		}
 		if node, ok := node.(*ast.FunctionCall); ok {
-			if isAggFunc(node.Name.Name) {
+			if isAggFunc(node.Name.Name) && node.Over == nil {
 				found = true
 				return nil // prune search
 			}
@@ -234,28 +387,170 @@ func containsAggFunc(node ast.Node) bool {
 	return found
 }
 
+// Recursively searches an AST for a window function call.
+func containsWindowFunc(node ast.Node) bool {
+	var fn ast.WalkFunc
+	found := false
+	fn = func(node ast.Node) ast.WalkFunc {
+		if found {
+			return nil // prune search
+		}
+		if _, ok := node.(*ast.SubqueryExpr); ok {
+			return nil // subqueries have their own window functions
+		}
+		if node, ok := node.(*ast.FunctionCall); ok && node.Over != nil {
+			found = true
+			return nil // prune search
+		}
+		return fn
+	}
+	ast.Walk(node, fn)
+	return found
+}
+
 // Verifies the following: (1) no argument of an aggregate contains a nested
 // call to an aggregate function; (2) no column identifier exists outside of
-// an aggregate function. N.B. only call this function on the projections of a
-// SELECT that contains one or more aggregate functions.
-func validateAggExpr(node ast.Node) {
+// an aggregate function, unless it is part of an expression that appears in
+// the GROUP BY clause. N.B. only call this function on the projections and
+// HAVING clause of a SELECT that contains aggregate functions or grouping.
+func validateAggExpr(node ast.Node, groupBy []ast.Expr) {
 	var fn ast.WalkFunc
 	fn = func(node ast.Node) ast.WalkFunc {
+		if expr, ok := node.(ast.Expr); ok {
+			for _, grouped := range groupBy {
+				if sameExpr(expr, grouped) {
+					return nil // prune search
+				}
+			}
+		}
 		switch node := node.(type) {
+		case *ast.SubqueryExpr:
+			return nil // prune search
 		case *ast.FunctionCall:
+			if node.Over != nil {
+				return nil // window function inputs are validated separately
+			}
 			if isAggFunc(node.Name.Name) {
 				for _, arg := range node.Args {
 					if containsAggFunc(arg) {
 						panic(errorf(arg, "aggregate function calls cannot be nested"))
 					}
+					if containsWindowFunc(arg) {
+						panic(errorf(arg, "aggregate function calls cannot contain window function calls"))
+					}
+				}
+				if node.Filter != nil && containsAggFunc(node.Filter) {
+					panic(errorf(node.Filter, "aggregate functions are not allowed in FILTER"))
 				}
 				return nil // prune search
 			}
+			// Skip the function name, which is not a column reference.
+			for _, arg := range node.Args {
+				ast.Walk(arg, fn)
+			}
+			return nil
 		case *ast.Ident:
 			panic(errorf(node, "column %q must appear in the GROUP BY clause "+
 				"or be used in an aggregate function", node.Name))
+		case *ast.QualifiedIdent:
+			panic(errorf(node, "column \"%s.%s\" must appear in the GROUP BY clause "+
+				"or be used in an aggregate function", node.Table.Name, node.Name.Name))
 		}
 		return fn
 	}
 	ast.Walk(node, fn)
 }
+
+// Reports whether two expressions are structurally identical, ignoring their
+// positions in the input.
+func sameExpr(x, y ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.Ident:
+		y, ok := y.(*ast.Ident)
+		return ok && x.Name == y.Name
+	case *ast.QualifiedIdent:
+		y, ok := y.(*ast.QualifiedIdent)
+		return ok && x.Table.Name == y.Table.Name && x.Name.Name == y.Name.Name
+	case *ast.IntegerLiteral:
+		y, ok := y.(*ast.IntegerLiteral)
+		return ok && x.Value == y.Value
+	case *ast.NumberLiteral:
+		y, ok := y.(*ast.NumberLiteral)
+		return ok && x.Value == y.Value
+	case *ast.StringLiteral:
+		y, ok := y.(*ast.StringLiteral)
+		return ok && x.Value == y.Value
+	case *ast.BooleanLiteral:
+		y, ok := y.(*ast.BooleanLiteral)
+		return ok && x.Value == y.Value
+	case *ast.Null:
+		_, ok := y.(*ast.Null)
+		return ok
+	case *ast.SelectStarExpr:
+		_, ok := y.(*ast.SelectStarExpr)
+		return ok
+	case *ast.BinaryExpr:
+		y, ok := y.(*ast.BinaryExpr)
+		return ok && x.Op == y.Op && sameExpr(x.Lhs, y.Lhs) && sameExpr(x.Rhs, y.Rhs)
+	case *ast.UnaryExpr:
+		y, ok := y.(*ast.UnaryExpr)
+		return ok && x.Op == y.Op && sameExpr(x.Expr, y.Expr)
+	case *ast.FunctionCall:
+		y, ok := y.(*ast.FunctionCall)
+		return ok && x.Name.Name == y.Name.Name && x.Distinct == y.Distinct && sameExprs(x.Args, y.Args) &&
+			sameOptionalExpr(x.Filter, y.Filter) && x.Over == y.Over
+	case *ast.IsExpr:
+		y, ok := y.(*ast.IsExpr)
+		return ok && x.Not == y.Not && x.Kind == y.Kind && sameExpr(x.Expr, y.Expr) &&
+			sameOptionalExpr(x.From, y.From)
+	case *ast.CaseExpr:
+		y, ok := y.(*ast.CaseExpr)
+		if !ok || len(x.Whens) != len(y.Whens) || !sameOptionalExpr(x.Operand, y.Operand) ||
+			!sameOptionalExpr(x.Else, y.Else) {
+			return false
+		}
+		for i, when := range x.Whens {
+			if !sameExpr(when.Cond, y.Whens[i].Cond) || !sameExpr(when.Result, y.Whens[i].Result) {
+				return false
+			}
+		}
+		return true
+	case *ast.LikeExpr:
+		y, ok := y.(*ast.LikeExpr)
+		return ok && x.Op == y.Op && sameExpr(x.Expr, y.Expr) && sameExpr(x.Pattern, y.Pattern) &&
+			sameOptionalExpr(x.Escape, y.Escape)
+	case *ast.BetweenExpr:
+		y, ok := y.(*ast.BetweenExpr)
+		return ok && sameExpr(x.Expr, y.Expr) && sameExpr(x.Low, y.Low) && sameExpr(x.High, y.High)
+	case *ast.TupleExpr:
+		y, ok := y.(*ast.TupleExpr)
+		return ok && sameExprs(x.Exprs, y.Exprs)
+	case *ast.CastExpr:
+		y, ok := y.(*ast.CastExpr)
+		return ok && x.Type == y.Type && sameExpr(x.Expr, y.Expr)
+	case *ast.SubqueryExpr:
+		return x == y
+	}
+	return false
+}
+
+// Like sameExpr, but either expression may be nil.
+func sameOptionalExpr(x, y ast.Expr) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	return sameExpr(x, y)
+}
+
+// Reports whether two lists of expressions are pairwise identical.
+func sameExprs(xs, ys []ast.Expr) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if !sameExpr(xs[i], ys[i]) {
+			return false
+		}
+	}
+	return true
+}
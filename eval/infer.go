@@ -0,0 +1,252 @@
+package eval
+
+import (
+	"strings"
+
+	"github.com/dcowgill/toysqleval/ast"
+	"github.com/dcowgill/toysqleval/token"
+)
+
+// Returns the default name of the result column produced by a projected
+// expression that has no alias. Like Postgres, we name a column after the
+// column or function it refers to, if any; otherwise, it is "?column?".
+func columnName(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name
+	case *ast.QualifiedIdent:
+		return expr.Name.Name
+	case *ast.FunctionCall:
+		return expr.Name.Name
+	case *ast.CaseExpr:
+		return "case"
+	case *ast.CastExpr:
+		if name := columnName(expr.Expr); name != "?column?" {
+			return name
+		}
+		return strings.ToLower(expr.Type.String())
+	case *ast.UnaryExpr:
+		if expr.Op == token.Exists {
+			return "exists"
+		}
+	case *ast.SubqueryExpr:
+		// The columns of a compound select are named by its leftmost query.
+		query := expr.Select
+		for {
+			switch q := query.(type) {
+			case *ast.CompoundSelectStmt:
+				query = q.Left
+				continue
+			case *ast.WithStmt:
+				query = q.Query
+				continue
+			case *ast.SelectStmt:
+				if len(q.Columns) == 1 {
+					if aliased, ok := q.Columns[0].(*ast.AliasedExpr); ok {
+						return aliased.Alias.Name
+					}
+					return columnName(q.Columns[0])
+				}
+			}
+			break
+		}
+	}
+	return "?column?"
+}
+
+// Describes the columns of the result of a select statement. Types are
+// inferred from the projected expressions, which are resolved in namespace ns.
+// Where that fails, e.g. for a scalar subquery, the column takes the type of
+// its values, if they all have the same type.
+func resultColumns(ns namespace, projection []ast.Expr, names []string, rows []Row) []*Column {
+	columns := make([]*Column, len(projection))
+	for i, expr := range projection {
+		t, nullable := inferType(ns, expr)
+		if t == InvalidDataType {
+			t, nullable = typeOfColumn(rows, i), true
+		}
+		columns[i] = &Column{Name: names[i], Type: t, Nullable: nullable}
+	}
+	return columns
+}
+
+// Returns the type of every non-null value in a column of rows, or
+// InvalidDataType if the values do not all have the same type.
+func typeOfColumn(rows []Row, i int) DataType {
+	t := InvalidDataType
+	for _, row := range rows {
+		if row[i] == nil {
+			continue
+		}
+		if vt := typeOf(row[i]); t == InvalidDataType {
+			t = vt
+		} else if vt != t {
+			return InvalidDataType
+		}
+	}
+	return t
+}
+
+// Infers the data type of an expression without evaluating it, and reports
+// whether the expression may be null. Returns InvalidDataType if the type
+// cannot be determined statically.
+func inferType(ns namespace, expr ast.Expr) (t DataType, nullable bool) {
+	switch expr := expr.(type) {
+	case *ast.Ident, *ast.QualifiedIdent:
+		return columnType(ns.column(expr))
+	case *ast.IntegerLiteral:
+		return Integer, false
+	case *ast.NumberLiteral:
+		return Number, false
+	case *ast.StringLiteral:
+		return String, false
+	case *ast.BooleanLiteral:
+		return Boolean, false
+	case *ast.Null:
+		return InvalidDataType, true
+	case *ast.BinaryExpr:
+		return inferBinaryType(ns, expr)
+	case *ast.UnaryExpr:
+		switch expr.Op {
+		case token.Exists:
+			return Boolean, false
+		case token.Not:
+			_, nullable := inferType(ns, expr.Expr)
+			return Boolean, nullable
+		}
+		return inferType(ns, expr.Expr)
+	case *ast.IsExpr:
+		return Boolean, false
+	case *ast.LikeExpr:
+		return Boolean, anyNullable(ns, expr.Expr, expr.Pattern, expr.Escape)
+	case *ast.BetweenExpr:
+		return Boolean, anyNullable(ns, expr.Expr, expr.Low, expr.High)
+	case *ast.CastExpr:
+		_, nullable := inferType(ns, expr.Expr)
+		return dataTypeFromToken(expr, expr.Type), nullable
+	case *ast.CaseExpr:
+		return inferCaseType(ns, expr)
+	case *ast.FunctionCall:
+		return inferFunctionType(ns, expr)
+	}
+	return InvalidDataType, true
+}
+
+// Returns the type of a column and whether it is nullable. A nil column has
+// an unknown type.
+func columnType(col *Column) (DataType, bool) {
+	if col == nil {
+		return InvalidDataType, true
+	}
+	return col.Type, col.Nullable
+}
+
+// Reports whether any of the expressions may be null. Nil expressions are
+// ignored.
+func anyNullable(ns namespace, exprs ...ast.Expr) bool {
+	for _, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		if _, nullable := inferType(ns, expr); nullable {
+			return true
+		}
+	}
+	return false
+}
+
+// Infers the type of a binary expression; see arithmeticOp.
+func inferBinaryType(ns namespace, expr *ast.BinaryExpr) (DataType, bool) {
+	lt, lnull := inferType(ns, expr.Lhs)
+	rt, rnull := inferType(ns, expr.Rhs)
+	nullable := lnull || rnull
+	switch expr.Op {
+	case token.Plus, token.Minus, token.Mul, token.Div:
+		switch {
+		case lt == Number || rt == Number:
+			return Number, nullable
+		case lt == Integer || rt == Integer:
+			return Integer, nullable
+		}
+		return InvalidDataType, true
+	case token.Concat:
+		return String, nullable
+	case token.In:
+		if _, ok := expr.Rhs.(*ast.TupleExpr); ok {
+			return Boolean, nullable
+		}
+		return Boolean, true
+	}
+	return Boolean, nullable
+}
+
+// Infers the type of a CASE expression from the first result whose type is
+// known. The result may be null if any branch may be, or if there is no ELSE.
+func inferCaseType(ns namespace, expr *ast.CaseExpr) (DataType, bool) {
+	t, nullable := InvalidDataType, expr.Else == nil
+	results := make([]ast.Expr, 0, len(expr.Whens)+1)
+	for _, when := range expr.Whens {
+		results = append(results, when.Result)
+	}
+	if expr.Else != nil {
+		results = append(results, expr.Else)
+	}
+	for _, result := range results {
+		rt, rnull := inferType(ns, result)
+		if t == InvalidDataType {
+			t = rt
+		}
+		nullable = nullable || rnull
+	}
+	return t, nullable
+}
+
+// Infers the type of a call to an aggregate, window or scalar function. A
+// scalar function whose result type depends on its arguments returns the type
+// of its first argument whose type is known.
+func inferFunctionType(ns namespace, expr *ast.FunctionCall) (DataType, bool) {
+	name := expr.Name.Name
+	switch name {
+	case "row_number", "rank", "dense_rank":
+		return Integer, false
+	case "ntile":
+		return Integer, true // null if the argument is
+	case "lag", "lead", "first_value", "last_value":
+		if len(expr.Args) != 0 {
+			t, _ := inferType(ns, expr.Args[0])
+			return t, true // null if the row is outside the partition or frame
+		}
+	case "count":
+		return Integer, false
+	case "min", "max", "sum":
+		if len(expr.Args) == 1 {
+			t, _ := inferType(ns, expr.Args[0])
+			return t, true // null if there are no rows
+		}
+	}
+	fn := ns.environment().lookupFunc(name)
+	if fn == nil {
+		return InvalidDataType, true
+	}
+	t, nullable := fn.sig.Result, !fn.sig.Strict
+	if t == InvalidDataType {
+		for _, arg := range expr.Args {
+			if t, _ = inferType(ns, arg); t != InvalidDataType {
+				break
+			}
+		}
+	}
+	switch {
+	case fn.sig.Strict:
+		nullable = anyNullable(ns, expr.Args...)
+	case name == "coalesce":
+		// The result is null only if every argument is null.
+		nullable = true
+		for _, arg := range expr.Args {
+			if _, argNullable := inferType(ns, arg); !argNullable {
+				nullable = false
+			}
+		}
+	}
+	return t, nullable
+}
@@ -0,0 +1,99 @@
+package eval
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dcowgill/toysqleval/ast"
+	"github.com/dcowgill/toysqleval/token"
+)
+
+// Evaluates "x [I]LIKE pattern [ESCAPE e]". In the pattern, "%" matches any
+// sequence of characters and "_" matches any single character; the escape
+// character, which defaults to a backslash, makes the next character literal.
+// The result is null if any operand is null.
+func evalLikeExpr(ns namespace, expr *ast.LikeExpr) Value {
+	value := evalExpr(ns, expr.Expr)
+	pattern := evalExpr(ns, expr.Pattern)
+	escape := Value(StringValue(`\`))
+	if expr.Escape != nil {
+		escape = evalExpr(ns, expr.Escape)
+	}
+	if value == nil || pattern == nil || escape == nil {
+		return nil
+	}
+	re := likeToRegexp(expr, string(pattern.toString()), string(escape.toString()), expr.Op == token.Ilike)
+	return BooleanValue(re.MatchString(string(value.toString())))
+}
+
+// Translates a LIKE pattern into an equivalent regular expression. An empty
+// escape string means that the pattern has no escape character.
+func likeToRegexp(expr *ast.LikeExpr, pattern, escape string, foldCase bool) *regexp.Regexp {
+	if utf8.RuneCountInString(escape) > 1 {
+		panic(errorf(expr.Escape, "invalid escape string: must be empty or one character"))
+	}
+	esc, _ := utf8.DecodeRuneInString(escape)
+	var sb strings.Builder
+	sb.WriteString("^(?s")
+	if foldCase {
+		sb.WriteString("i")
+	}
+	sb.WriteString(")")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case escape != "" && r == esc:
+			if i++; i == len(runes) {
+				panic(errorf(expr.Pattern, "LIKE pattern must not end with escape character"))
+			}
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// Computes "x ~ pattern" and its variants: "~*" ignores case, and "!~" and
+// "!~*" negate the result. Unlike LIKE, the pattern matches if it matches any
+// part of the string. The result is null if either operand is null.
+func regexMatchOp(expr *ast.BinaryExpr, lhs, rhs Value) Value {
+	if lhs == nil || rhs == nil {
+		return nil
+	}
+	pattern := string(rhs.toString())
+	if expr.Op == token.RegexIMatch || expr.Op == token.NotRegexIMatch {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(errorf(expr.Rhs, "invalid regular expression: %s", err))
+	}
+	matched := re.MatchString(string(lhs.toString()))
+	if expr.Op == token.NotRegexMatch || expr.Op == token.NotRegexIMatch {
+		matched = !matched
+	}
+	return BooleanValue(matched)
+}
+
+// Evaluates "x BETWEEN low AND high", which is equivalent to "x >= low AND
+// x <= high".
+func evalBetweenExpr(ns namespace, expr *ast.BetweenExpr) Value {
+	value := evalExpr(ns, expr.Expr)
+	low := evalExpr(ns, expr.Low)
+	high := evalExpr(ns, expr.High)
+	var geLow, leHigh Value
+	if value != nil && low != nil {
+		geLow = BooleanValue(compareValues(expr, value, low) >= 0)
+	}
+	if value != nil && high != nil {
+		leHigh = BooleanValue(compareValues(expr, value, high) <= 0)
+	}
+	return and3(geLow, leHigh)
+}
@@ -0,0 +1,345 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Evaluates a refresh materialized view statement, which replaces the stored
+// result of a materialized view with the current result of its query.
+func evalRefreshStmt(env *Environment, stmt *ast.RefreshStmt) {
+	name := stmt.View.Name
+	v, isView := env.views[name]
+	_, isTable := env.tables[name]
+	switch {
+	case isView && v.materialized:
+		v.refresh(env)
+	case isView || isTable:
+		panic(errorf(stmt.View, "%q is not a materialized view", name))
+	default:
+		panic(errorf(stmt.View, "relation %q does not exist", name))
+	}
+}
+
+// Recomputes the stored result of a materialized view.
+func (v *view) refresh(env *Environment) {
+	if v.incremental != nil {
+		v.incremental.build(env)
+		return
+	}
+	v.data = v.evalQuery(env)
+}
+
+// Returns the incrementally maintained views whose queries select from the
+// named table, ordered by name.
+func (env *Environment) incrementalViews(table string) []*view {
+	var views []*view
+	for _, v := range env.dependentViews(table) {
+		if v.incremental != nil {
+			views = append(views, v)
+		}
+	}
+	return views
+}
+
+// Rebuilds the incrementally maintained views of a table whose contents were
+// replaced other than by a changeSet, as by TRUNCATE or ALTER TABLE.
+func (env *Environment) refreshIncrementalViews(table string) {
+	for _, v := range env.incrementalViews(table) {
+		v.refresh(env)
+	}
+}
+
+// The state of a materialized view that is kept up to date as statements
+// change the table from which it selects, instead of being refreshed. Only
+// views whose queries filter, project and aggregate the rows of a single
+// table are maintained this way, since the effect of a changed row on the
+// result of such a query can be computed from the row alone: a row of a plain
+// query maps to at most one row of the result, and a row of an aggregate query
+// contributes only to the aggregates of its group.
+type incrementalView struct {
+	view       *view
+	stmt       *ast.SelectStmt
+	table      string     // name of the table from which the query selects
+	alias      string     // name by which the query refers to the table
+	scope      scope      // columns of the table, under the alias
+	projection []ast.Expr // expanded projection
+	names      []string   // names of the result columns
+	aggregate  bool
+	valid      bool // false if the state below must be rebuilt before it is used
+
+	// Result row for each row of the table, or nil if the row does not
+	// satisfy the where clause. Not used if the query is an aggregate.
+	rows []Row
+
+	// Groups of an aggregate query, in order of creation, and by key.
+	groups []*ivmGroup
+	index  map[string]*ivmGroup
+}
+
+// A group of rows of an incrementally maintained aggregate view.
+type ivmGroup struct {
+	key   string
+	count int       // number of rows in the group
+	rg    *rowGroup // aggregates of the group's rows
+	row   Row       // result row, or nil if the group fails the having clause
+	dirty bool      // whether row must be reevaluated
+	stale bool      // whether the aggregates must be recomputed from scratch
+}
+
+// Creates the incremental state of a new materialized view, and builds the
+// view's result. Panics unless the view's query can be maintained
+// incrementally.
+func newIncrementalView(env *Environment, v *view) *incrementalView {
+	fail := func(node ast.Node, reason string) {
+		panic(errorf(node, "materialized view %q cannot be maintained incrementally: %s", v.name, reason))
+	}
+	stmt, ok := v.query.(*ast.SelectStmt)
+	if !ok {
+		fail(v.query, "query must be a simple SELECT")
+	}
+	iv := &incrementalView{view: v, stmt: stmt}
+	switch expr := stmt.Table.(type) {
+	case *ast.Ident:
+		iv.table, iv.alias = expr.Name, expr.Name
+	case *ast.AliasedTableExpr:
+		if ident, ok := expr.Expr.(*ast.Ident); ok {
+			iv.table, iv.alias = ident.Name, expr.Alias.Name
+		}
+	}
+	if _, ok := env.tables[iv.table]; !ok {
+		fail(stmt, "query must select from a single table")
+	}
+	switch {
+	case stmt.Distinct:
+		fail(stmt, "DISTINCT is not supported")
+	case len(stmt.OrderBy) != 0 || stmt.Limit != nil || stmt.Offset != nil:
+		fail(stmt, "ORDER BY, LIMIT and OFFSET are not supported")
+	case len(stmt.Windows) != 0:
+		fail(stmt, "window functions are not supported")
+	}
+	for _, expr := range stmt.Columns {
+		if containsWindowFunc(expr) {
+			fail(expr, "window functions are not supported")
+		}
+	}
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		if _, ok := node.(*ast.SubqueryExpr); ok {
+			fail(node, "subqueries are not supported")
+		}
+		return walk
+	}
+	ast.Walk(stmt, walk)
+	iv.build(env)
+	return iv
+}
+
+// Rebuilds the view's result from the current contents of the table.
+func (iv *incrementalView) build(env *Environment) {
+	table := env.tables[iv.table]
+	iv.scope = tableScope(table, iv.alias)
+	iv.projection, iv.names = expandProjection(iv.stmt.Columns, iv.scope)
+	iv.aggregate = isAggregateSelect(iv.stmt, iv.projection)
+	iv.rows, iv.groups, iv.index = nil, nil, make(map[string]*ivmGroup)
+	if iv.aggregate {
+		if len(iv.stmt.GroupBy) == 0 {
+			// As in evalAggregateSelectStmt, there is exactly one group,
+			// even if no rows match.
+			iv.newGroup(env, make(Row, len(iv.scope)), rowKey(nil))
+		}
+		for _, row := range table.Data {
+			iv.add(env, row)
+		}
+	} else {
+		iv.rows = make([]Row, len(table.Data))
+		for i, row := range table.Data {
+			iv.rows[i] = iv.project(env, row)
+		}
+	}
+	rows := iv.result(env, table.Data)
+	ns := &currentRow{iv.scope, nil, emptyNamespace{env}}
+	iv.view.data = iv.view.newTable(resultColumns(ns, iv.projection, iv.names, rows), rows)
+	iv.valid = true
+}
+
+// Updates the view's result to reflect changes to the table, before they are
+// made; the table's rows are still the old ones.
+func (iv *incrementalView) apply(env *Environment, tc *tableChange) {
+	if !iv.valid {
+		iv.build(env)
+	}
+	if iv.aggregate {
+		changed := tc.changedIndexes()
+		for _, i := range changed {
+			iv.remove(env, tc.table.Data[i])
+		}
+		for _, i := range changed {
+			if row := tc.changes[i]; row != nil {
+				iv.add(env, row)
+			}
+		}
+		for _, row := range tc.inserted {
+			iv.add(env, row)
+		}
+	} else {
+		// Mirror the way changeSet.commit changes the table.
+		rows := make([]Row, 0, len(tc.data))
+		for i := range tc.table.Data {
+			row, changed := tc.changes[i]
+			switch {
+			case !changed:
+				rows = append(rows, iv.rows[i])
+			case row != nil:
+				rows = append(rows, iv.project(env, row))
+			}
+		}
+		for _, row := range tc.inserted {
+			rows = append(rows, iv.project(env, row))
+		}
+		iv.rows = rows
+	}
+	iv.view.data = &Table{Name: iv.view.name, Columns: iv.view.data.Columns, Data: iv.result(env, tc.data)}
+}
+
+// Returns a namespace in which the current row is a row of the table.
+func (iv *incrementalView) namespace(env *Environment, row Row) *currentRow {
+	return &currentRow{iv.scope, row, emptyNamespace{env}}
+}
+
+// Reports whether the current row satisfies the where clause.
+func (iv *incrementalView) matches(ns namespace) bool {
+	return iv.stmt.Where == nil || isTrue(evalExpr(ns, iv.stmt.Where))
+}
+
+// Returns the key of the group to which the current row belongs.
+func (iv *incrementalView) groupKey(ns namespace) string {
+	key := make([]Value, len(iv.stmt.GroupBy))
+	for i, expr := range iv.stmt.GroupBy {
+		key[i] = evalExpr(ns, expr)
+	}
+	return rowKey(key)
+}
+
+// Returns the result row of a plain query for a row of the table, or nil if
+// the row does not satisfy the where clause.
+func (iv *incrementalView) project(env *Environment, row Row) Row {
+	ns := iv.namespace(env, row)
+	if !iv.matches(ns) {
+		return nil
+	}
+	result := make(Row, len(iv.projection))
+	for i, expr := range iv.projection {
+		result[i] = evalExpr(ns, expr)
+	}
+	return result
+}
+
+// Creates a group whose first row is row.
+func (iv *incrementalView) newGroup(env *Environment, row Row, key string) *ivmGroup {
+	ns := iv.namespace(env, row)
+	g := &ivmGroup{key: key, rg: newRowGroup(ns, iv.projection, iv.stmt.Having), dirty: true}
+	iv.groups = append(iv.groups, g)
+	iv.index[key] = g
+	return g
+}
+
+// Adds a row of the table to its group, if it satisfies the where clause.
+func (iv *incrementalView) add(env *Environment, row Row) {
+	ns := iv.namespace(env, row)
+	if !iv.matches(ns) {
+		return
+	}
+	key := iv.groupKey(ns)
+	g := iv.index[key]
+	if g == nil {
+		g = iv.newGroup(env, row, key)
+	}
+	g.count++
+	g.dirty = true
+	if !g.stale {
+		for _, fn := range g.rg.funcs {
+			fn.step(ns)
+		}
+	}
+}
+
+// Removes a row of the table from its group, if it satisfies the where
+// clause. The group's aggregates are recomputed later if one of them cannot
+// remove the row.
+func (iv *incrementalView) remove(env *Environment, row Row) {
+	ns := iv.namespace(env, row)
+	if !iv.matches(ns) {
+		return
+	}
+	g := iv.index[iv.groupKey(ns)]
+	g.count--
+	g.dirty = true
+	if g.stale {
+		return
+	}
+	for _, fn := range g.rg.funcs {
+		if !fn.unstep(ns) {
+			g.stale = true
+			return
+		}
+	}
+}
+
+// Returns the rows of the view's result. For an aggregate query, first
+// recomputes the stale groups from data, the table's new rows, removes the
+// empty groups, and reevaluates the result rows of the changed groups.
+func (iv *incrementalView) result(env *Environment, data []Row) []Row {
+	var rows []Row
+	if !iv.aggregate {
+		for _, row := range iv.rows {
+			if row != nil {
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	}
+	groups := make([]*ivmGroup, 0, len(iv.groups))
+	for _, g := range iv.groups {
+		if g.stale {
+			iv.recompute(env, g, data)
+		}
+		if g.count == 0 && len(iv.stmt.GroupBy) != 0 {
+			delete(iv.index, g.key)
+			continue
+		}
+		if g.dirty {
+			g.row = nil
+			if g.rg.having == nil || isTrue(evalExpr(g.rg.ns, g.rg.having)) {
+				g.row = make(Row, len(g.rg.projection))
+				for i, expr := range g.rg.projection {
+					g.row[i] = evalExpr(g.rg.ns, expr)
+				}
+			}
+			g.dirty = false
+		}
+		groups = append(groups, g)
+		if g.row != nil {
+			rows = append(rows, g.row)
+		}
+	}
+	iv.groups = groups
+	return rows
+}
+
+// Recomputes the aggregates of a group from the rows of the table.
+func (iv *incrementalView) recompute(env *Environment, g *ivmGroup, data []Row) {
+	g.rg = newRowGroup(g.rg.ns, iv.projection, iv.stmt.Having)
+	g.count = 0
+	for _, row := range data {
+		ns := iv.namespace(env, row)
+		if !iv.matches(ns) || iv.groupKey(ns) != g.key {
+			continue
+		}
+		g.count++
+		for _, fn := range g.rg.funcs {
+			fn.step(ns)
+		}
+	}
+	g.stale = false
+	g.dirty = true
+}
@@ -1,50 +1,153 @@
 package eval
 
 import (
-	"fmt"
-
 	"github.com/dcowgill/toysqleval/ast"
 )
 
-// Namespace is a symbol table of columns.
+// Namespace is a symbol table of columns. Namespaces form a chain from the
+// innermost query outward, so that correlated subqueries may refer to columns
+// of enclosing queries; the outermost link is always an emptyNamespace.
 type namespace interface {
-	// Looks up a column value by name.
-	lookup(name string) Value
+	// Looks up the value of a column by reference: an *ast.Ident or
+	// *ast.QualifiedIdent. An unqualified name must be unambiguous.
+	lookup(ref ast.Expr) Value
+
+	// Looks up the metadata of a column by reference, for type inference.
+	// Returns nil if no such column exists.
+	column(ref ast.Expr) *Column
+
+	// Looks up the value of a window function call for the current row, by
+	// the address of its AST node.
+	windowValue(expr *ast.FunctionCall) Value
 
-	// Looks up an aggregate function expression by the address of its AST node.
-	aggFunc(expr *ast.FunctionCall) Value
+	// Looks up a table by name. Tables defined by WITH clauses shadow the
+	// tables in the environment.
+	table(name string) *Table
+
+	// Returns the environment in which expressions are evaluated.
+	environment() *Environment
 }
 
 // emptyNamespace represents an empty namespace.
-type emptyNamespace struct{}
+type emptyNamespace struct {
+	env *Environment
+}
 
 // lookup is part of the namespace interface.
-func (ns emptyNamespace) lookup(name string) Value {
-	panic(fmt.Errorf("column %q does not exist", name))
+func (ns emptyNamespace) lookup(ref ast.Expr) Value {
+	scope(nil).resolve(ref) // always panics
+	return nil
 }
 
-// aggFunc is part of the namespace interface.
-func (ns emptyNamespace) aggFunc(expr *ast.FunctionCall) Value {
-	panic(fmt.Sprintf("failed aggFunc lookup at %s", expr.Pos()))
+// column is part of the namespace interface.
+func (ns emptyNamespace) column(ref ast.Expr) *Column {
+	return nil
 }
 
-// Represents the current row being evaluated in a select or update statement.
+// windowValue is part of the namespace interface.
+func (ns emptyNamespace) windowValue(expr *ast.FunctionCall) Value {
+	panic(errorf(expr, "window functions are not allowed here"))
+}
+
+// table is part of the namespace interface.
+func (ns emptyNamespace) table(name string) *Table {
+	return ns.env.lookupTable(name)
+}
+
+// environment is part of the namespace interface.
+func (ns emptyNamespace) environment() *Environment {
+	return ns.env
+}
+
+// Represents the current row being evaluated in a select, update or delete
+// statement.
 type currentRow struct {
-	table *Table
+	scope scope
 	row   []Value
+	outer namespace // enclosing namespace
+}
+
+// lookup is part of the namespace interface. Names that do not refer to a
+// column in the current row are looked up in the enclosing namespace.
+func (ns *currentRow) lookup(ref ast.Expr) Value {
+	if i := ns.scope.find(ref); i >= 0 {
+		return ns.row[i]
+	}
+	if _, ok := ns.outer.(emptyNamespace); ok {
+		ns.scope.resolve(ref) // always panics
+	}
+	return ns.outer.lookup(ref)
+}
+
+// column is part of the namespace interface.
+func (ns *currentRow) column(ref ast.Expr) *Column {
+	if i := ns.scope.find(ref); i >= 0 {
+		return ns.scope[i].col
+	}
+	return ns.outer.column(ref)
+}
+
+// windowValue is part of the namespace interface.
+func (ns *currentRow) windowValue(expr *ast.FunctionCall) Value {
+	panic(errorf(expr, "window functions are not allowed here"))
+}
+
+// table is part of the namespace interface.
+func (ns *currentRow) table(name string) *Table {
+	return ns.outer.table(name)
+}
+
+// environment is part of the namespace interface.
+func (ns *currentRow) environment() *Environment {
+	return ns.outer.environment()
+}
+
+// Represents the tables defined by a WITH clause. Everything else is looked up
+// in the enclosing namespace.
+type withTables struct {
+	tables map[string]*Table // key is table name
+	outer  namespace         // enclosing namespace
 }
 
 // lookup is part of the namespace interface.
-func (ns *currentRow) lookup(name string) Value {
-	if ns != nil {
-		if i := ns.table.colIndex(name); i >= 0 {
-			return ns.row[i]
-		}
+func (ns *withTables) lookup(ref ast.Expr) Value {
+	return ns.outer.lookup(ref)
+}
+
+// column is part of the namespace interface.
+func (ns *withTables) column(ref ast.Expr) *Column {
+	return ns.outer.column(ref)
+}
+
+// windowValue is part of the namespace interface.
+func (ns *withTables) windowValue(expr *ast.FunctionCall) Value {
+	return ns.outer.windowValue(expr)
+}
+
+// table is part of the namespace interface.
+func (ns *withTables) table(name string) *Table {
+	if t, ok := ns.tables[name]; ok {
+		return t
 	}
-	panic(fmt.Errorf("column %q does not exist", name))
+	return ns.outer.table(name)
 }
 
-// aggFunc is part of the namespace interface.
-func (ns *currentRow) aggFunc(expr *ast.FunctionCall) Value {
-	panic(fmt.Sprintf("failed aggFunc lookup at %s", expr.Pos()))
+// environment is part of the namespace interface.
+func (ns *withTables) environment() *Environment {
+	return ns.outer.environment()
+}
+
+// Represents the current row of a select statement that has window functions,
+// whose values for the row have already been computed.
+type windowRow struct {
+	namespace
+	values map[*ast.FunctionCall]Value
+}
+
+// windowValue is part of the namespace interface.
+func (ns *windowRow) windowValue(expr *ast.FunctionCall) Value {
+	if v, ok := ns.values[expr]; ok {
+		return v
+	}
+	return ns.namespace.windowValue(expr)
 }
@@ -0,0 +1,142 @@
+package eval
+
+import (
+	"sort"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Resolves the expressions in an ORDER BY clause; see resolveOutputRefs.
+func resolveOrderBy(terms []*ast.OrderingTerm, projection []ast.Expr, names []string) []ast.Expr {
+	exprs := make([]ast.Expr, len(terms))
+	for i, term := range terms {
+		exprs[i] = term.Expr
+	}
+	return resolveOutputRefs("ORDER BY", exprs, projection, names)
+}
+
+// Resolves expressions that may refer to output columns, as in the ORDER BY
+// and DISTINCT ON clauses. An integer literal refers to an output column by
+// its one-based position, and an identifier that names an output column refers
+// to that column; in both cases, the key is the projected expression itself.
+// Any other expression is evaluated against the input row. The names of the
+// output columns are given in names, which parallels projection.
+func resolveOutputRefs(clause string, exprs []ast.Expr, projection []ast.Expr, names []string) []ast.Expr {
+	keys := make([]ast.Expr, len(exprs))
+	for i, expr := range exprs {
+		keys[i] = expr
+		switch expr := expr.(type) {
+		case *ast.IntegerLiteral:
+			if expr.Value < 1 || expr.Value > int64(len(projection)) {
+				panic(errorf(expr, "%s position %d is not in select list", clause, expr.Value))
+			}
+			keys[i] = projection[expr.Value-1]
+		case *ast.Ident:
+			for j, name := range names {
+				if name == expr.Name {
+					keys[i] = projection[j]
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// Panics unless every ORDER BY key of a SELECT DISTINCT appears in the select
+// list; otherwise, the order of the distinct rows would be ill-defined.
+func validateDistinctOrderBy(keys []ast.Expr, projection []ast.Expr) {
+	for _, key := range keys {
+		found := false
+		for _, projected := range projection {
+			if sameExpr(key, projected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic(errorf(key, "for SELECT DISTINCT, ORDER BY expressions must appear in select list"))
+		}
+	}
+}
+
+// Removes duplicate rows, keeping the first row of each set of duplicates.
+// Two rows are duplicates if the values in row[keyStart:keyEnd] are equal;
+// nulls are considered equal to each other.
+func distinctRows(rows []Row, keyStart, keyEnd int) []Row {
+	seen := make(map[string]bool)
+	var result []Row
+	for _, row := range rows {
+		if k := rowKey(row[keyStart:keyEnd]); !seen[k] {
+			seen[k] = true
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// Sorts rows in place according to an ORDER BY clause. The sort keys must be
+// stored in the rows in the same order as the terms, starting at index
+// keyStart. Rows with equal keys retain their relative order.
+func sortRows(terms []*ast.OrderingTerm, rows []Row, keyStart int) {
+	if len(terms) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, term := range terms {
+			a, b := rows[i][keyStart+k], rows[j][keyStart+k]
+			switch {
+			case a == nil && b == nil:
+				continue
+			case a == nil:
+				return term.NullsFirst
+			case b == nil:
+				return !term.NullsFirst
+			}
+			c := compareValues(term, a, b)
+			if term.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// Applies the OFFSET and LIMIT clauses of a query to its rows. Either clause
+// may be nil.
+func limitRows(ns namespace, limit, offset ast.Expr, rows []Row) []Row {
+	if n, ok := evalRowCount(ns, offset, "OFFSET"); ok {
+		if n < len(rows) {
+			rows = rows[n:]
+		} else {
+			rows = nil
+		}
+	}
+	if n, ok := evalRowCount(ns, limit, "LIMIT"); ok && n < len(rows) {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+// Evaluates the argument of a LIMIT or OFFSET clause. Returns false if the
+// clause is absent or its argument is null, both of which mean "no limit".
+func evalRowCount(ns namespace, expr ast.Expr, clause string) (int, bool) {
+	if expr == nil {
+		return 0, false
+	}
+	value := evalExpr(ns, expr)
+	if value == nil {
+		return 0, false
+	}
+	n, ok := value.(IntegerValue)
+	if !ok {
+		panic(errorf(expr, "argument of %s must be an integer, not %s", clause, value))
+	}
+	if n < 0 {
+		panic(errorf(expr, "%s must not be negative", clause))
+	}
+	return int(n), true
+}
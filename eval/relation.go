@@ -0,0 +1,187 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+	"github.com/dcowgill/toysqleval/token"
+)
+
+// Describes the columns visible to an expression that is evaluated against a
+// row, in row order. Each column is qualified by the name or alias of the
+// table it belongs to.
+type scope []scopeColumn
+
+// A column in a scope.
+type scopeColumn struct {
+	table string // table name or alias
+	col   *Column
+}
+
+// Creates a scope for the columns of a table, qualified by the given name.
+func tableScope(table *Table, name string) scope {
+	sc := make(scope, len(table.Columns))
+	for i, col := range table.Columns {
+		sc[i] = scopeColumn{table: name, col: col}
+	}
+	return sc
+}
+
+// Returns the table name, which is empty if the reference is unqualified, and
+// the column name of a column reference: an *ast.Ident or *ast.QualifiedIdent.
+func columnRef(ref ast.Expr) (table, name string) {
+	if q, ok := ref.(*ast.QualifiedIdent); ok {
+		return q.Table.Name, q.Name.Name
+	}
+	return "", ref.(*ast.Ident).Name
+}
+
+// Returns the index of the column referenced by an optionally qualified name,
+// or -1 if no such column exists. Panics if an unqualified name refers to
+// more than one column.
+func (sc scope) find(ref ast.Expr) int {
+	table, name := columnRef(ref)
+	found := -1
+	for i, c := range sc {
+		if c.col.Name != name || (table != "" && c.table != table) {
+			continue
+		}
+		if found >= 0 {
+			panic(errorf(ref, "column reference %q is ambiguous", name))
+		}
+		found = i
+	}
+	return found
+}
+
+// Like find, but panics if the column does not exist.
+func (sc scope) resolve(ref ast.Expr) int {
+	if i := sc.find(ref); i >= 0 {
+		return i
+	}
+	table, name := columnRef(ref)
+	if table == "" {
+		panic(errorf(ref, "column %q does not exist", name))
+	}
+	if !sc.hasTable(table) {
+		panic(errorf(ref, "missing FROM-clause entry for table %q", table))
+	}
+	panic(errorf(ref, "column %s.%s does not exist", table, name))
+}
+
+// Reports whether any column in the scope belongs to the named table.
+func (sc scope) hasTable(table string) bool {
+	for _, c := range sc {
+		if c.table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the scope in which every column is nullable.
+func (sc scope) nullable() scope {
+	result := make(scope, len(sc))
+	for i, c := range sc {
+		col := *c.col
+		col.Nullable = true
+		result[i] = scopeColumn{table: c.table, col: &col}
+	}
+	return result
+}
+
+// A relation is the result of evaluating the FROM clause of a select
+// statement: a set of rows and the scope that describes their columns.
+type relation struct {
+	scope scope
+	rows  []Row
+}
+
+// Evaluates a table expression in a FROM clause. Subqueries in the expression
+// may refer to columns in the outer namespace.
+func evalTableExpr(outer namespace, expr ast.Expr) *relation {
+	switch expr := expr.(type) {
+	case nil:
+		// A select without a FROM clause produces a single empty row.
+		return &relation{rows: []Row{{}}}
+	case *ast.Ident:
+		table := outer.table(expr.Name)
+		// The table may append rows in place; see tableChange.computeData.
+		rows := table.Data[:len(table.Data):len(table.Data)]
+		return &relation{scope: tableScope(table, expr.Name), rows: rows}
+	case *ast.SubqueryExpr:
+		panic(errorf(expr, "subquery in FROM must have an alias"))
+	case *ast.AliasedTableExpr:
+		var rel *relation
+		if sub, ok := expr.Expr.(*ast.SubqueryExpr); ok {
+			result := evalQueryStmt(outer, sub.Select)
+			rel = &relation{scope: tableScope(result, ""), rows: result.Data}
+		} else {
+			rel = evalTableExpr(outer, expr.Expr)
+		}
+		sc := make(scope, len(rel.scope))
+		for i, c := range rel.scope {
+			sc[i] = scopeColumn{table: expr.Alias.Name, col: c.col}
+		}
+		return &relation{scope: sc, rows: rel.rows}
+	case *ast.JoinExpr:
+		return evalJoinExpr(outer, expr)
+	}
+	panic(errorf(expr, "invalid table expression: %T", expr))
+}
+
+// Evaluates a join using the nested loop algorithm.
+func evalJoinExpr(outer namespace, expr *ast.JoinExpr) *relation {
+	left := evalTableExpr(outer, expr.Left)
+	right := evalTableExpr(outer, expr.Right)
+	for _, c := range right.scope {
+		if left.scope.hasTable(c.table) {
+			panic(errorf(expr.Right, "table name %q specified more than once", c.table))
+		}
+	}
+	// The columns on the inner side of an outer join may be null.
+	leftScope, rightScope := left.scope, right.scope
+	if expr.Kind == token.Right || expr.Kind == token.Full {
+		leftScope = leftScope.nullable()
+	}
+	if expr.Kind == token.Left || expr.Kind == token.Full {
+		rightScope = rightScope.nullable()
+	}
+	result := &relation{scope: append(append(scope{}, leftScope...), rightScope...)}
+	concat := func(l, r Row) Row {
+		row := make(Row, 0, len(result.scope))
+		if l == nil {
+			l = make(Row, len(left.scope))
+		}
+		if r == nil {
+			r = make(Row, len(right.scope))
+		}
+		return append(append(row, l...), r...)
+	}
+	rightMatched := make([]bool, len(right.rows))
+	for _, l := range left.rows {
+		leftMatched := false
+		for j, r := range right.rows {
+			row := concat(l, r)
+			if expr.On != nil {
+				if !isTrue(evalExpr(&currentRow{result.scope, row, outer}, expr.On)) {
+					continue
+				}
+			}
+			result.rows = append(result.rows, row)
+			leftMatched = true
+			rightMatched[j] = true
+		}
+		// In a left or full join, unmatched left rows are padded with nulls.
+		if !leftMatched && (expr.Kind == token.Left || expr.Kind == token.Full) {
+			result.rows = append(result.rows, concat(l, nil))
+		}
+	}
+	// In a right or full join, unmatched right rows are padded with nulls.
+	if expr.Kind == token.Right || expr.Kind == token.Full {
+		for j, r := range right.rows {
+			if !rightMatched[j] {
+				result.rows = append(result.rows, concat(nil, r))
+			}
+		}
+	}
+	return result
+}
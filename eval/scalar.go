@@ -0,0 +1,136 @@
+package eval
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Func is the implementation of a scalar SQL function. Its arguments have been
+// checked against, and coerced to, the types in the function's signature.
+type Func func(args []Value) (Value, error)
+
+// Signature describes the parameters and result of a scalar function. The data
+// type InvalidDataType stands for "any type": an argument of that type is not
+// coerced, and a result of that type depends on the arguments.
+type Signature struct {
+	Args     []DataType // parameter types
+	Variadic bool       // if true, the last parameter is optional and may repeat
+	Result   DataType   // type of the result
+	Strict   bool       // if true, any null argument produces a null result
+}
+
+// Describes a scalar SQL function.
+type scalarFunc struct {
+	name string
+	sig  Signature
+	impl Func
+}
+
+// RegisterFunc adds a scalar function to the environment, so that statements
+// evaluated in the environment may call it. Function names are
+// case-insensitive, and must not conflict with any existing function.
+func (env *Environment) RegisterFunc(name string, sig Signature, impl Func) error {
+	name = strings.ToLower(name)
+	if isAggFunc(name) || builtinFuncs[name] != nil || env.funcs[name] != nil {
+		return fmt.Errorf("function %q already exists", name)
+	}
+	if impl == nil {
+		return fmt.Errorf("function %q has no implementation", name)
+	}
+	if sig.Variadic && len(sig.Args) == 0 {
+		return fmt.Errorf("variadic function %q must have at least one parameter", name)
+	}
+	if env.funcs == nil {
+		env.funcs = make(map[string]*scalarFunc)
+	}
+	env.funcs[name] = &scalarFunc{name: name, sig: sig, impl: impl}
+	return nil
+}
+
+// Retrieves a scalar function by name. Returns nil if none exists.
+func (env *Environment) lookupFunc(name string) *scalarFunc {
+	if fn, ok := env.funcs[name]; ok {
+		return fn
+	}
+	return builtinFuncs[name]
+}
+
+// Evaluates a call to a scalar function.
+func evalFunctionCall(ns namespace, expr *ast.FunctionCall) Value {
+	name := expr.Name.Name
+	fn := ns.environment().lookupFunc(name)
+	if fn == nil {
+		if isAggFunc(name) {
+			panic(errorf(expr, "aggregate function %s is not allowed here", strings.ToUpper(name)))
+		}
+		panic(errorf(expr, "function %s does not exist", name))
+	}
+	if expr.Distinct {
+		panic(errorf(expr, "DISTINCT specified, but %s is not an aggregate function", name))
+	}
+	if expr.Filter != nil {
+		panic(errorf(expr, "FILTER specified, but %s is not an aggregate function", name))
+	}
+	sig := fn.sig
+	if n := len(expr.Args); n != len(sig.Args) && !(sig.Variadic && n >= len(sig.Args)-1) {
+		want := fmt.Sprint(len(sig.Args))
+		if sig.Variadic {
+			want = fmt.Sprintf("at least %d", len(sig.Args)-1)
+		}
+		panic(errorf(expr, "wrong number of arguments to %s: got %d, want %s",
+			strings.ToUpper(name), n, want))
+	}
+	args := make([]Value, len(expr.Args))
+	for i, arg := range expr.Args {
+		value := evalExpr(ns, arg)
+		if value == nil {
+			if sig.Strict {
+				return nil
+			}
+			continue
+		}
+		t := sig.Args[len(sig.Args)-1]
+		if i < len(sig.Args) {
+			t = sig.Args[i]
+		}
+		if t != InvalidDataType {
+			value = coerceAt(arg, value, t)
+		}
+		args[i] = value
+	}
+	return callFunc(expr, fn, args)
+}
+
+// Calls the implementation of a scalar function. Errors, including any panics
+// other than evaluation errors, are reported at the position of the call.
+func callFunc(expr *ast.FunctionCall, fn *scalarFunc, args []Value) Value {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Error); ok {
+				panic(r)
+			}
+			panic(errorf(expr, "%s: %s", fn.name, r))
+		}
+	}()
+	result, err := fn.impl(args)
+	if err != nil {
+		panic(errorf(expr, "%s: %s", fn.name, err))
+	}
+	return result
+}
+
+// Coerces a value to a data type, like coerce, but on failure panics with an
+// error at the position of node.
+func coerceAt(node ast.Node, v Value, t DataType) Value {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Error); ok {
+				panic(r)
+			}
+			panic(errorf(node, "%s", r))
+		}
+	}()
+	return coerce(v, t)
+}
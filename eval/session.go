@@ -0,0 +1,639 @@
+package eval
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Database is a set of tables and views that may be shared by concurrent
+// sessions, each used by its own goroutine. The zero value is an empty
+// database that lives only in memory; Open opens one that is stored on disk.
+//
+// Each transaction sees a snapshot of the database as of its first
+// statement, along with its own changes, so readers never wait for writers
+// or vice versa. Committed states of the database are never modified;
+// instead, a commit replaces the current state with a new one, which shares
+// the rows that did not change. A transaction fails with a
+// SerializationError if it updates or deletes a row that a concurrent
+// transaction updated or deleted and committed first, if it refers to a
+// table or view whose definition a concurrent transaction changed, or if it
+// changes the schema and a concurrent transaction changed a table or view
+// to which it refers.
+type Database struct {
+	// RecursionLimit is the RecursionLimit of the environments in which the
+	// sessions evaluate statements.
+	RecursionLimit int
+
+	mu             sync.Mutex
+	current        *Environment   // the committed state; never modified
+	version        int            // number of commits
+	schemaVersions map[string]int // by name, the version of the last commit that changed a relation's definition
+	storage        *storage       // nil unless the database is durable; see Open
+}
+
+// Session is a connection to a database. A session may not be used by more
+// than one goroutine at a time.
+type Session struct {
+	db      *Database
+	env     *Environment    // the transaction's copy of the database; nil if none
+	base    *Environment    // the state of the database from which env was copied
+	version int             // the version of base
+	refs    map[string]bool // names to which the transaction's statements refer
+	ddl     map[string]bool // names of the relations whose definitions it changed; nil if none
+
+	// The session's temporary tables, and the views that depend on them,
+	// which other sessions do not see; nil if there are none. They are never
+	// part of the committed state of the database.
+	temp   *Environment
+	hidden map[string]bool // names of the relations of base that temporary relations hide
+}
+
+// NewSession returns a new session of the database.
+func (db *Database) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// RegisterFunc adds a scalar function to the database, as with
+// Environment.RegisterFunc. Transactions that are in progress do not see it.
+func (db *Database) RegisterFunc(name string, sig Signature, impl Func) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	env := *db.state()
+	env.funcs = make(map[string]*scalarFunc)
+	for name, fn := range db.current.funcs {
+		env.funcs[name] = fn
+	}
+	if err := env.RegisterFunc(name, sig, impl); err != nil {
+		return err
+	}
+	db.current = &env
+	return nil
+}
+
+// Returns the committed state of the database. The caller must hold db.mu.
+func (db *Database) state() *Environment {
+	if db.current == nil {
+		db.current = &Environment{}
+	}
+	return db.current
+}
+
+// Exec evaluates a statement in the session. Outside a transaction, a
+// statement that changes the database is committed as soon as it succeeds.
+func (s *Session) Exec(stmt ast.Node) (*Table, error) {
+	switch stmt := stmt.(type) {
+	case *ast.BeginStmt:
+		if s.env != nil {
+			return nil, errorf(stmt, "there is already a transaction in progress")
+		}
+		s.begin()
+		return EvalStmt(s.env, stmt)
+	case *ast.CommitStmt:
+		if s.env == nil {
+			return nil, errorf(stmt, "there is no transaction in progress")
+		}
+		return nil, s.commit()
+	case *ast.RollbackStmt:
+		if stmt.Savepoint == nil {
+			if s.env == nil {
+				return nil, errorf(stmt, "there is no transaction in progress")
+			}
+			s.end()
+			return nil, nil
+		}
+	}
+	if s.env != nil {
+		return s.eval(stmt)
+	}
+	// The statement is a transaction of its own.
+	s.begin()
+	defer s.end()
+	table, err := s.eval(stmt)
+	if err == nil && mayChange(stmt) {
+		err = s.commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Starts a transaction with a copy of the current state of the database and
+// of the session's temporary relations, which hide any others of the same
+// names.
+func (s *Session) begin() {
+	s.db.mu.Lock()
+	s.base, s.version = s.db.state(), s.db.version
+	s.db.mu.Unlock()
+	s.env = s.base.checkout()
+	s.env.RecursionLimit = s.db.RecursionLimit
+	s.env.logRows = s.db.storage != nil
+	s.hidden = make(map[string]bool)
+	if s.temp != nil {
+		temp := s.temp.checkout()
+		for name, table := range temp.tables {
+			s.hide(name)
+			s.env.tables[name] = table
+		}
+		for name, v := range temp.views {
+			s.hide(name)
+			s.env.views[name] = v
+		}
+	}
+	s.refs, s.ddl = make(map[string]bool), nil
+}
+
+// Removes the named relation of base, if any, from the transaction's copy of
+// the database, to make way for a temporary relation.
+func (s *Session) hide(name string) {
+	if s.base.tables[name] != nil || s.base.views[name] != nil {
+		s.hidden[name] = true
+		delete(s.env.tables, name)
+		delete(s.env.views, name)
+	}
+}
+
+// Restores the relations of base that temporary relations no longer hide,
+// such as those whose temporary relations have been dropped.
+func (s *Session) unhide() {
+	for name := range s.hidden {
+		if s.env.tables[name] != nil || s.env.views[name] != nil {
+			continue
+		}
+		if table, ok := s.base.tables[name]; ok {
+			s.env.tables[name] = table.copyShared()
+		}
+		if v, ok := s.base.views[name]; ok {
+			s.env.views[name] = v.copyShared()
+		}
+		delete(s.hidden, name)
+	}
+}
+
+// Evaluates a statement in the transaction, and records the names to which
+// it refers and, if it changes the schema, the relations that it defines,
+// except for temporary relations, which no other session can see.
+func (s *Session) eval(stmt ast.Node) (*Table, error) {
+	temps := s.env.temporaryRelations()
+	table, err := EvalStmt(s.env, stmt)
+	s.unhide()
+	for name := range s.env.temporaryRelations() {
+		temps[name] = true
+	}
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		if id, ok := node.(*ast.Ident); ok && !temps[id.Name] {
+			s.refs[id.Name] = true
+		}
+		return walk
+	}
+	ast.Walk(stmt, walk)
+	if err != nil || !changesSchema(stmt) {
+		return table, err
+	}
+	for _, id := range definedRelations(stmt) {
+		if temps[id.Name] {
+			continue
+		}
+		if s.ddl == nil {
+			s.ddl = make(map[string]bool)
+		}
+		s.ddl[id.Name] = true
+	}
+	return table, nil
+}
+
+// Returns the names of the relations whose definitions a statement that
+// changes the schema creates, drops or changes. Views dropped by CASCADE are
+// not among them; see Database.commit.
+func definedRelations(stmt ast.Node) []*ast.Ident {
+	switch stmt := stmt.(type) {
+	case *ast.CreateTableStmt:
+		return []*ast.Ident{stmt.Table}
+	case *ast.CreateViewStmt:
+		return []*ast.Ident{stmt.Name}
+	case *ast.DropTableStmt:
+		return stmt.Tables
+	case *ast.DropViewStmt:
+		return stmt.Views
+	case *ast.TruncateStmt:
+		return stmt.Tables
+	case *ast.RefreshStmt:
+		return []*ast.Ident{stmt.View}
+	case *ast.AlterTableStmt:
+		names := []*ast.Ident{stmt.Table}
+		for _, cmd := range stmt.Cmds {
+			if cmd.Kind == ast.RenameTable {
+				names = append(names, cmd.NewName)
+			}
+		}
+		return names
+	case *ast.SelectStmt:
+		return []*ast.Ident{stmt.Into}
+	}
+	return nil
+}
+
+// Returns the set of names of the environment's temporary tables and of the
+// views that depend on them.
+func (env *Environment) temporaryRelations() map[string]bool {
+	names := make(map[string]bool)
+	for name := range env.tables {
+		if env.isTemporary(name) {
+			names[name] = true
+		}
+	}
+	for name := range env.views {
+		if env.isTemporary(name) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Commits the transaction, and ends it even if that fails. The session keeps
+// the transaction's temporary relations, which are not committed to the
+// database.
+func (s *Session) commit() error {
+	defer s.end()
+	temp := s.env.removeTemporary(s.base, s.hidden)
+	if err := s.db.commit(s.env, s.base, s.version, s.refs, s.ddl); err != nil {
+		return err
+	}
+	temp.shareSequences()
+	s.temp = temp
+	if len(temp.tables) == 0 {
+		s.temp = nil
+	}
+	return nil
+}
+
+// Removes the temporary relations from a transaction's copy of the database,
+// restoring the named relations of base, which they hid, and returns them in
+// an environment of their own.
+func (env *Environment) removeTemporary(base *Environment, hidden map[string]bool) *Environment {
+	temp := &Environment{tables: make(map[string]*Table), views: make(map[string]*view)}
+	for name := range env.temporaryRelations() {
+		if table, ok := env.tables[name]; ok {
+			temp.tables[name] = table
+		} else {
+			temp.views[name] = env.views[name]
+		}
+		delete(env.tables, name)
+		delete(env.views, name)
+	}
+	for name := range hidden {
+		if table, ok := base.tables[name]; ok {
+			env.tables[name] = table.copyShared()
+		}
+		if v, ok := base.views[name]; ok {
+			env.views[name] = v.copyShared()
+		}
+	}
+	return temp
+}
+
+// Ends the transaction, discarding its copy of the database.
+func (s *Session) end() {
+	s.env, s.base, s.refs, s.ddl, s.hidden = nil, nil, nil, nil, nil
+}
+
+// Reports whether a statement that may change the environment changes more
+// than the rows of its tables.
+func changesSchema(stmt ast.Node) bool {
+	switch stmt.(type) {
+	case *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt:
+		return false
+	}
+	return mayChange(stmt)
+}
+
+// Makes env, the copy of the database of a transaction that started at the
+// given version, the current state of the database. refs holds the names to
+// which the transaction's statements refer, and ddl the names of the
+// relations whose definitions it changed, or is nil if it did not change the
+// schema. If other transactions have committed since, the transaction's
+// changes are merged with theirs, if they do not conflict, in a copy of the
+// current state. A transaction that changed nothing has no effect.
+func (db *Database) commit(env, base *Environment, version int, refs, ddl map[string]bool) error {
+	if ddl == nil && sameTables(env, base) {
+		return nil
+	}
+	checkpoint, err := db.install(env, base, version, refs, ddl)
+	if checkpoint {
+		// The commit is durable even if the checkpoint fails, in which case
+		// a later commit tries again. Other commits proceed while the
+		// snapshot is written.
+		db.checkpoint(false)
+	}
+	return err
+}
+
+// Does the work of commit while holding the database's lock, and reports
+// whether the database's log has grown enough to be checkpointed.
+func (db *Database) install(env, base *Environment, version int, refs, ddl map[string]bool) (checkpoint bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if ddl != nil {
+		for name := range redefined(base, env) {
+			ddl[name] = true
+		}
+	}
+	if db.version != version {
+		touched := make(map[string]bool)
+		for _, names := range []map[string]bool{refs, ddl, changedTables(env, base)} {
+			for name := range names {
+				touched[name] = true
+			}
+		}
+		addRelated(touched, ddl != nil, base, env, db.current)
+		for name := range touched {
+			if db.schemaVersions[name] > version {
+				return false, &SerializationError{Msg: "could not serialize access due to concurrent schema change"}
+			}
+		}
+		if ddl != nil {
+			env, err = rebase(db.current, env, base, touched)
+		} else {
+			env, err = merge(db.current, env, base)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	env.txn = nil
+	env.funcs = db.current.funcs // in case RegisterFunc was called since
+	for _, table := range env.tables {
+		table.base = nil // describes the transaction's copy of the table only
+	}
+	env.shareSequences()
+	if db.storage != nil {
+		if checkpoint, err = db.storage.append(db.current, env, ddl); err != nil {
+			return false, err
+		}
+		env.logRows, env.rowLog = false, nil // the changes are in the log
+	}
+	db.current = env
+	db.version++
+	for name := range ddl {
+		if db.schemaVersions == nil {
+			db.schemaVersions = make(map[string]int)
+		}
+		db.schemaVersions[name] = db.version
+	}
+	return checkpoint, nil
+}
+
+// Reports whether two environments have the same tables with the same rows.
+func sameTables(a, b *Environment) bool {
+	if len(a.tables) != len(b.tables) {
+		return false
+	}
+	for name, table := range a.tables {
+		if other, ok := b.tables[name]; !ok || !sameRows(table.Data, other.Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the names of the tables of env whose rows differ from those of
+// base.
+func changedTables(env, base *Environment) map[string]bool {
+	names := make(map[string]bool)
+	for name, table := range env.tables {
+		if old, ok := base.tables[name]; ok && !sameRows(table.Data, old.Data) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Returns the names of the tables and views that are in only one of two
+// environments, or that are a table in one and a view in the other, such as
+// those created, dropped or renamed.
+func redefined(a, b *Environment) map[string]bool {
+	names := make(map[string]bool)
+	kind := func(env *Environment, name string) int {
+		if _, ok := env.tables[name]; ok {
+			return 1
+		}
+		if _, ok := env.views[name]; ok {
+			return 2
+		}
+		return 0
+	}
+	for _, env := range []*Environment{a, b} {
+		for name := range env.tables {
+			if kind(a, name) != kind(b, name) {
+				names[name] = true
+			}
+		}
+		for name := range env.views {
+			if kind(a, name) != kind(b, name) {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// Adds to names the names of the relations on which the named views depend,
+// directly or indirectly, in any of the environments. If dependents is true,
+// also adds the views that depend on the named relations, and the tables that
+// refer to or are referred to by the named tables by foreign keys, so that
+// the named relations and the others have no dependencies on each other.
+func addRelated(names map[string]bool, dependents bool, envs ...*Environment) {
+	for changed := true; changed; {
+		changed = false
+		add := func(name string) {
+			if !names[name] {
+				names[name] = true
+				changed = true
+			}
+		}
+		for _, env := range envs {
+			for name, v := range env.views {
+				for _, ref := range v.refs {
+					if names[name] {
+						add(ref)
+					} else if dependents && names[ref] {
+						add(name)
+					}
+				}
+			}
+			if !dependents {
+				continue
+			}
+			for name, table := range env.tables {
+				for _, fk := range table.ForeignKeys {
+					if names[name] {
+						add(fk.RefTable)
+					} else if names[fk.RefTable] {
+						add(name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Applies the changes of a transaction that changed the schema to a copy of
+// current, and returns the copy. touched holds the names of the relations to
+// which the transaction refers, which must not depend on the others, and
+// whose definitions did not change since env was copied from base. The
+// transaction's versions of these relations replace those of current, unless
+// concurrent transactions changed their rows, in which case the changes
+// conflict.
+func rebase(current, env, base *Environment, touched map[string]bool) (*Environment, error) {
+	result := current.checkout()
+	for name := range touched {
+		old, inBase := base.tables[name]
+		table, inCurrent := current.tables[name]
+		if inBase != inCurrent || inBase && !sameRows(old.Data, table.Data) {
+			return nil, &SerializationError{Msg: "could not serialize access due to concurrent update"}
+		}
+		delete(result.tables, name)
+		delete(result.views, name)
+		if table, ok := env.tables[name]; ok {
+			result.tables[name] = table
+		}
+		if v, ok := env.views[name]; ok {
+			result.views[name] = v
+		}
+	}
+	result.rowLog = env.rowLog
+	return result, nil
+}
+
+// Applies the changes that a transaction made to the rows of its copy of the
+// database, env, since it was copied from base, to a copy of current, and
+// returns the copy. Rows are identified by address, since they are never
+// modified in place: a row of base that is not in env was updated or deleted
+// by the transaction, and must still be in current, and a row of env that is
+// not in base was inserted or updated. A table to which the transaction only
+// inserted rows is not compared with base, so that merging the insertions
+// costs in proportion to their number. The constraints of the changed tables
+// are checked again, since concurrent changes may violate them.
+func merge(current, env, base *Environment) (result *Environment, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			result, err = nil, e
+		}
+	}()
+	result = current.checkout()
+	result.logRows = env.logRows // the changes are logged relative to current
+	names := make([]string, 0, len(env.tables))
+	for name := range env.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cs := newChangeSet(result)
+	for _, name := range names {
+		table := env.tables[name]
+		rows, old := table.Data, base.tables[name].Data
+		if sameRows(rows, old) {
+			continue // the transaction did not change the table
+		}
+		if sameRows(table.base, old) {
+			// The transaction only inserted rows, which follow those of base.
+			tc := cs.change(result.tables[name])
+			for _, row := range rows[len(old):] {
+				tc.insert(row)
+			}
+			continue
+		}
+		inBase, inEnv := rowIDs(old), rowIDs(rows)
+		removed := 0
+		for id := range inBase {
+			if !inEnv[id] {
+				removed++
+			}
+		}
+		tc := cs.change(result.tables[name])
+		for i, row := range tc.table.Data {
+			if id := rowID(row); inBase[id] && !inEnv[id] {
+				tc.remove(i)
+				removed--
+			}
+		}
+		if removed != 0 {
+			return nil, &SerializationError{Msg: "could not serialize access due to concurrent update"}
+		}
+		for _, row := range rows {
+			if !inBase[rowID(row)] {
+				tc.insert(row)
+			}
+		}
+	}
+	cs.commit()
+	return result, nil
+}
+
+// Gives the auto-increment columns of the environment's tables the sequences
+// that the copies of the environment share, if they do not have them yet.
+func (env *Environment) shareSequences() {
+	for _, table := range env.tables {
+		for _, col := range table.Columns {
+			if col.AutoInc && col.seq == nil {
+				col.seq = &sequence{next: int64(col.NextVal)}
+			}
+		}
+	}
+}
+
+// Reports whether two slices of rows are the same slice, in which case the
+// table to which they belong has not changed, since its rows are never
+// modified in place.
+func sameRows(a, b []Row) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// Returns the identity of a row: the address of its first value.
+func rowID(row Row) *Value {
+	return &row[0]
+}
+
+// Returns the set of identities of rows.
+func rowIDs(rows []Row) map[*Value]bool {
+	ids := make(map[*Value]bool, len(rows))
+	for _, row := range rows {
+		ids[rowID(row)] = true
+	}
+	return ids
+}
+
+// Returns a copy of the environment that a transaction can change without
+// affecting the environment or the other transactions' copies. The tables'
+// rows and the views' results are shared, since they are never modified in
+// place.
+func (env *Environment) checkout() *Environment {
+	c := &Environment{
+		RecursionLimit: env.RecursionLimit,
+		tables:         make(map[string]*Table, len(env.tables)),
+		views:          make(map[string]*view, len(env.views)),
+		funcs:          env.funcs,
+	}
+	for name, table := range env.tables {
+		c.tables[name] = table.copyShared()
+	}
+	for name, v := range env.views {
+		c.views[name] = v.copyShared()
+	}
+	return c
+}
+
+// Returns a copy of a view that shares its query and its result.
+func (v *view) copyShared() *view {
+	cp := *v
+	if iv := v.incremental; iv != nil {
+		cp.incremental = &incrementalView{view: &cp, stmt: iv.stmt, table: iv.table, alias: iv.alias}
+	}
+	return &cp
+}
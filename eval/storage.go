@@ -0,0 +1,1012 @@
+package eval
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// SyncPolicy determines when the write-ahead log of a durable database is
+// flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log before each commit returns, so that no
+	// committed transaction is lost even if the operating system crashes.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes the log periodically, so that a crash of the
+	// operating system loses the transactions committed since the last
+	// flush. A crash of the process alone loses nothing.
+	SyncInterval
+
+	// SyncNever leaves flushing the log to the operating system.
+	SyncNever
+)
+
+// StorageOptions are the options of a durable database; see Open.
+type StorageOptions struct {
+	Sync SyncPolicy
+
+	// SyncInterval is the time between flushes of the log under the
+	// SyncInterval policy; zero means DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// CheckpointSize is the size in bytes that the log may reach before the
+	// database is checkpointed; zero means DefaultCheckpointSize, and a
+	// negative value disables automatic checkpoints.
+	CheckpointSize int64
+}
+
+// Defaults of StorageOptions.
+const (
+	DefaultSyncInterval   = time.Second
+	DefaultCheckpointSize = 4 << 20
+)
+
+// Names of the files in the directory of a durable database.
+const (
+	logFile      = "wal"
+	snapshotFile = "snapshot"
+)
+
+// The on-disk state of a durable database, which consists of a snapshot of the
+// database and a write-ahead log of the changes committed since. Each commit
+// appends a record to the log before it takes effect; a checkpoint replaces
+// the snapshot with the current state of the database and removes from the
+// log the records that the snapshot reflects.
+//
+// Both files are sequences of records, each of which is preceded by its
+// length and checksum, so that a record that was only partly written when
+// the process crashed can be recognized and discarded. Records are numbered,
+// and the snapshot has the number of the last record it reflects, so a crash
+// after a checkpoint replaces the snapshot, but before it empties the log, is
+// harmless.
+type storage struct {
+	dir   string
+	opts  StorageOptions
+	log   *os.File // nil once the database is closed
+	size  int64    // size of the log
+	lsn   uint64   // number of the last record
+	dirty bool     // whether the log was written since it was last flushed
+	err   error    // if not nil, the log is unusable, and commits fail
+	done  chan struct{}
+
+	checkpointMu sync.Mutex // held while the database is checkpointed
+}
+
+// A record of the log or snapshot. The snapshot's record has an image of the
+// whole database. A record of the log has the changes that a transaction
+// made: the names of the relations that it dropped, an image of those that it
+// created or whose definitions it changed, and the changes that its
+// statements made to the rows of the other tables, in order.
+type logRecord struct {
+	LSN     uint64
+	Image   *dbImage      `json:",omitempty"`
+	Dropped []string      `json:",omitempty"`
+	Schema  *dbImage      `json:",omitempty"`
+	Tables  []*tableDelta `json:",omitempty"`
+}
+
+// The tables and views of a database, except temporary tables and the views
+// that depend on them.
+type dbImage struct {
+	Tables []*tableImage `json:",omitempty"`
+	Views  []*viewImage  `json:",omitempty"`
+}
+
+type tableImage struct {
+	Name        string
+	Columns     []*columnImage
+	Keys        []*Key          `json:",omitempty"`
+	Checks      []*checkImage   `json:",omitempty"`
+	ForeignKeys []*ForeignKey   `json:",omitempty"`
+	Rows        [][]interface{} `json:",omitempty"`
+}
+
+type columnImage struct {
+	Name            string
+	Type            DataType
+	Default         interface{}     `json:",omitempty"`
+	DefaultExpr     json.RawMessage `json:",omitempty"`
+	Nullable        bool            `json:",omitempty"`
+	AutoInc         bool            `json:",omitempty"`
+	NextVal         int64           `json:",omitempty"`
+	GeneratedAlways bool            `json:",omitempty"`
+}
+
+type checkImage struct {
+	Name string
+	Expr json.RawMessage
+}
+
+type viewImage struct {
+	Name         string
+	Columns      []string `json:",omitempty"`
+	Query        json.RawMessage
+	Materialized bool        `json:",omitempty"`
+	Incremental  bool        `json:",omitempty"` // the result is rebuilt, not stored
+	Data         *tableImage `json:",omitempty"` // result of a materialized view
+}
+
+// The changes that a statement made to the rows of a table: the indexes of the
+// updated and deleted rows among the rows before the statement, in order, and
+// their new values, which are nil for deleted rows, and the inserted rows,
+// which follow the others. The last delta of a table in a record has the next
+// values of the table's sequences.
+type tableDelta struct {
+	Name     string
+	Changed  []int            `json:",omitempty"`
+	Rows     [][]interface{}  `json:",omitempty"`
+	Inserted [][]interface{}  `json:",omitempty"`
+	NextVals map[string]int64 `json:",omitempty"`
+}
+
+// The changes that a statement made to the rows of a table, which are logged
+// when its transaction commits; see Environment.rowLog.
+type rowChanges struct {
+	table    string
+	changes  map[int]Row // as in tableChange
+	inserted []Row
+}
+
+// Open opens the durable database stored in a directory, which is created if
+// it does not exist, and recovers the last committed state of the database
+// from it. Each commit is written to the directory before it takes effect. If
+// opts is nil, the defaults are used. The database should be closed when it
+// is no longer used.
+//
+// The database may not be opened again while it is open.
+func Open(dir string, opts *StorageOptions) (*Database, error) {
+	s := &storage{dir: dir, done: make(chan struct{})}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.SyncInterval == 0 {
+		s.opts.SyncInterval = DefaultSyncInterval
+	}
+	if s.opts.CheckpointSize == 0 {
+		s.opts.CheckpointSize = DefaultCheckpointSize
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	env, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	db := &Database{current: env, storage: s}
+	if s.opts.Sync == SyncInterval {
+		go db.flush()
+	}
+	return db, nil
+}
+
+// Flushes the log periodically, until the database is closed.
+func (db *Database) flush() {
+	ticker := time.NewTicker(db.storage.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.storage.done:
+			return
+		case <-ticker.C:
+		}
+		db.mu.Lock()
+		if s := db.storage; s.log != nil && s.dirty && s.err == nil {
+			// A failed flush may have discarded the written data, so it
+			// cannot simply be retried.
+			s.err = s.log.Sync()
+			s.dirty = false
+		}
+		db.mu.Unlock()
+	}
+}
+
+// Checkpoint writes the current state of a durable database to its snapshot
+// and empties its log, which makes the database faster to open. A database is
+// checkpointed automatically when its log exceeds StorageOptions.CheckpointSize.
+func (db *Database) Checkpoint() error {
+	if db.storage == nil {
+		return errors.New("database is not durable")
+	}
+	return db.checkpoint(true)
+}
+
+// Replaces the snapshot with the current state of the database, then removes
+// from the log the records that the snapshot reflects. Unless force is set,
+// does nothing unless the log exceeds its checkpoint size. The database is not
+// locked while the snapshot is written, so commits may append records to the
+// log meanwhile, which it keeps.
+func (db *Database) checkpoint(force bool) error {
+	s := db.storage
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+	db.mu.Lock()
+	err := db.checkOpen()
+	if err == nil {
+		err = s.err
+	}
+	due := force || s.opts.CheckpointSize > 0 && s.size > s.opts.CheckpointSize
+	env, lsn, size := db.current, s.lsn, s.size
+	db.mu.Unlock()
+	if err != nil || !due {
+		return err
+	}
+	if err := s.writeSnapshot(env, lsn); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return s.trimLog(size)
+}
+
+// Close flushes the log of a durable database and closes it. Transactions
+// cannot commit after the database is closed. Close does nothing if the
+// database is not durable.
+func (db *Database) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := db.storage
+	if s == nil || s.log == nil {
+		return nil
+	}
+	close(s.done)
+	err := s.log.Sync()
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	s.log = nil
+	return err
+}
+
+// Returns an error if the database is not durable, or is closed. The caller
+// must hold db.mu.
+func (db *Database) checkOpen() error {
+	switch s := db.storage; {
+	case s == nil:
+		return errors.New("database is not durable")
+	case s.log == nil:
+		return errors.New("database is closed")
+	}
+	return nil
+}
+
+// Reads the snapshot and the log, and returns the state of the database
+// after the last complete record. Discards the incomplete record at the end
+// of the log, if any, and opens the log for writing. Returns an error, and
+// leaves the log as it is, if a record other than the last is corrupt.
+func (s *storage) replay() (env *Environment, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			env, err = nil, fmt.Errorf("recovering %s: %v", s.dir, e)
+		}
+	}()
+	env = &Environment{tables: make(map[string]*Table), views: make(map[string]*view)}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		// The snapshot is replaced atomically, so it is never incomplete.
+		recs, n, err := readRecords(data)
+		if err != nil || len(recs) != 1 || n != len(data) {
+			return nil, fmt.Errorf("%s is corrupt", snapshotFile)
+		}
+		env = recs[0].Image.load()
+		s.lsn = recs[0].LSN
+	}
+	if s.log, err = os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.log.Close()
+		}
+	}()
+	if data, err = ioutil.ReadAll(s.log); err != nil {
+		return nil, err
+	}
+	recs, n, err := readRecords(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %v", logFile, err)
+	}
+	changed := make(map[string]bool) // tables whose incremental views are stale
+	for _, rec := range recs {
+		if rec.LSN <= s.lsn {
+			continue // already in the snapshot
+		}
+		if rec.Image != nil {
+			env = rec.Image.load()
+			changed = make(map[string]bool)
+		}
+		for _, name := range rec.Dropped {
+			delete(env.tables, name)
+			delete(env.views, name)
+		}
+		if rec.Schema != nil {
+			rec.Schema.loadInto(env)
+			for _, ti := range rec.Schema.Tables {
+				changed[ti.Name] = true
+			}
+		}
+		for _, delta := range rec.Tables {
+			delta.apply(env)
+			changed[delta.Name] = true
+		}
+		s.lsn = rec.LSN
+	}
+	for name := range changed {
+		env.refreshIncrementalViews(name)
+	}
+	if n < len(data) {
+		if err = s.log.Truncate(int64(n)); err != nil {
+			return nil, err
+		}
+		if err = s.log.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	s.size = int64(n)
+	env.shareSequences()
+	return env, nil
+}
+
+// Each record is preceded by a header: the length of its encoding, and the
+// CRC-32 checksum of its encoding, both little-endian.
+const recordHeaderSize = 8
+
+// Returns the records in data, and the number of bytes they occupy, which is
+// less than len(data) if the last record is incomplete. Returns an error if an
+// intact record follows one that is not, since only the last record can have
+// been cut short by a crash, and the records after a corrupt one must not be
+// discarded. Panics if a record that is intact cannot be decoded.
+func readRecords(data []byte) ([]*logRecord, int, error) {
+	var recs []*logRecord
+	n := 0
+	for n < len(data) {
+		payload, ok := recordAt(data, n)
+		if !ok {
+			for i := n + 1; i < len(data); i++ {
+				if _, ok := recordAt(data, i); ok {
+					return nil, 0, fmt.Errorf("record at offset %d is corrupt", n)
+				}
+			}
+			break
+		}
+		rec := new(logRecord)
+		if err := json.Unmarshal(payload, rec); err != nil {
+			panic(err)
+		}
+		recs = append(recs, rec)
+		n += recordHeaderSize + len(payload)
+	}
+	return recs, n, nil
+}
+
+// Returns the encoding of the record at offset n of data, or false if there is
+// no intact record there. No record is empty, so a run of zeros, which a crash
+// may leave at the end of a file, is not mistaken for one.
+func recordAt(data []byte, n int) ([]byte, bool) {
+	if len(data)-n < recordHeaderSize {
+		return nil, false
+	}
+	size := binary.LittleEndian.Uint32(data[n:])
+	sum := binary.LittleEndian.Uint32(data[n+4:])
+	if size == 0 || uint64(len(data)-n-recordHeaderSize) < uint64(size) {
+		return nil, false
+	}
+	payload := data[n+recordHeaderSize : n+recordHeaderSize+int(size)]
+	return payload, crc32.ChecksumIEEE(payload) == sum
+}
+
+// Returns the encoding of a record, preceded by its header.
+func encodeRecord(rec *logRecord) []byte {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		panic(err)
+	}
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// Appends to the log a record of the changes from prev, the current state of
+// the database, to next, the state that a transaction is about to commit, and
+// reports whether the log has grown enough to be checkpointed. ddl holds the
+// names of the relations whose definitions the transaction changed, or is nil
+// if it did not change the schema. The caller must hold the database's lock.
+func (s *storage) append(prev, next *Environment, ddl map[string]bool) (checkpoint bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	switch {
+	case s.log == nil:
+		return false, errors.New("database is closed")
+	case s.err != nil:
+		return false, s.err
+	}
+	rec := &logRecord{LSN: s.lsn + 1}
+	defined := make(map[string]bool)
+	if ddl != nil {
+		rec.Dropped, rec.Schema = schemaChanges(prev, next, ddl, defined)
+	}
+	rec.Tables = rowDeltas(next, defined)
+	if len(rec.Dropped) == 0 && rec.Schema == nil && len(rec.Tables) == 0 {
+		return false, nil
+	}
+	buf := encodeRecord(rec)
+	if _, err := s.log.Write(buf); err != nil {
+		// Remove the part of the record that was written, if any, so that
+		// later records are not lost behind it.
+		if terr := s.log.Truncate(s.size); terr != nil {
+			s.err = terr
+		}
+		return false, err
+	}
+	s.size += int64(len(buf))
+	s.lsn++
+	s.dirty = true
+	if s.opts.Sync == SyncAlways {
+		if s.err = s.log.Sync(); s.err != nil {
+			return false, s.err
+		}
+		s.dirty = false
+	}
+	return s.full(), nil
+}
+
+// Reports whether the log exceeds its checkpoint size.
+func (s *storage) full() bool {
+	return s.opts.CheckpointSize > 0 && s.size > s.opts.CheckpointSize
+}
+
+// Replaces the snapshot with the state of the database after the record
+// numbered lsn.
+func (s *storage) writeSnapshot(env *Environment, lsn uint64) error {
+	name := filepath.Join(s.dir, snapshotFile)
+	if err := writeFile(name+".tmp", encodeRecord(&logRecord{LSN: lsn, Image: newImage(env)})); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Removes from the log the records in its first size bytes, which the
+// snapshot reflects. The records appended since are copied to a new log,
+// which replaces the old one atomically. The caller must hold the database's
+// lock.
+func (s *storage) trimLog(size int64) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.size == size {
+		if err := s.log.Truncate(0); err != nil {
+			s.err = err
+			return err
+		}
+		s.size = 0
+		s.err = s.log.Sync()
+		s.dirty = false
+		return s.err
+	}
+	tail := make([]byte, s.size-size)
+	if _, err := s.log.ReadAt(tail, size); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, logFile)
+	if err := writeFile(name+".tmp", tail); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	// Later records must be appended to the new log, and are lost if it
+	// does not survive a crash.
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0666)
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		s.err = err
+		return err
+	}
+	s.log.Close()
+	s.log, s.size, s.dirty = f, int64(len(tail)), false
+	return nil
+}
+
+// Writes data to a new file and flushes it. The file is removed if that fails.
+func writeFile(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// Flushes a directory, so that the files renamed into it survive a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Returns the names of the relations that a transaction that changed the
+// schema dropped, and an image of those that it created or whose definitions
+// it changed, with their rows, or nil if there are none, and adds the names
+// of both to defined. Besides the relations in ddl, a statement may change
+// the definitions of the views that depend on them and of the tables related
+// to them by foreign keys, such as by renaming the table to which a foreign
+// key refers.
+func schemaChanges(prev, next *Environment, ddl, defined map[string]bool) ([]string, *dbImage) {
+	related := make(map[string]bool)
+	for name := range ddl {
+		related[name] = true
+	}
+	addRelated(related, true, prev, next)
+	names := make([]string, 0, len(related))
+	for name := range related {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var dropped []string
+	img := new(dbImage)
+	for _, name := range names {
+		table, isTable := next.tables[name]
+		v, isView := next.views[name]
+		switch {
+		case !isTable && !isView:
+			if prev.tables[name] == nil && prev.views[name] == nil {
+				continue
+			}
+			dropped = append(dropped, name)
+		case !ddl[name] && sameDefinition(prev, next, name):
+			continue
+		case isTable:
+			img.Tables = append(img.Tables, newTableImage(table))
+		default:
+			img.Views = append(img.Views, newViewImage(v))
+		}
+		defined[name] = true
+	}
+	if len(img.Tables) == 0 && len(img.Views) == 0 {
+		img = nil
+	}
+	return dropped, img
+}
+
+// Reports whether a relation has the same definition in two environments,
+// regardless of the rows of its tables.
+func sameDefinition(a, b *Environment, name string) bool {
+	if t, ok := a.tables[name]; ok {
+		u, ok := b.tables[name]
+		if !ok {
+			return false
+		}
+		ti, ui := newSchemaImage(t), newSchemaImage(u)
+		// The sequences of auto-increment columns advance as rows are
+		// inserted.
+		for _, ci := range ti.Columns {
+			ci.NextVal = 0
+		}
+		for _, ci := range ui.Columns {
+			ci.NextVal = 0
+		}
+		tdata, err := json.Marshal(ti)
+		if err != nil {
+			panic(err)
+		}
+		udata, err := json.Marshal(ui)
+		if err != nil {
+			panic(err)
+		}
+		return bytes.Equal(tdata, udata)
+	}
+	v, w := a.views[name], b.views[name]
+	if v == nil || w == nil || v.query != w.query || v.materialized != w.materialized ||
+		(v.incremental == nil) != (w.incremental == nil) || len(v.columns) != len(w.columns) {
+		return false
+	}
+	// The result of an incremental view is rebuilt from its table.
+	if v.incremental == nil && v.data != w.data {
+		return false
+	}
+	for i := range v.columns {
+		if v.columns[i] != w.columns[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the changes that the statements of a transaction made to the rows
+// of the tables of next, the state that it is about to commit, except for the
+// tables in exclude.
+func rowDeltas(next *Environment, exclude map[string]bool) []*tableDelta {
+	var deltas []*tableDelta
+	last := make(map[string]*tableDelta)
+	for _, rc := range next.rowLog {
+		if exclude[rc.table] {
+			continue
+		}
+		d := &tableDelta{Name: rc.table}
+		for i := range rc.changes {
+			d.Changed = append(d.Changed, i)
+		}
+		sort.Ints(d.Changed)
+		for _, i := range d.Changed {
+			var row []interface{}
+			if rc.changes[i] != nil {
+				row = encodeRow(rc.changes[i])
+			}
+			d.Rows = append(d.Rows, row)
+		}
+		for _, row := range rc.inserted {
+			d.Inserted = append(d.Inserted, encodeRow(row))
+		}
+		deltas = append(deltas, d)
+		last[rc.table] = d
+	}
+	for name, d := range last {
+		d.NextVals = nextVals(next.tables[name])
+	}
+	return deltas
+}
+
+// Changes the rows of a table as the delta specifies.
+func (d *tableDelta) apply(env *Environment) {
+	table, ok := env.tables[d.Name]
+	if !ok {
+		panic(fmt.Errorf("table %q does not exist", d.Name))
+	}
+	if len(d.Rows) != len(d.Changed) {
+		panic(fmt.Errorf("invalid rows of table %q", d.Name))
+	}
+	rows := table.Data
+	if len(d.Changed) != 0 {
+		rows = make([]Row, 0, len(table.Data)+len(d.Inserted))
+		from := 0
+		for k, i := range d.Changed {
+			if i < from || i >= len(table.Data) {
+				panic(fmt.Errorf("invalid rows of table %q", d.Name))
+			}
+			rows = append(rows, table.Data[from:i]...)
+			if d.Rows[k] != nil {
+				rows = append(rows, decodeRow(d.Rows[k]))
+			}
+			from = i + 1
+		}
+		rows = append(rows, table.Data[from:]...)
+	}
+	for _, row := range d.Inserted {
+		rows = append(rows, decodeRow(row))
+	}
+	table.Data = rows
+	for _, col := range table.Columns {
+		if next, ok := d.NextVals[col.Name]; ok {
+			col.NextVal = int(next)
+		}
+	}
+}
+
+// Returns the next values of the sequences of a table's auto-increment
+// columns, by column name, or nil if it has none.
+func nextVals(table *Table) map[string]int64 {
+	var vals map[string]int64
+	for _, col := range table.Columns {
+		if col.AutoInc {
+			if vals == nil {
+				vals = make(map[string]int64)
+			}
+			vals[col.Name] = col.nextVal()
+		}
+	}
+	return vals
+}
+
+// Returns the next value of an auto-increment column's sequence.
+func (col *Column) nextVal() int64 {
+	if col.seq != nil {
+		return atomic.LoadInt64(&col.seq.next)
+	}
+	return int64(col.NextVal)
+}
+
+// Returns the names of the tables of an environment, in order.
+func sortedTableNames(env *Environment) []string {
+	names := make([]string, 0, len(env.tables))
+	for name := range env.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns an image of the tables and views of an environment.
+func newImage(env *Environment) *dbImage {
+	img := new(dbImage)
+	for _, name := range sortedTableNames(env) {
+		if table := env.tables[name]; !table.Temporary {
+			img.Tables = append(img.Tables, newTableImage(table))
+		}
+	}
+	names := make([]string, 0, len(env.views))
+	for name := range env.views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := env.views[name]; !env.isTemporary(name) {
+			img.Views = append(img.Views, newViewImage(v))
+		}
+	}
+	return img
+}
+
+// Reports whether the named relation is a temporary table or a view that
+// depends on one.
+func (env *Environment) isTemporary(name string) bool {
+	if table, ok := env.tables[name]; ok {
+		return table.Temporary
+	}
+	if v, ok := env.views[name]; ok {
+		for _, ref := range v.refs {
+			if env.isTemporary(ref) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newViewImage(v *view) *viewImage {
+	vi := &viewImage{
+		Name:         v.name,
+		Columns:      v.columns,
+		Query:        marshalNode(v.query),
+		Materialized: v.materialized,
+		Incremental:  v.incremental != nil,
+	}
+	if v.materialized && v.incremental == nil {
+		vi.Data = newTableImage(v.data)
+	}
+	return vi
+}
+
+func newTableImage(table *Table) *tableImage {
+	ti := newSchemaImage(table)
+	for _, row := range table.Data {
+		ti.Rows = append(ti.Rows, encodeRow(row))
+	}
+	return ti
+}
+
+// Returns an image of a table without its rows.
+func newSchemaImage(table *Table) *tableImage {
+	ti := &tableImage{Name: table.Name, Keys: table.Keys, ForeignKeys: table.ForeignKeys}
+	for _, col := range table.Columns {
+		ci := &columnImage{
+			Name:            col.Name,
+			Type:            col.Type,
+			Default:         encodeValue(col.Default),
+			Nullable:        col.Nullable,
+			AutoInc:         col.AutoInc,
+			GeneratedAlways: col.GeneratedAlways,
+		}
+		if col.DefaultExpr != nil {
+			ci.DefaultExpr = marshalNode(col.DefaultExpr)
+		}
+		if col.AutoInc {
+			ci.NextVal = col.nextVal()
+		}
+		ti.Columns = append(ti.Columns, ci)
+	}
+	for _, check := range table.Checks {
+		ti.Checks = append(ti.Checks, &checkImage{Name: check.Name, Expr: marshalNode(check.Expr)})
+	}
+	return ti
+}
+
+// Returns the environment that the image describes.
+func (img *dbImage) load() *Environment {
+	env := &Environment{tables: make(map[string]*Table), views: make(map[string]*view)}
+	img.loadInto(env)
+	return env
+}
+
+// Adds the relations that the image describes to an environment, replacing
+// those of the same names.
+func (img *dbImage) loadInto(env *Environment) {
+	for _, ti := range img.Tables {
+		delete(env.views, ti.Name)
+		env.tables[ti.Name] = ti.load()
+	}
+	var incremental []*view
+	for _, vi := range img.Views {
+		query, ok := unmarshalNode(vi.Query).(ast.QueryStmt)
+		if !ok {
+			panic(fmt.Errorf("query of view %q is not a query", vi.Name))
+		}
+		v := &view{
+			name:         vi.Name,
+			columns:      vi.Columns,
+			query:        query,
+			refs:         tableRefs(query),
+			materialized: vi.Materialized,
+		}
+		if vi.Data != nil {
+			v.data = vi.Data.load()
+		}
+		if vi.Incremental {
+			incremental = append(incremental, v)
+		}
+		delete(env.tables, v.name)
+		env.views[v.name] = v
+	}
+	// An incremental view's result is rebuilt from its table.
+	for _, v := range incremental {
+		v.incremental = newIncrementalView(env, v)
+	}
+}
+
+func (ti *tableImage) load() *Table {
+	table := &Table{Name: ti.Name, Keys: ti.Keys, ForeignKeys: ti.ForeignKeys}
+	for _, ci := range ti.Columns {
+		col := &Column{
+			Name:            ci.Name,
+			Type:            ci.Type,
+			Default:         decodeValue(ci.Default),
+			Nullable:        ci.Nullable,
+			AutoInc:         ci.AutoInc,
+			NextVal:         int(ci.NextVal),
+			GeneratedAlways: ci.GeneratedAlways,
+		}
+		if ci.DefaultExpr != nil {
+			col.DefaultExpr = unmarshalNode(ci.DefaultExpr).(ast.Expr)
+		}
+		table.Columns = append(table.Columns, col)
+	}
+	for _, ci := range ti.Checks {
+		table.Checks = append(table.Checks, &Check{Name: ci.Name, Expr: unmarshalNode(ci.Expr).(ast.Expr)})
+	}
+	for _, row := range ti.Rows {
+		table.Data = append(table.Data, decodeRow(row))
+	}
+	return table
+}
+
+func marshalNode(node ast.Node) json.RawMessage {
+	data, err := ast.Marshal(node)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func unmarshalNode(data json.RawMessage) ast.Node {
+	node, err := ast.Unmarshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
+
+func encodeRow(row Row) []interface{} {
+	values := make([]interface{}, len(row))
+	for i, v := range row {
+		values[i] = encodeValue(v)
+	}
+	return values
+}
+
+func decodeRow(values []interface{}) Row {
+	row := make(Row, len(values))
+	for i, x := range values {
+		row[i] = decodeValue(x)
+	}
+	return row
+}
+
+// Returns the encoding of a value as JSON: null, a boolean, or a string whose
+// first character is the type of the value.
+func encodeValue(v Value) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case BooleanValue:
+		return bool(v)
+	case IntegerValue:
+		return "i" + strconv.FormatInt(int64(v), 10)
+	case NumberValue:
+		return "n" + strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case StringValue:
+		return "s" + string(v)
+	case TimestampValue:
+		return "t" + time.Time(v).Format(time.RFC3339Nano)
+	}
+	panic(fmt.Errorf("cannot encode %T", v))
+}
+
+// Returns the value encoded by encodeValue.
+func decodeValue(x interface{}) Value {
+	switch x := x.(type) {
+	case nil:
+		return nil
+	case bool:
+		return BooleanValue(x)
+	case string:
+		if x == "" {
+			break
+		}
+		s := x[1:]
+		switch x[0] {
+		case 'i':
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return IntegerValue(n)
+			}
+		case 'n':
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return NumberValue(f)
+			}
+		case 's':
+			return StringValue(s)
+		case 't':
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return TimestampValue(t)
+			}
+		}
+	}
+	panic(fmt.Errorf("invalid value %v", x))
+}
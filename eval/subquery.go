@@ -0,0 +1,72 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Evaluates a subquery in the given namespace, which is the subquery's outer
+// namespace. Panics unless the result has exactly one column.
+func evalSubquery(ns namespace, expr *ast.SubqueryExpr) *Table {
+	result := evalQueryStmt(ns, expr.Select)
+	if len(result.Columns) != 1 {
+		panic(errorf(expr, "subquery must return only one column"))
+	}
+	return result
+}
+
+// Evaluates a subquery used as a scalar value. The result is null if the
+// subquery returns no rows, and an error if it returns more than one.
+func evalScalarSubquery(ns namespace, expr *ast.SubqueryExpr) Value {
+	result := evalSubquery(ns, expr)
+	switch len(result.Data) {
+	case 0:
+		return nil
+	case 1:
+		return result.Data[0][0]
+	}
+	panic(errorf(expr, "more than one row returned by a subquery used as an expression"))
+}
+
+// Evaluates "x IN (SELECT ...)" or "x IN (a, b, ...)". The result is true if
+// x equals any value in the list. Otherwise, it is null if x is null or if the
+// list contains a null; or false if neither is the case.
+func evalInExpr(ns namespace, expr *ast.BinaryExpr) Value {
+	lhs := evalExpr(ns, expr.Lhs)
+	var values []Value
+	switch rhs := expr.Rhs.(type) {
+	case *ast.SubqueryExpr:
+		for _, row := range evalSubquery(ns, rhs).Data {
+			values = append(values, row[0])
+		}
+	case *ast.TupleExpr:
+		for _, e := range rhs.Exprs {
+			values = append(values, evalExpr(ns, e))
+		}
+	default:
+		panic(errorf(rhs, "invalid right-hand side of IN"))
+	}
+	if len(values) == 0 {
+		return BooleanValue(false)
+	}
+	if lhs == nil {
+		return nil
+	}
+	sawNull := false
+	for _, v := range values {
+		if v == nil {
+			sawNull = true
+		} else if compareValues(expr, lhs, v) == 0 {
+			return BooleanValue(true)
+		}
+	}
+	if sawNull {
+		return nil
+	}
+	return BooleanValue(false)
+}
+
+// Evaluates "EXISTS (SELECT ...)".
+func evalExistsSubquery(ns namespace, expr *ast.UnaryExpr) Value {
+	result := evalQueryStmt(ns, expr.Expr.(*ast.SubqueryExpr).Select)
+	return BooleanValue(len(result.Data) != 0)
+}
@@ -0,0 +1,152 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// The state of an open transaction. Rolling back a transaction, or to one of
+// its savepoints, restores the environment from a snapshot.
+type transaction struct {
+	begin      *snapshot   // the state before BEGIN
+	savepoints []savepoint // in order of creation
+}
+
+type savepoint struct {
+	name  string
+	state *snapshot
+}
+
+// Evaluates a begin statement, which starts a transaction.
+func evalBeginStmt(env *Environment, stmt *ast.BeginStmt) {
+	if env.txn != nil {
+		panic(errorf(stmt, "there is already a transaction in progress"))
+	}
+	env.txn = &transaction{begin: env.snapshot()}
+}
+
+// Evaluates a commit statement, which ends the transaction, keeping its
+// changes.
+func evalCommitStmt(env *Environment, stmt *ast.CommitStmt) {
+	if env.txn == nil {
+		panic(errorf(stmt, "there is no transaction in progress"))
+	}
+	env.txn = nil
+}
+
+// Evaluates a rollback statement. ROLLBACK ends the transaction, undoing its
+// changes. ROLLBACK TO SAVEPOINT undoes the changes made since the savepoint
+// and releases the savepoints created after it, but not the savepoint itself.
+func evalRollbackStmt(env *Environment, stmt *ast.RollbackStmt) {
+	if stmt.Savepoint == nil {
+		if env.txn == nil {
+			panic(errorf(stmt, "there is no transaction in progress"))
+		}
+		env.restore(env.txn.begin)
+		env.txn = nil
+		return
+	}
+	i := env.findSavepoint(stmt, stmt.Savepoint, "ROLLBACK TO SAVEPOINT")
+	env.restore(env.txn.savepoints[i].state)
+	env.txn.savepoints = env.txn.savepoints[:i+1]
+}
+
+// Evaluates a savepoint statement. A savepoint may have the same name as an
+// earlier one, which it hides until it is released.
+func evalSavepointStmt(env *Environment, stmt *ast.SavepointStmt) {
+	if env.txn == nil {
+		panic(errorf(stmt, "SAVEPOINT can only be used in transaction blocks"))
+	}
+	env.txn.savepoints = append(env.txn.savepoints, savepoint{stmt.Name.Name, env.snapshot()})
+}
+
+// Evaluates a release savepoint statement, which forgets the savepoint and the
+// savepoints created after it, keeping the changes made since.
+func evalReleaseStmt(env *Environment, stmt *ast.ReleaseStmt) {
+	i := env.findSavepoint(stmt, stmt.Name, "RELEASE SAVEPOINT")
+	env.txn.savepoints = env.txn.savepoints[:i]
+}
+
+// Returns the index of the most recent savepoint with the given name. Panics
+// if there is no transaction or no such savepoint; cmd names the statement in
+// the error message.
+func (env *Environment) findSavepoint(stmt ast.Node, name *ast.Ident, cmd string) int {
+	if env.txn == nil {
+		panic(errorf(stmt, "%s can only be used in transaction blocks", cmd))
+	}
+	for i := len(env.txn.savepoints) - 1; i >= 0; i-- {
+		if env.txn.savepoints[i].name == name.Name {
+			return i
+		}
+	}
+	panic(errorf(name, "savepoint %q does not exist", name.Name))
+}
+
+// A copy of the tables and views of an environment, from which the
+// environment can be restored. Rows are shared with the environment, which
+// never modifies them in place, but everything else that a statement may
+// modify in place is copied.
+type snapshot struct {
+	tables map[string]*Table
+	copies map[*Table]*Table // copy of each table, sharing its rows
+	views  map[string]*view
+	states map[*view]view
+	logged int // length of the environment's rowLog
+}
+
+// Returns a snapshot of the environment.
+func (env *Environment) snapshot() *snapshot {
+	s := &snapshot{
+		tables: make(map[string]*Table),
+		copies: make(map[*Table]*Table),
+		views:  make(map[string]*view),
+		states: make(map[*view]view),
+		logged: len(env.rowLog),
+	}
+	for name, table := range env.tables {
+		s.tables[name] = table
+		s.copies[table] = table.copyShared()
+	}
+	for name, v := range env.views {
+		s.views[name] = v
+		s.states[v] = *v
+	}
+	return s
+}
+
+// Restores the environment from a snapshot. The snapshot is not modified, so
+// the environment may be restored from it again. Tables and views that existed
+// when the snapshot was taken keep their identity.
+func (env *Environment) restore(s *snapshot) {
+	env.tables = make(map[string]*Table)
+	for name, table := range s.tables {
+		*table = *s.copies[table].copyShared()
+		env.tables[name] = table
+	}
+	env.views = make(map[string]*view)
+	for name, v := range s.views {
+		*v = s.states[v]
+		env.views[name] = v
+		// The state of an incrementally maintained view is modified in
+		// place, so it is rebuilt instead; the view's result is unchanged.
+		if v.incremental != nil {
+			v.incremental.valid = false
+		}
+	}
+	env.rowLog = env.rowLog[:s.logged]
+}
+
+// Returns a copy of a table that shares its rows, which are never modified
+// in place, the expressions of its checks, which are never modified once the
+// table has been created, and the index of its keys. Rows appended to either
+// table are not visible to the other, since the tables share the claims on
+// the spare capacity of their rows, or else the copy's slice of rows has no
+// spare capacity.
+func (tab *Table) copyShared() *Table {
+	c := tab.cloneSchema()
+	c.Data, c.slots, c.base = tab.Data, tab.slots, tab.Data
+	if c.slots == nil {
+		c.Data = tab.Data[:len(tab.Data):len(tab.Data)]
+	}
+	c.index = tab.index
+	return c
+}
@@ -0,0 +1,159 @@
+package eval
+
+import (
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// Implements the ON CONFLICT clause of an insert statement. Rows are updated
+// in the statement's changes to the table, which the insert statement commits
+// once the whole statement has succeeded. Conflicts are found with the index
+// of the table's rows, and with the keys of the rows that the statement has
+// inserted or updated so far.
+type upsert struct {
+	env    *Environment
+	table  *Table
+	clause *ast.OnConflict
+	keys   []int // positions among the table's keys of the keys to which the clause applies
+	scope  scope // the table's columns, then those of "excluded"
+	base   int   // number of rows in the table before the insert
+	index  *keyIndex
+	seen   []map[string]int // by key, the index of each inserted or updated row by the rowKey of its values
+}
+
+// Validates the ON CONFLICT clause of an insert statement. Returns nil if
+// clause is nil.
+func newUpsert(env *Environment, table *Table, clause *ast.OnConflict) *upsert {
+	if clause == nil {
+		return nil
+	}
+	u := &upsert{
+		env:    env,
+		table:  table,
+		clause: clause,
+		base:   len(table.Data),
+		index:  table.keyIndex(),
+		seen:   make([]map[string]int, len(table.Keys)),
+	}
+	for k := range table.Keys {
+		u.keys = append(u.keys, k)
+		u.seen[k] = make(map[string]int)
+	}
+	if len(clause.Columns) != 0 {
+		names := make([]string, len(clause.Columns))
+		for i, col := range clause.Columns {
+			names[i] = col.Name
+		}
+		key := table.keyWithColumns(names)
+		if key == nil {
+			panic(errorf(clause, "there is no unique constraint matching the ON CONFLICT specification"))
+		}
+		for k := range table.Keys {
+			if table.Keys[k] == key {
+				u.keys = []int{k}
+			}
+		}
+	}
+	// The proposed row is visible to the DO UPDATE clause as "excluded".
+	u.scope = append(tableScope(table, table.Name), tableScope(table, "excluded")...)
+	for i, name := range clause.Set {
+		if table.colIndex(name.Name) < 0 {
+			panic(errorf(name, "column %q of relation %q does not exist", name.Name, table.Name))
+		}
+		validateUpsertExpr(clause.Values[i])
+	}
+	if clause.Where != nil {
+		validateUpsertExpr(clause.Where)
+	}
+	return u
+}
+
+// Panics if an expression in a DO UPDATE clause contains an aggregate or
+// window function.
+func validateUpsertExpr(expr ast.Expr) {
+	if containsAggFunc(expr) {
+		panic(errorf(expr, "aggregate functions are not allowed in ON CONFLICT DO UPDATE"))
+	}
+	if containsWindowFunc(expr) {
+		panic(errorf(expr, "window functions are not allowed in ON CONFLICT DO UPDATE"))
+	}
+}
+
+// Returns the index of the row that has the same values as the proposed row
+// in one of the keys to which the clause applies, or -1 if there is no such
+// row. Rows inserted by the statement follow the table's existing rows.
+func (u *upsert) findConflict(tc *tableChange, proposed Row) int {
+	for _, k := range u.keys {
+		if i := u.find(tc, k, proposed, -1); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the row, other than the one at index skip, that has
+// the same values as row in the columns of the k'th key, or -1 if there is no
+// such row.
+func (u *upsert) find(tc *tableChange, k int, row Row, skip int) int {
+	v, ok := u.index.key(k, row)
+	if !ok {
+		return -1
+	}
+	if i, ok := u.seen[k][v]; ok && i != skip {
+		return i
+	}
+	if i := u.index.find(k, v); i >= 0 && i != skip {
+		if _, updated := tc.changes[i]; !updated {
+			return i
+		}
+	}
+	return -1
+}
+
+// Panics if a row has the same values as a row other than the one at index
+// skip in the columns of any unique key; otherwise, records the row's values
+// as those of the row at index i.
+func (u *upsert) add(tc *tableChange, row Row, i int) {
+	for k, key := range u.table.Keys {
+		if u.find(tc, k, row, i) >= 0 {
+			panic(u.table.uniqueViolation(key))
+		}
+	}
+	for k := range u.table.Keys {
+		if v, ok := u.index.key(k, row); ok {
+			u.seen[k][v] = i
+		}
+	}
+}
+
+// Inserts a row that does not conflict with any row in the keys to which the
+// clause applies.
+func (u *upsert) insert(tc *tableChange, row Row) {
+	u.add(tc, row, u.base+len(tc.inserted))
+	tc.insert(row)
+}
+
+// Resolves a conflict between the proposed row and the row at index i, by
+// doing nothing or by updating the latter. Returns the updated row, or nil if
+// it was not updated.
+func (u *upsert) resolve(cs *changeSet, tc *tableChange, i int, proposed Row) Row {
+	if !u.clause.DoUpdate {
+		return nil
+	}
+	if _, updated := tc.changes[i]; i >= u.base || updated {
+		panic(errorf(u.clause, "ON CONFLICT DO UPDATE command cannot affect row a second time"))
+	}
+	existing := tc.row(i)
+	ns := &currentRow{u.scope, append(append(Row{}, existing...), proposed...), emptyNamespace{u.env}}
+	if u.clause.Where != nil && !isTrue(evalExpr(ns, u.clause.Where)) {
+		return nil
+	}
+	row := append(Row{}, existing...)
+	for j, name := range u.clause.Set {
+		n := u.table.colIndex(name.Name)
+		row[n] = evalAssignment(ns, u.table.Columns[n], u.clause.Values[j])
+	}
+	u.table.checkRow(u.env, row)
+	u.add(tc, row, i)
+	cs.update(tc, i, row)
+	return row
+}
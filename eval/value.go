@@ -2,7 +2,9 @@ package eval
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dcowgill/toysqleval/ast"
@@ -40,7 +42,7 @@ type BooleanValue bool
 func (v BooleanValue) toBoolean() BooleanValue     { return v }
 func (v BooleanValue) toInteger() IntegerValue     { panic("cannot convert Boolean to Integer") }
 func (v BooleanValue) toNumber() NumberValue       { panic("cannot convert Boolean to Number") }
-func (v BooleanValue) toString() StringValue       { panic("cannot convert Boolean to String") }
+func (v BooleanValue) toString() StringValue       { return StringValue(v.String()) }
 func (v BooleanValue) toTimestamp() TimestampValue { panic("cannot convert Boolean to Timestamp") }
 
 func (v BooleanValue) toInt() int64 {
@@ -83,18 +85,26 @@ func (v NumberValue) String() string {
 
 type StringValue string
 
-func (v StringValue) toBoolean() BooleanValue { panic("cannot convert String to Boolean") }
+func (v StringValue) toBoolean() BooleanValue {
+	switch strings.ToLower(strings.TrimSpace(string(v))) {
+	case "true", "t", "yes", "y", "on", "1":
+		return true
+	case "false", "f", "no", "n", "off", "0":
+		return false
+	}
+	panic(fmt.Sprintf("invalid input syntax for type Boolean: %s", v))
+}
 func (v StringValue) toInteger() IntegerValue {
-	n, err := strconv.ParseInt(string(v), 10, 64)
+	n, err := strconv.ParseInt(strings.TrimSpace(string(v)), 10, 64)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprintf("invalid input syntax for type Integer: %s", v))
 	}
 	return IntegerValue(n)
 }
 func (v StringValue) toNumber() NumberValue {
-	n, err := strconv.ParseFloat(string(v), 64)
+	n, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprintf("invalid input syntax for type Number: %s", v))
 	}
 	return NumberValue(n)
 }
@@ -124,6 +134,23 @@ func (v TimestampValue) String() string {
 	return time.Time(v).Format(time.RFC3339)
 }
 
+// Returns the data type of a non-null value.
+func typeOf(v Value) DataType {
+	switch v.(type) {
+	case BooleanValue:
+		return Boolean
+	case IntegerValue:
+		return Integer
+	case NumberValue:
+		return Number
+	case StringValue:
+		return String
+	case TimestampValue:
+		return Timestamp
+	}
+	panic(fmt.Sprintf("invalid value: %v", v))
+}
+
 func coerce(v Value, t DataType) Value {
 	switch t {
 	case Boolean:
@@ -140,134 +167,125 @@ func coerce(v Value, t DataType) Value {
 	panic(fmt.Errorf("invalid data type: %s", t))
 }
 
-func comparisonOp(expr *ast.BinaryExpr, lhs, rhs Value) bool {
-	// Any comparison involving null evaluates to false.
+func comparisonOp(expr *ast.BinaryExpr, lhs, rhs Value) Value {
+	// Any comparison involving null evaluates to null ("unknown").
 	if lhs == nil || rhs == nil {
-		return false
+		return nil
+	}
+	c := compareValues(expr, lhs, rhs)
+	switch expr.Op {
+	case token.Equal:
+		return BooleanValue(c == 0)
+	case token.NotEqual:
+		return BooleanValue(c != 0)
+	case token.LessThan:
+		return BooleanValue(c < 0)
+	case token.LessThanOrEqualTo:
+		return BooleanValue(c <= 0)
+	case token.GreaterThan:
+		return BooleanValue(c > 0)
+	case token.GreaterThanOrEqualTo:
+		return BooleanValue(c >= 0)
+	}
+	panic(errorf(expr, "invalid comparison operator: %s", expr.Op))
+}
+
+// Compares two non-null values, returning a negative number if lhs < rhs, zero
+// if lhs == rhs, or a positive number if lhs > rhs. Panics with an error at the
+// position of node if the values cannot be compared.
+func compareValues(node ast.Node, lhs, rhs Value) int {
+	if c, ok := compare(lhs, rhs); ok {
+		return c
 	}
+	if expr, ok := node.(*ast.BinaryExpr); ok {
+		panic(errorf(expr, "invalid comparison: %s %s %s", lhs, expr.Op, rhs))
+	}
+	panic(errorf(node, "cannot compare %s and %s", lhs, rhs))
+}
+
+// Like compareValues, but returns false if the values cannot be compared.
+func compare(lhs, rhs Value) (int, bool) {
 	// Double dispatch by type.
 	switch lhs := lhs.(type) {
 	case BooleanValue:
 		switch rhs := rhs.(type) {
 		case BooleanValue:
-			return cmpInts(expr, lhs.toInt(), rhs.toInt())
+			return cmpInts(lhs.toInt(), rhs.toInt()), true
 		}
 	case IntegerValue:
 		switch rhs := rhs.(type) {
 		case IntegerValue:
-			return cmpInts(expr, int64(lhs), int64(rhs))
+			return cmpInts(int64(lhs), int64(rhs)), true
 		case NumberValue:
-			return cmpFloats(expr, float64(lhs), float64(rhs))
+			return cmpFloats(float64(lhs), float64(rhs)), true
 		case StringValue:
 			val := rhs.toInteger()
-			return cmpInts(expr, int64(lhs), int64(val))
+			return cmpInts(int64(lhs), int64(val)), true
 		}
 	case NumberValue:
 		switch rhs := rhs.(type) {
 		case IntegerValue:
-			return cmpFloats(expr, float64(lhs), float64(rhs))
+			return cmpFloats(float64(lhs), float64(rhs)), true
 		case NumberValue:
-			return cmpFloats(expr, float64(lhs), float64(rhs))
+			return cmpFloats(float64(lhs), float64(rhs)), true
 		case StringValue:
 			val := rhs.toNumber()
-			return cmpFloats(expr, float64(lhs), float64(val))
+			return cmpFloats(float64(lhs), float64(val)), true
 		}
 	case StringValue:
 		switch rhs := rhs.(type) {
 		case IntegerValue:
-			val := rhs.toInteger()
-			return cmpInts(expr, int64(val), int64(rhs))
+			val := lhs.toInteger()
+			return cmpInts(int64(val), int64(rhs)), true
 		case NumberValue:
-			val := rhs.toNumber()
-			return cmpFloats(expr, float64(val), float64(rhs))
+			val := lhs.toNumber()
+			return cmpFloats(float64(val), float64(rhs)), true
 		case StringValue:
-			return cmpStrings(expr, string(lhs), string(rhs))
+			return strings.Compare(string(lhs), string(rhs)), true
 		case TimestampValue:
 			val := lhs.toTimestamp()
-			return cmpTimes(expr, time.Time(val), time.Time(rhs))
+			return cmpTimes(time.Time(val), time.Time(rhs)), true
 		}
 	case TimestampValue:
 		switch rhs := rhs.(type) {
 		case StringValue:
 			val := rhs.toTimestamp()
-			return cmpTimes(expr, time.Time(lhs), time.Time(val))
+			return cmpTimes(time.Time(lhs), time.Time(val)), true
 		case TimestampValue:
-			return cmpTimes(expr, time.Time(lhs), time.Time(rhs))
+			return cmpTimes(time.Time(lhs), time.Time(rhs)), true
 		}
 	}
-	panic(errorf(expr, "invalid comparison: %s %s %s", lhs, expr.Op, rhs))
-}
-
-func cmpInts(expr *ast.BinaryExpr, a, b int64) bool {
-	switch expr.Op {
-	case token.Equal:
-		return a == b
-	case token.NotEqual:
-		return a != b
-	case token.LessThan:
-		return a < b
-	case token.LessThanOrEqualTo:
-		return a <= b
-	case token.GreaterThan:
-		return a > b
-	case token.GreaterThanOrEqualTo:
-		return a >= b
-	}
-	panic(errorf(expr, "invalid comparison operator: %s", expr.Op))
+	return 0, false
 }
 
-func cmpFloats(expr *ast.BinaryExpr, a, b float64) bool {
-	switch expr.Op {
-	case token.Equal:
-		return a == b
-	case token.NotEqual:
-		return a != b
-	case token.LessThan:
-		return a < b
-	case token.LessThanOrEqualTo:
-		return a <= b
-	case token.GreaterThan:
-		return a > b
-	case token.GreaterThanOrEqualTo:
-		return a >= b
+func cmpInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
-	panic(errorf(expr, "invalid comparison operator: %s", expr.Op))
+	return 0
 }
 
-func cmpStrings(expr *ast.BinaryExpr, a, b string) bool {
-	switch expr.Op {
-	case token.Equal:
-		return a == b
-	case token.NotEqual:
-		return a != b
-	case token.LessThan:
-		return a < b
-	case token.LessThanOrEqualTo:
-		return a <= b
-	case token.GreaterThan:
-		return a > b
-	case token.GreaterThanOrEqualTo:
-		return a >= b
+func cmpFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
 	}
-	panic(errorf(expr, "invalid comparison operator: %s", expr.Op))
+	return 0
 }
 
-func cmpTimes(expr *ast.BinaryExpr, a, b time.Time) bool {
-	switch expr.Op {
-	case token.Equal:
-		return a.Equal(b)
-	case token.NotEqual:
-		return !a.Equal(b)
-	case token.LessThan:
-		return a.Before(b)
-	case token.LessThanOrEqualTo:
-		return a.Before(b) || a.Equal(b)
-	case token.GreaterThan:
-		return a.After(b)
-	case token.GreaterThanOrEqualTo:
-		return a.After(b) || a.Equal(b)
+func cmpTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
 	}
-	panic(errorf(expr, "invalid comparison operator: %s", expr.Op))
+	return 0
 }
 
 func arithmeticOp(expr *ast.BinaryExpr, lhs, rhs Value) Value {
@@ -381,3 +399,52 @@ func concatOp(expr *ast.BinaryExpr, lhs, rhs Value) Value {
 	}
 	return StringValue(string(lhs.toString()) + string(rhs.toString()))
 }
+
+// Returns a string that identifies a value for the purpose of grouping. Values
+// that compare as equal have the same key; in particular, an Integer and a
+// Number with the same numeric value share a key. All nulls share a key.
+func valueKey(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "N"
+	case BooleanValue:
+		return "B" + v.String()
+	case IntegerValue:
+		return "I" + v.String()
+	case NumberValue:
+		if f := float64(v); f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			return "I" + strconv.FormatInt(int64(f), 10)
+		}
+		return "F" + strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case StringValue:
+		return "S" + string(v)
+	case TimestampValue:
+		return "T" + time.Time(v).UTC().Format(time.RFC3339Nano)
+	}
+	panic(fmt.Sprintf("invalid value: %v", v))
+}
+
+// Returns a string that identifies a list of values for the purpose of
+// grouping; see valueKey.
+func rowKey(values []Value) string {
+	var sb strings.Builder
+	for _, v := range values {
+		k := valueKey(v)
+		fmt.Fprintf(&sb, "%d:%s", len(k), k)
+	}
+	return sb.String()
+}
+
+// A set of values, in which values that compare as equal are the same member;
+// see valueKey.
+type valueSet map[string]bool
+
+// Adds a value to the set, reporting whether it was not already a member.
+func (s valueSet) add(v Value) bool {
+	k := valueKey(v)
+	if s[k] {
+		return false
+	}
+	s[k] = true
+	return true
+}
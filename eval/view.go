@@ -0,0 +1,509 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// A named query. A view is evaluated each time a query refers to it, so it
+// always reflects the current contents of the tables it refers to, unless it
+// is materialized, in which case the result of its query is stored when it is
+// created or refreshed.
+type view struct {
+	name         string
+	columns      []string      // renames the first columns of the query's result
+	query        ast.QueryStmt // with "*" expanded; see expandQuery
+	refs         []string      // names of the tables and views to which the query refers
+	materialized bool
+	data         *Table           // stored result of a materialized view
+	incremental  *incrementalView // nil unless the view is maintained incrementally
+}
+
+// Returns the contents of the view: its stored result if it is materialized,
+// or else the result of evaluating its query.
+func (v *view) eval(env *Environment) *Table {
+	if v.materialized {
+		return v.data
+	}
+	return v.evalQuery(env)
+}
+
+// Evaluates the view's query. The result is a new table, named after the view.
+func (v *view) evalQuery(env *Environment) *Table {
+	result := evalQueryStmt(emptyNamespace{env}, v.query)
+	return v.newTable(result.Columns, result.Data)
+}
+
+// Evaluates the view's query, replacing "*" in its select statements with
+// references to the columns that it stands for, so that the view's columns do
+// not change when columns are added to the tables to which it refers. A
+// select statement that is never evaluated, such as a subquery in the WHERE
+// clause of a query of an empty table, keeps its "*".
+func (v *view) expandQuery(env *Environment) *Table {
+	env.expanding = make(map[*ast.SelectStmt]bool)
+	defer func() { env.expanding = nil }()
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		if stmt, ok := node.(*ast.SelectStmt); ok {
+			env.expanding[stmt] = true
+		}
+		return walk
+	}
+	ast.Walk(v.query, walk)
+	return v.evalQuery(env)
+}
+
+// Returns a table, named after the view, with the given rows and with copies
+// of the given columns, renamed as the view specifies.
+func (v *view) newTable(columns []*Column, rows []Row) *Table {
+	table := &Table{Name: v.name, Data: rows}
+	for i, col := range columns {
+		cp := *col
+		if i < len(v.columns) {
+			cp.Name = v.columns[i]
+		}
+		table.Columns = append(table.Columns, &cp)
+	}
+	return table
+}
+
+// Evaluates a create view statement. The query is evaluated once, to check
+// that it is valid and to determine the view's columns. A view may replace
+// another only if it has at least the same columns, with the same names and
+// types, in the same order.
+func evalCreateViewStmt(env *Environment, stmt *ast.CreateViewStmt) {
+	name := stmt.Name.Name
+	if _, ok := env.tables[name]; ok {
+		panic(errorf(stmt.Name, "relation %q already exists", name))
+	}
+	old, exists := env.views[name]
+	if exists && !stmt.OrReplace {
+		panic(errorf(stmt.Name, "relation %q already exists", name))
+	}
+	if exists && old.materialized {
+		panic(errorf(stmt.Name, "%q is not a view", name))
+	}
+	query := ast.Copy(stmt.Query).(ast.QueryStmt)
+	v := &view{name: name, query: query, refs: tableRefs(query), materialized: stmt.Materialized}
+	for _, ref := range v.refs {
+		if env.dependsOn(ref, name) {
+			panic(errorf(stmt.Name, "view %q cannot refer to itself", name))
+		}
+	}
+	for i, col := range stmt.Columns {
+		for _, prev := range stmt.Columns[:i] {
+			if prev.Name == col.Name {
+				panic(errorf(col, "column %q specified more than once", col.Name))
+			}
+		}
+		v.columns = append(v.columns, col.Name)
+	}
+	result := v.expandQuery(env)
+	if len(v.columns) > len(result.Columns) {
+		panic(errorf(stmt, "CREATE VIEW specifies more column names than columns"))
+	}
+	seen := make(map[string]bool)
+	for _, col := range result.Columns {
+		if seen[col.Name] {
+			panic(errorf(stmt, "column %q specified more than once", col.Name))
+		}
+		seen[col.Name] = true
+	}
+	if exists {
+		prev := old.eval(env)
+		if len(result.Columns) < len(prev.Columns) {
+			panic(errorf(stmt, "cannot drop columns from view"))
+		}
+		for i, col := range prev.Columns {
+			if c := result.Columns[i]; c.Name != col.Name {
+				panic(errorf(stmt, "cannot change name of view column %q to %q", col.Name, c.Name))
+			} else if c.Type != col.Type && c.Type != InvalidDataType && col.Type != InvalidDataType {
+				panic(errorf(stmt, "cannot change data type of view column %q from %s to %s", col.Name, col.Type, c.Type))
+			}
+		}
+	}
+	if v.materialized {
+		v.data = result
+		if stmt.Incremental {
+			v.incremental = newIncrementalView(env, v)
+		}
+	}
+	if env.views == nil {
+		env.views = make(map[string]*view)
+	}
+	env.views[name] = v
+}
+
+// Evaluates a drop view statement. The views are dropped together, so views
+// that depend on each other do not require CASCADE. DROP VIEW drops only
+// views that are not materialized, and DROP MATERIALIZED VIEW only views that
+// are.
+func evalDropViewStmt(env *Environment, stmt *ast.DropViewStmt) {
+	kind := "view"
+	if stmt.Materialized {
+		kind = "materialized view"
+	}
+	dropped := make(map[string]bool)
+	for _, name := range stmt.Views {
+		v, isView := env.views[name.Name]
+		_, isTable := env.tables[name.Name]
+		switch {
+		case isView && v.materialized == stmt.Materialized:
+			dropped[name.Name] = true
+		case isView || isTable:
+			panic(errorf(name, "%q is not a %s", name.Name, kind))
+		case !stmt.IfExists:
+			panic(errorf(name, "%s %q does not exist", kind, name.Name))
+		}
+	}
+	if !stmt.Cascade {
+		for _, name := range stmt.Views {
+			env.checkViewDependents(name, dropped)
+		}
+	}
+	for _, name := range stmt.Views {
+		env.dropView(name.Name)
+	}
+}
+
+// Panics if a view that is not in the set of dropped relations depends on the
+// named relation, which is being dropped.
+func (env *Environment) checkViewDependents(name *ast.Ident, dropped map[string]bool) {
+	if !dropped[name.Name] {
+		return
+	}
+	for _, v := range env.dependentViews(name.Name) {
+		if !dropped[v.name] {
+			panic(errorf(name, "cannot drop %q because view %q depends on it", name.Name, v.name))
+		}
+	}
+}
+
+// Removes a view, and the views that depend on it, from the environment.
+// Does nothing if the view does not exist.
+func (env *Environment) dropView(name string) {
+	if _, ok := env.views[name]; !ok {
+		return
+	}
+	delete(env.views, name)
+	for _, v := range env.dependentViews(name) {
+		env.dropView(v.name)
+	}
+}
+
+// Returns the views whose queries refer directly to the named table or view,
+// ordered by name.
+func (env *Environment) dependentViews(name string) []*view {
+	var views []*view
+	for _, v := range env.views {
+		if containsName(v.refs, name) {
+			views = append(views, v)
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].name < views[j].name })
+	return views
+}
+
+// Reports whether the named relation is the target relation, or is a view
+// that depends on it, directly or indirectly.
+func (env *Environment) dependsOn(name, target string) bool {
+	if name == target {
+		return true
+	}
+	if v, ok := env.views[name]; ok {
+		for _, ref := range v.refs {
+			if env.dependsOn(ref, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Panics if the named relation is a view. Statements that modify tables use
+// this to reject views; msg is formatted with the view's name. Materialized
+// views are rejected with a message of their own.
+func (env *Environment) checkNotView(name *ast.Ident, msg string) {
+	if v, ok := env.views[name.Name]; ok {
+		if v.materialized {
+			panic(errorf(name, "cannot change materialized view %q", name.Name))
+		}
+		panic(errorf(name, msg, name.Name))
+	}
+}
+
+// Returns the names of the tables and views to which a query refers in its
+// FROM clauses, including those of its subqueries, in order of first
+// reference. Names defined by WITH clauses in the query are excluded.
+func tableRefs(query ast.QueryStmt) []string {
+	var refs, ctes []string
+	var from func(expr ast.Expr)
+	from = func(expr ast.Expr) {
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			if !containsName(refs, expr.Name) {
+				refs = append(refs, expr.Name)
+			}
+		case *ast.AliasedTableExpr:
+			from(expr.Expr)
+		case *ast.JoinExpr:
+			from(expr.Left)
+			from(expr.Right)
+		}
+		// Subqueries are found by the walk below.
+	}
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.SelectStmt:
+			from(node.Table)
+		case *ast.CommonTableExpr:
+			ctes = append(ctes, node.Name.Name)
+		}
+		return walk
+	}
+	ast.Walk(query, walk)
+	var result []string
+	for _, ref := range refs {
+		if !containsName(ctes, ref) {
+			result = append(result, ref)
+		}
+	}
+	return result
+}
+
+// Returns an error unless the named relation is a table.
+func (env *Environment) checkIsTable(name string) error {
+	if _, ok := env.tables[name]; ok {
+		return nil
+	}
+	if _, ok := env.views[name]; ok {
+		return fmt.Errorf("%q is not a table", name)
+	}
+	return fmt.Errorf("table %q does not exist", name)
+}
+
+// Returns the columns of the named table to which a view's query refers. A
+// column that the query names without a table is attributed to each table in
+// the nearest enclosing FROM clause that has a column of that name, so the
+// result may include a column that the query does not use, but never omits
+// one that it does.
+func (env *Environment) viewColumns(v *view, table string) []string {
+	f := &columnFinder{env: env, table: table}
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		if cte, ok := node.(*ast.CommonTableExpr); ok {
+			f.ctes = append(f.ctes, cte.Name.Name)
+		}
+		return walk
+	}
+	ast.Walk(v.query, walk)
+	f.walk(v.query, nil)
+	return f.cols
+}
+
+// Finds the columns of a table to which a query refers; see viewColumns.
+type columnFinder struct {
+	env   *Environment
+	table string
+	ctes  []string // names defined by WITH clauses, which hide tables
+	cols  []string
+}
+
+// A table expression in a FROM clause, by the name by which the query refers
+// to it. The table is nil unless the expression names a table.
+type fromEntry struct {
+	name  string
+	table *Table
+}
+
+// Finds the column references in a node. The scopes are the FROM clauses of
+// the select statements that enclose it, innermost first.
+func (f *columnFinder) walk(node ast.Node, scopes [][]fromEntry) {
+	var fn ast.WalkFunc
+	fn = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.SelectStmt:
+			f.selectStmt(node, scopes)
+			return nil
+		case *ast.CommonTableExpr:
+			f.walk(node.Query, scopes)
+			return nil
+		case *ast.AliasedExpr:
+			f.walk(node.Expr, scopes)
+			return nil
+		case *ast.FunctionCall:
+			for _, arg := range node.Args {
+				if _, ok := arg.(*ast.SelectStarExpr); !ok { // COUNT(*) refers to no column
+					f.walk(arg, scopes)
+				}
+			}
+			f.walk(node.Filter, scopes)
+			if node.Over != nil {
+				f.walk(node.Over, scopes)
+			}
+			return nil
+		case *ast.WindowDef:
+			f.walk(node.Spec, scopes)
+			return nil
+		case *ast.WindowSpec:
+			for _, expr := range node.PartitionBy {
+				f.walk(expr, scopes)
+			}
+			for _, term := range node.OrderBy {
+				f.walk(term, scopes)
+			}
+			return nil
+		case *ast.SelectStarExpr:
+			if len(scopes) != 0 {
+				for _, e := range scopes[0] {
+					if node.Table == nil || node.Table.Name == e.name {
+						f.addAll(e.table)
+					}
+				}
+			}
+			return nil
+		case *ast.QualifiedIdent:
+			f.qualified(node.Table.Name, node.Name.Name, scopes)
+			return nil
+		case *ast.Ident:
+			f.unqualified(node.Name, scopes)
+		}
+		return fn
+	}
+	ast.Walk(node, fn)
+}
+
+// Finds the column references in a select statement, which resolve first
+// against its own FROM clause.
+func (f *columnFinder) selectStmt(stmt *ast.SelectStmt, scopes [][]fromEntry) {
+	var from []fromEntry
+	var conds []ast.Expr
+	var add func(expr ast.Expr, alias string)
+	add = func(expr ast.Expr, alias string) {
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			e := fromEntry{name: expr.Name}
+			if !containsName(f.ctes, expr.Name) {
+				e.table = f.env.tables[expr.Name]
+			}
+			if alias != "" {
+				e.name = alias
+			}
+			from = append(from, e)
+		case *ast.AliasedTableExpr:
+			add(expr.Expr, expr.Alias.Name)
+		case *ast.SubqueryExpr:
+			f.walk(expr.Select, scopes) // cannot refer to the rest of the FROM clause
+			from = append(from, fromEntry{name: alias})
+		case *ast.JoinExpr:
+			add(expr.Left, "")
+			add(expr.Right, "")
+			conds = append(conds, expr.On)
+		}
+	}
+	add(stmt.Table, "")
+	scopes = append([][]fromEntry{from}, scopes...)
+	for _, expr := range conds {
+		f.walk(expr, scopes)
+	}
+	for _, expr := range stmt.DistinctOn {
+		f.walk(expr, scopes)
+	}
+	for _, expr := range stmt.Columns {
+		f.walk(expr, scopes)
+	}
+	f.walk(stmt.Where, scopes)
+	for _, expr := range stmt.GroupBy {
+		f.walk(expr, scopes)
+	}
+	f.walk(stmt.Having, scopes)
+	for _, def := range stmt.Windows {
+		f.walk(def, scopes)
+	}
+	for _, term := range stmt.OrderBy {
+		f.walk(term, scopes)
+	}
+	f.walk(stmt.Limit, scopes)
+	f.walk(stmt.Offset, scopes)
+}
+
+// Records a reference to a column qualified by a table name or alias.
+func (f *columnFinder) qualified(name, col string, scopes [][]fromEntry) {
+	for _, from := range scopes {
+		for _, e := range from {
+			if e.name == name {
+				if e.table != nil && e.table.Name == f.table {
+					f.add(col)
+				}
+				return
+			}
+		}
+	}
+}
+
+// Records a reference to a column that is not qualified by a table name.
+func (f *columnFinder) unqualified(col string, scopes [][]fromEntry) {
+	for _, from := range scopes {
+		found := false
+		for _, e := range from {
+			if e.table != nil && e.table.colIndex(col) >= 0 {
+				found = true
+				if e.table.Name == f.table {
+					f.add(col)
+				}
+			}
+		}
+		if found {
+			return
+		}
+	}
+}
+
+func (f *columnFinder) add(col string) {
+	if !containsName(f.cols, col) {
+		f.cols = append(f.cols, col)
+	}
+}
+
+func (f *columnFinder) addAll(table *Table) {
+	if table != nil && table.Name == f.table {
+		for _, col := range table.Columns {
+			f.add(col.Name)
+		}
+	}
+}
+
+// Returns a copy of a query in which the FROM clauses refer to a renamed table
+// by its new name. The table keeps its old name as an alias, so that columns
+// qualified by it still resolve.
+func renameTableRefs(query ast.QueryStmt, oldName, newName string) ast.QueryStmt {
+	query = ast.Copy(query).(ast.QueryStmt)
+	var rename func(expr ast.Expr) ast.Expr
+	rename = func(expr ast.Expr) ast.Expr {
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			if expr.Name == oldName {
+				return &ast.AliasedTableExpr{Expr: &ast.Ident{NamePos: expr.NamePos, Name: newName}, Alias: expr}
+			}
+		case *ast.AliasedTableExpr:
+			if ident, ok := expr.Expr.(*ast.Ident); ok && ident.Name == oldName {
+				ident.Name = newName
+			}
+		case *ast.JoinExpr:
+			expr.Left, expr.Right = rename(expr.Left), rename(expr.Right)
+		}
+		return expr
+	}
+	var walk ast.WalkFunc
+	walk = func(node ast.Node) ast.WalkFunc {
+		if stmt, ok := node.(*ast.SelectStmt); ok {
+			stmt.Table = rename(stmt.Table)
+		}
+		return walk
+	}
+	ast.Walk(query, walk)
+	return query
+}
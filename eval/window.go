@@ -0,0 +1,555 @@
+package eval
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dcowgill/toysqleval/ast"
+)
+
+// The minimum and maximum number of arguments of each builtin window function
+// that is not also an aggregate function.
+var windowFuncArgs = map[string][2]int{
+	"row_number":  {0, 0},
+	"rank":        {0, 0},
+	"dense_rank":  {0, 0},
+	"ntile":       {1, 1},
+	"lag":         {1, 3},
+	"lead":        {1, 3},
+	"first_value": {1, 1},
+	"last_value":  {1, 1},
+}
+
+// Describes a window function call in the projection of a select statement,
+// with its window resolved against the statement's WINDOW clause.
+type windowCall struct {
+	call      *ast.FunctionCall
+	partition []ast.Expr
+	orderBy   []*ast.OrderingTerm
+	frame     *ast.WindowFrame // nil for the default frame
+	start     int              // index of the first input in each row
+}
+
+// Returns the expressions whose values the window function needs for each row:
+// its arguments, then its filter condition, if any, then its partition keys,
+// then its sort keys. The caller must store them in each row, starting at
+// index w.start.
+func (w *windowCall) inputs() []ast.Expr {
+	var exprs []ast.Expr
+	for _, arg := range w.call.Args {
+		if _, ok := arg.(*ast.SelectStarExpr); ok {
+			arg = &ast.IntegerLiteral{ValuePos: arg.Pos(), Value: 1} // COUNT(*) counts rows
+		}
+		exprs = append(exprs, arg)
+	}
+	if w.call.Filter != nil {
+		exprs = append(exprs, w.call.Filter)
+	}
+	exprs = append(exprs, w.partition...)
+	for _, term := range w.orderBy {
+		exprs = append(exprs, term.Expr)
+	}
+	return exprs
+}
+
+// Accessors for the inputs of a window function in a row; see inputs.
+func (w *windowCall) args(row Row) []Value {
+	return row[w.start : w.start+len(w.call.Args)]
+}
+
+func (w *windowCall) filter(row Row) bool {
+	if w.call.Filter == nil {
+		return true
+	}
+	return isTrue(row[w.start+len(w.call.Args)])
+}
+
+func (w *windowCall) partitionKeys(row Row) []Value {
+	i := w.start + len(w.call.Args)
+	if w.call.Filter != nil {
+		i++
+	}
+	return row[i : i+len(w.partition)]
+}
+
+func (w *windowCall) sortKeys(row Row) []Value {
+	i := w.start + len(w.call.Args) + len(w.partition)
+	if w.call.Filter != nil {
+		i++
+	}
+	return row[i : i+len(w.orderBy)]
+}
+
+// Finds the window function calls in the projection of a select statement,
+// excluding those in subqueries, and resolves their windows. Panics if a call
+// is invalid.
+func findWindowCalls(stmt *ast.SelectStmt, projection []ast.Expr) []*windowCall {
+	for i, def := range stmt.Windows {
+		for _, prev := range stmt.Windows[:i] {
+			if prev.Name.Name == def.Name.Name {
+				panic(errorf(def.Name, "window %q is already defined", def.Name.Name))
+			}
+		}
+	}
+	var windows []*windowCall
+	seen := make(map[*ast.FunctionCall]bool)
+	var fn ast.WalkFunc
+	fn = func(node ast.Node) ast.WalkFunc {
+		switch node := node.(type) {
+		case *ast.SubqueryExpr:
+			return nil // subqueries have their own window functions
+		case *ast.FunctionCall:
+			if node.Over == nil || seen[node] {
+				break
+			}
+			seen[node] = true
+			validateWindowCall(node)
+			w := &windowCall{call: node}
+			w.partition, w.orderBy, w.frame = resolveWindow(stmt.Windows, node.Over)
+			validateWindowFrame(w)
+			windows = append(windows, w)
+			return nil // arguments cannot contain window functions
+		}
+		return fn
+	}
+	for _, expr := range projection {
+		ast.Walk(expr, fn)
+	}
+	return windows
+}
+
+// Panics unless a window function call has a valid name and arguments.
+func validateWindowCall(call *ast.FunctionCall) {
+	name := call.Name.Name
+	for _, arg := range call.Args {
+		if containsWindowFunc(arg) {
+			panic(errorf(arg, "window function calls cannot be nested"))
+		}
+	}
+	if call.Distinct {
+		panic(errorf(call, "DISTINCT is not implemented for window functions"))
+	}
+	if constructor := builtinAggFuncs[name]; constructor != nil {
+		constructor(call) // validates the arguments
+		return
+	}
+	limits, ok := windowFuncArgs[name]
+	if !ok {
+		panic(errorf(call, "OVER specified, but %s is not a window function nor an aggregate function", name))
+	}
+	if call.Filter != nil {
+		panic(errorf(call, "FILTER is not implemented for non-aggregate window functions"))
+	}
+	if n := len(call.Args); n < limits[0] || n > limits[1] {
+		want := strconv.Itoa(limits[0])
+		if limits[0] != limits[1] {
+			want = strconv.Itoa(limits[0]) + " to " + strconv.Itoa(limits[1])
+		}
+		panic(errorf(call, "wrong number of arguments to %s: got %d, want %s", strings.ToUpper(name), n, want))
+	}
+}
+
+// Resolves a window specification that may refer to a named window in the
+// WINDOW clause of a select statement, returning its partition keys, sort keys
+// and frame clause. Like Postgres, a window definition may only refer to
+// windows defined before it, so defs contains only those that are visible.
+func resolveWindow(defs []*ast.WindowDef, spec *ast.WindowSpec) ([]ast.Expr, []*ast.OrderingTerm, *ast.WindowFrame) {
+	if spec.Name == nil {
+		return spec.PartitionBy, spec.OrderBy, spec.Frame
+	}
+	i := len(defs) - 1
+	for i >= 0 && defs[i].Name.Name != spec.Name.Name {
+		i--
+	}
+	if i < 0 {
+		panic(errorf(spec.Name, "window %q does not exist", spec.Name.Name))
+	}
+	partition, orderBy, frame := resolveWindow(defs[:i], defs[i].Spec)
+	if len(spec.PartitionBy) != 0 {
+		panic(errorf(spec, "cannot override PARTITION BY clause of window %q", spec.Name.Name))
+	}
+	if len(spec.OrderBy) != 0 {
+		if len(orderBy) != 0 {
+			panic(errorf(spec, "cannot override ORDER BY clause of window %q", spec.Name.Name))
+		}
+		orderBy = spec.OrderBy
+	}
+	if spec.Frame != nil {
+		frame = spec.Frame
+	}
+	return partition, orderBy, frame
+}
+
+// Panics unless a window function's frame clause is valid.
+func validateWindowFrame(w *windowCall) {
+	frame := w.frame
+	if frame == nil {
+		return
+	}
+	switch {
+	case frame.Start.Kind == ast.UnboundedFollowing:
+		panic(errorf(frame.Start, "frame start cannot be UNBOUNDED FOLLOWING"))
+	case frame.End.Kind == ast.UnboundedPreceding:
+		panic(errorf(frame.End, "frame end cannot be UNBOUNDED PRECEDING"))
+	case frame.Start.Kind > frame.End.Kind:
+		panic(errorf(frame, "frame starting from %s cannot end with %s", frame.Start.Kind, frame.End.Kind))
+	}
+	if frame.Range && (frame.Start.Offset != nil || frame.End.Offset != nil) && len(w.orderBy) != 1 {
+		panic(errorf(frame, "RANGE with offset PRECEDING/FOLLOWING requires exactly one ORDER BY column"))
+	}
+}
+
+// Computes the window functions for each row. The rows must contain the
+// inputs of each function; see windowCall.inputs. Returns nil if there are
+// no window functions; otherwise, the values of the functions in each row.
+func evalWindowCalls(outer namespace, windows []*windowCall, rows []Row) []map[*ast.FunctionCall]Value {
+	if len(windows) == 0 {
+		return nil
+	}
+	values := make([]map[*ast.FunctionCall]Value, len(rows))
+	for i := range values {
+		values[i] = make(map[*ast.FunctionCall]Value, len(windows))
+	}
+	for _, w := range windows {
+		for _, part := range w.partitions(rows) {
+			p := newWindowPartition(outer, w, rows, part)
+			for pos, i := range part {
+				values[i][w.call] = p.compute(pos)
+			}
+		}
+	}
+	return values
+}
+
+// Divides the rows into partitions by the window's partition keys, and sorts
+// each partition by its sort keys. Returns the partitions as lists of indexes
+// into rows.
+func (w *windowCall) partitions(rows []Row) [][]int {
+	var parts [][]int
+	index := make(map[string]int)
+	for i, row := range rows {
+		k := rowKey(w.partitionKeys(row))
+		n, ok := index[k]
+		if !ok {
+			n = len(parts)
+			index[k] = n
+			parts = append(parts, nil)
+		}
+		parts[n] = append(parts[n], i)
+	}
+	for n, part := range parts {
+		// Sort a copy of each row's sort keys, followed by the row's index.
+		keys := make([]Row, len(part))
+		for j, i := range part {
+			keys[j] = append(append(Row{}, w.sortKeys(rows[i])...), IntegerValue(i))
+		}
+		sortRows(w.orderBy, keys, 0)
+		for j, key := range keys {
+			parts[n][j] = int(key[len(key)-1].(IntegerValue))
+		}
+	}
+	return parts
+}
+
+// A sorted partition of the rows of a window function, and everything needed
+// to compute the function for each of them.
+type windowPartition struct {
+	w          *windowCall
+	rows       []Row // the partition's rows, in order
+	peerStart  []int // position of the first peer of each row
+	peerEnd    []int // position of the last peer of each row
+	startDelta Value // offset of the frame start, if any
+	endDelta   Value // offset of the frame end, if any
+	outer      namespace
+
+	// The state of an aggregate window function whose frames all start at
+	// the beginning of the partition; see aggregate.
+	aggScope scope
+	aggCall  *ast.FunctionCall
+	running  aggFunc // nil until the first frame is aggregated
+	stepped  int     // number of rows passed to running
+}
+
+// Creates a partition from the rows with the given indexes, in order.
+func newWindowPartition(outer namespace, w *windowCall, rows []Row, indexes []int) *windowPartition {
+	p := &windowPartition{w: w, outer: outer}
+	for _, i := range indexes {
+		p.rows = append(p.rows, rows[i])
+	}
+	// Rows with equal sort keys are peers. Without ORDER BY, all rows are.
+	n := len(p.rows)
+	p.peerStart, p.peerEnd = make([]int, n), make([]int, n)
+	for pos := 0; pos < n; pos++ {
+		p.peerStart[pos] = pos
+		if pos > 0 && rowKey(w.sortKeys(p.rows[pos])) == rowKey(w.sortKeys(p.rows[pos-1])) {
+			p.peerStart[pos] = p.peerStart[pos-1]
+		}
+	}
+	for pos := n - 1; pos >= 0; pos-- {
+		p.peerEnd[pos] = pos
+		if pos < n-1 && p.peerStart[pos+1] == p.peerStart[pos] {
+			p.peerEnd[pos] = p.peerEnd[pos+1]
+		}
+	}
+	if w.frame != nil {
+		p.startDelta = evalFrameOffset(outer, w.frame, w.frame.Start)
+		p.endDelta = evalFrameOffset(outer, w.frame, w.frame.End)
+	}
+	return p
+}
+
+// Evaluates the offset of a frame bound. Returns nil if there is no offset.
+func evalFrameOffset(ns namespace, frame *ast.WindowFrame, bound *ast.FrameBound) Value {
+	if bound.Offset == nil {
+		return nil
+	}
+	value := evalExpr(ns, bound.Offset)
+	switch v := value.(type) {
+	case IntegerValue:
+		if v >= 0 {
+			return v
+		}
+	case NumberValue:
+		if frame.Range && v >= 0 {
+			return v
+		}
+	}
+	if frame.Range {
+		panic(errorf(bound.Offset, "frame offset must be a non-negative number, not %v", value))
+	}
+	panic(errorf(bound.Offset, "frame offset must be a non-negative integer, not %v", value))
+}
+
+// Computes the window function for the row at the given position.
+func (p *windowPartition) compute(pos int) Value {
+	call := p.w.call
+	args := p.w.args(p.rows[pos])
+	switch call.Name.Name {
+	case "row_number":
+		return IntegerValue(pos + 1)
+	case "rank":
+		return IntegerValue(p.peerStart[pos] + 1)
+	case "dense_rank":
+		rank := 1
+		for i := 1; i <= pos; i++ {
+			if p.peerStart[i] == i {
+				rank++
+			}
+		}
+		return IntegerValue(rank)
+	case "ntile":
+		return p.ntile(pos, args[0])
+	case "lag", "lead":
+		offset := IntegerValue(1)
+		if len(args) > 1 {
+			if args[1] == nil {
+				return nil
+			}
+			offset = coerceAt(call.Args[1], args[1], Integer).(IntegerValue)
+		}
+		if call.Name.Name == "lag" {
+			offset = -offset
+		}
+		if i := pos + int(offset); i >= 0 && i < len(p.rows) {
+			return p.w.args(p.rows[i])[0]
+		}
+		if len(args) > 2 {
+			return args[2]
+		}
+		return nil
+	case "first_value", "last_value":
+		lo, hi := p.frame(pos)
+		switch {
+		case lo > hi:
+			return nil
+		case call.Name.Name == "first_value":
+			return p.w.args(p.rows[lo])[0]
+		default:
+			return p.w.args(p.rows[hi])[0]
+		}
+	}
+	return p.aggregate(pos)
+}
+
+// Computes ntile(n) for the row at the given position: the number of the
+// bucket, from 1 to n, to which the row belongs when the partition is divided
+// as evenly as possible. The first buckets get any extra rows.
+func (p *windowPartition) ntile(pos int, arg Value) Value {
+	if arg == nil {
+		return nil
+	}
+	n, ok := arg.(IntegerValue)
+	if !ok || n <= 0 {
+		panic(errorf(p.w.call.Args[0], "argument of ntile must be a positive integer, not %v", arg))
+	}
+	size, extra := len(p.rows)/int(n), len(p.rows)%int(n)
+	if big := extra * (size + 1); pos < big {
+		return IntegerValue(pos/(size+1) + 1)
+	} else {
+		return IntegerValue(extra + (pos-big)/size + 1)
+	}
+}
+
+// Computes an aggregate window function for the row at the given position.
+// If every frame starts at the beginning of the partition, each frame contains
+// the previous one, so a single instance of the aggregate is passed only the
+// rows that each frame adds. Otherwise, every row in the frame is passed to a
+// new instance.
+func (p *windowPartition) aggregate(pos int) Value {
+	lo, hi := p.frame(pos)
+	if frame := p.w.frame; frame != nil && frame.Start.Kind != ast.UnboundedPreceding {
+		fn := p.newAggregate()
+		p.step(fn, lo, hi)
+		return fn.finalize()
+	}
+	if p.running == nil {
+		p.running = p.newAggregate()
+	}
+	// The frame end never moves backward, since rows are computed in order.
+	p.step(p.running, p.stepped, hi)
+	p.stepped = maxInt(p.stepped, hi+1)
+	return p.running.finalize()
+}
+
+// Creates a new instance of an aggregate window function.
+func (p *windowPartition) newAggregate() aggFunc {
+	if p.aggCall == nil {
+		// The aggregate sees the arguments, which have already been computed,
+		// as the columns of a row.
+		call := p.w.call
+		p.aggScope = make(scope, len(call.Args))
+		args := make([]ast.Expr, len(call.Args))
+		for i, arg := range call.Args {
+			name := "$" + strconv.Itoa(i+1)
+			p.aggScope[i] = scopeColumn{col: &Column{Name: name}}
+			args[i] = &ast.Ident{NamePos: arg.Pos(), Name: name}
+			if _, ok := arg.(*ast.SelectStarExpr); ok {
+				args[i] = arg
+			}
+		}
+		p.aggCall = &ast.FunctionCall{Name: call.Name, Args: args}
+	}
+	return builtinAggFuncs[p.aggCall.Name.Name](p.aggCall)
+}
+
+// Passes the rows at positions lo through hi to an aggregate.
+func (p *windowPartition) step(fn aggFunc, lo, hi int) {
+	for i := lo; i <= hi; i++ {
+		if row := p.rows[i]; p.w.filter(row) {
+			fn.step(&currentRow{p.aggScope, p.w.args(row), p.outer})
+		}
+	}
+}
+
+// Returns the positions of the first and last rows in the frame of the row at
+// the given position. The frame is empty if the first exceeds the last.
+func (p *windowPartition) frame(pos int) (lo, hi int) {
+	frame := p.w.frame
+	if frame == nil {
+		// The default frame extends from the start of the partition to the
+		// current row's last peer.
+		return 0, p.peerEnd[pos]
+	}
+	if frame.Range {
+		return p.rangeBound(pos, frame.Start, p.startDelta, true),
+			p.rangeBound(pos, frame.End, p.endDelta, false)
+	}
+	lo = maxInt(p.rowsBound(pos, frame.Start, p.startDelta), 0)
+	hi = minInt(p.rowsBound(pos, frame.End, p.endDelta), len(p.rows)-1)
+	return lo, hi
+}
+
+// Returns the position of a frame bound in ROWS mode, which may lie outside
+// the partition.
+func (p *windowPartition) rowsBound(pos int, bound *ast.FrameBound, delta Value) int {
+	switch bound.Kind {
+	case ast.UnboundedPreceding:
+		return 0
+	case ast.Preceding:
+		return pos - int(delta.(IntegerValue))
+	case ast.Following:
+		return pos + int(delta.(IntegerValue))
+	case ast.UnboundedFollowing:
+		return len(p.rows) - 1
+	}
+	return pos // current row
+}
+
+// Returns the position of a frame bound in RANGE mode, in which the frame
+// includes every row whose sort key is within the given distance of the
+// current row's key. As in PostgreSQL, rows with null keys are infinitely far
+// from other rows, before or after them according to NULLS FIRST or LAST, and
+// a row with a null key has only its peers in range.
+func (p *windowPartition) rangeBound(pos int, bound *ast.FrameBound, delta Value, isStart bool) int {
+	switch bound.Kind {
+	case ast.UnboundedPreceding:
+		return 0
+	case ast.UnboundedFollowing:
+		return len(p.rows) - 1
+	case ast.CurrentRow:
+		if isStart {
+			return p.peerStart[pos]
+		}
+		return p.peerEnd[pos]
+	}
+	term := p.w.orderBy[0]
+	cur := p.w.sortKeys(p.rows[pos])[0]
+	if cur == nil {
+		if isStart {
+			return p.peerStart[pos]
+		}
+		return p.peerEnd[pos]
+	}
+	// The signed distance from the current row in the direction of the sort,
+	// which never decreases from one row to the next.
+	key := numericSortKey(term, cur)
+	limit := float64(delta.toNumber())
+	if bound.Kind == ast.Preceding {
+		limit = -limit
+	}
+	distance := func(i int) float64 {
+		v := p.w.sortKeys(p.rows[i])[0]
+		if v == nil {
+			if term.NullsFirst {
+				return math.Inf(-1)
+			}
+			return math.Inf(1)
+		}
+		d := float64(numericSortKey(term, v) - key)
+		if term.Desc {
+			d = -d
+		}
+		return d
+	}
+	if isStart {
+		return sort.Search(len(p.rows), func(i int) bool { return distance(i) >= limit })
+	}
+	return sort.Search(len(p.rows), func(i int) bool { return distance(i) > limit }) - 1
+}
+
+// Converts a sort key to a number, for a frame in RANGE mode with an offset.
+func numericSortKey(term *ast.OrderingTerm, v Value) NumberValue {
+	switch v := v.(type) {
+	case IntegerValue:
+		return v.toNumber()
+	case NumberValue:
+		return v
+	}
+	panic(errorf(term, "RANGE with offset PRECEDING/FOLLOWING requires a numeric ORDER BY column, not %s", v))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -12,28 +12,79 @@ import (
 const singleQuote = '\''
 
 var sqlKeywords = map[string]token.Kind{
-	"and":       token.And,
-	"boolean":   token.Boolean,
-	"create":    token.Create,
-	"delete":    token.Delete,
-	"false":     token.False,
-	"from":      token.From,
-	"insert":    token.Insert,
-	"integer":   token.Integer,
-	"into":      token.Into,
-	"not":       token.Not,
-	"null":      token.Null,
-	"number":    token.Number,
-	"or":        token.Or,
-	"select":    token.Select,
-	"set":       token.Set,
-	"table":     token.Table,
-	"timestamp": token.Timestamp,
-	"true":      token.True,
-	"update":    token.Update,
-	"values":    token.Values,
-	"varchar":   token.Varchar,
-	"where":     token.Where,
+	"all":        token.All,
+	"alter":      token.Alter,
+	"and":        token.And,
+	"as":         token.As,
+	"asc":        token.Asc,
+	"between":    token.Between,
+	"boolean":    token.Boolean,
+	"by":         token.By,
+	"case":       token.Case,
+	"cast":       token.Cast,
+	"check":      token.Check,
+	"constraint": token.Constraint,
+	"create":     token.Create,
+	"cross":      token.Cross,
+	"default":    token.Default,
+	"delete":     token.Delete,
+	"desc":       token.Desc,
+	"distinct":   token.Distinct,
+	"drop":       token.Drop,
+	"else":       token.Else,
+	"end":        token.End,
+	"escape":     token.Escape,
+	"except":     token.Except,
+	"exists":     token.Exists,
+	"false":      token.False,
+	"foreign":    token.Foreign,
+	"from":       token.From,
+	"full":       token.Full,
+	"group":      token.Group,
+	"having":     token.Having,
+	"ilike":      token.Ilike,
+	"in":         token.In,
+	"inner":      token.Inner,
+	"insert":     token.Insert,
+	"integer":    token.Integer,
+	"intersect":  token.Intersect,
+	"into":       token.Into,
+	"is":         token.Is,
+	"join":       token.Join,
+	"left":       token.Left,
+	"like":       token.Like,
+	"limit":      token.Limit,
+	"not":        token.Not,
+	"null":       token.Null,
+	"number":     token.Number,
+	"offset":     token.Offset,
+	"on":         token.On,
+	"or":         token.Or,
+	"order":      token.Order,
+	"outer":      token.Outer,
+	"over":       token.Over,
+	"primary":    token.Primary,
+	"recursive":  token.Recursive,
+	"references": token.References,
+	"returning":  token.Returning,
+	"right":      token.Right,
+	"select":     token.Select,
+	"set":        token.Set,
+	"table":      token.Table,
+	"then":       token.Then,
+	"timestamp":  token.Timestamp,
+	"true":       token.True,
+	"truncate":   token.Truncate,
+	"union":      token.Union,
+	"unique":     token.Unique,
+	"unknown":    token.Unknown,
+	"update":     token.Update,
+	"values":     token.Values,
+	"varchar":    token.Varchar,
+	"when":       token.When,
+	"where":      token.Where,
+	"window":     token.Window,
+	"with":       token.With,
 }
 
 // Lexer represents a SQL lexical analyzer.
@@ -77,6 +128,10 @@ func (lex *Lexer) Scan() bool {
 			return lex.consumeNumber() // e.g. ".01"
 		}
 		return lex.consumeRune(token.Dot)
+	case ':':
+		if lex.matchString("::", token.DoubleColon) {
+			return true
+		}
 	case '=':
 		return lex.consumeRune(token.Equal)
 	case '>':
@@ -102,6 +157,17 @@ func (lex *Lexer) Scan() bool {
 		if lex.matchString("!=", token.NotEqual) {
 			return true
 		}
+		if lex.matchString("!~*", token.NotRegexIMatch) {
+			return true
+		}
+		if lex.matchString("!~", token.NotRegexMatch) {
+			return true
+		}
+	case '~':
+		if lex.matchString("~*", token.RegexIMatch) {
+			return true
+		}
+		return lex.consumeRune(token.RegexMatch)
 	case '+':
 		return lex.consumeRune(token.Plus)
 	case ')':
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"unicode"
 
 	"github.com/dcowgill/toysqleval/ast"
@@ -10,10 +11,6 @@ import (
 	"github.com/dcowgill/toysqleval/token"
 )
 
-// TODO: tuple expressions, as in (1,2,3)
-// TODO: select from parenthesized table subexpression
-// TODO: IS and NOT, as in "WHERE x IS NOT NULL"
-
 // Maintains the parser state.
 type parser struct {
 	lex *lexer.Lexer
@@ -57,102 +54,887 @@ func (p *parser) parseStmtList() []ast.Node {
 func (p *parser) parseStmt() ast.Node {
 	switch p.kind() {
 	case token.Create:
-		return p.parseCreateTableStmt()
-	case token.Select:
-		return p.parseSelectStmt()
+		return p.parseCreateStmt()
+	case token.Select, token.With:
+		return p.parseQueryStmt()
 	case token.Insert:
 		return p.parseInsertStmt()
 	case token.Update:
 		return p.parseUpdateStmt()
 	case token.Delete:
 		return p.parseDeleteStmt()
+	case token.Drop:
+		return p.parseDropStmt()
+	case token.Truncate:
+		return p.parseTruncateStmt()
+	case token.Alter:
+		return p.parseAlterTableStmt()
+	}
+	switch {
+	case p.isWord("refresh"):
+		return p.parseRefreshStmt()
+	case p.isWord("begin"), p.isWord("start"), p.isWord("commit"), p.isWord("rollback"),
+		p.isWord("savepoint"), p.isWord("release"):
+		return p.parseTransactionStmt()
 	}
-	p.expected(token.Select, token.Insert, token.Update, token.Delete)
+	p.expected(token.Select, token.With, token.Insert, token.Update, token.Delete,
+		token.Create, token.Drop, token.Truncate, token.Alter)
 	return nil // not reached
 }
 
-// Parses a create table statement.
-func (p *parser) parseCreateTableStmt() *ast.CreateTableStmt {
+// Parses a create table or create view statement. VIEW, REPLACE, INCREMENTAL
+// and MATERIALIZED are not reserved words.
+func (p *parser) parseCreateStmt() ast.Node {
 	start := p.match(token.Create)
-	p.match(token.Table)
-	table := p.parseIdent()
-	columns := p.parseColumnDefinitions()
-	return &ast.CreateTableStmt{StartPos: start.Pos, Table: table, Columns: columns}
+	if p.kind() == token.Or {
+		p.skip(token.Or)
+		p.matchWord("replace")
+		return p.parseCreateViewStmt(&ast.CreateViewStmt{StartPos: start.Pos, OrReplace: true})
+	}
+	if p.isWord("incremental") {
+		p.next()
+		p.matchWord("materialized")
+		return p.parseCreateViewStmt(&ast.CreateViewStmt{StartPos: start.Pos, Materialized: true, Incremental: true})
+	}
+	if p.isWord("materialized") {
+		p.next()
+		return p.parseCreateViewStmt(&ast.CreateViewStmt{StartPos: start.Pos, Materialized: true})
+	}
+	if p.isWord("view") {
+		return p.parseCreateViewStmt(&ast.CreateViewStmt{StartPos: start.Pos})
+	}
+	return p.parseCreateTableStmt(start.Pos)
 }
 
-// Parses a column definition in a create table statement.
-func (p *parser) parseColumnDefinitions() []*ast.ColumnDefinition {
-	var columns []*ast.ColumnDefinition
+// Parses the rest of a create view statement, after CREATE [OR REPLACE] or
+// CREATE [INCREMENTAL] MATERIALIZED.
+func (p *parser) parseCreateViewStmt(stmt *ast.CreateViewStmt) *ast.CreateViewStmt {
+	p.matchWord("view")
+	stmt.Name = p.parseIdent()
+	if p.kind() == token.LeftParen {
+		stmt.Columns = p.parseIdentList()
+	}
+	p.match(token.As)
+	stmt.Query = p.parseQueryStmt()
+	return stmt
+}
+
+// Parses a create table statement, after CREATE.
+func (p *parser) parseCreateTableStmt(start token.Pos) *ast.CreateTableStmt {
+	stmt := &ast.CreateTableStmt{StartPos: start, Temporary: p.parseTemporary()}
+	p.match(token.Table)
+	if p.isWord("if") {
+		p.next()
+		p.match(token.Not)
+		p.match(token.Exists)
+		stmt.IfNotExists = true
+	}
+	stmt.Table = p.parseIdent()
+	if p.kind() == token.As {
+		p.skip(token.As)
+		stmt.Query = p.parseQueryStmt()
+		return stmt
+	}
 	p.match(token.LeftParen)
 	for {
-		name := p.parseIdent()
-
-		var dataType token.Kind
 		switch p.kind() {
-		case token.Boolean, token.Integer, token.Number, token.Varchar, token.Timestamp:
-			tok := p.next()
-			dataType = tok.Kind
+		case token.Constraint, token.Primary, token.Unique, token.Check, token.Foreign:
+			stmt.Constraints = append(stmt.Constraints, p.parseTableConstraint())
 		default:
-			p.expected(token.Boolean, token.Integer, token.Number, token.Varchar, token.Timestamp)
+			col, constraints := p.parseColumnDefinition()
+			stmt.Columns = append(stmt.Columns, col)
+			stmt.Constraints = append(stmt.Constraints, constraints...)
 		}
+		if p.kind() != token.Comma {
+			break
+		}
+		p.skip(token.Comma)
+	}
+	p.match(token.RightParen)
+	return stmt
+}
+
+// Parses an optional TEMP or TEMPORARY, which are not reserved words. Returns
+// true if it was present.
+func (p *parser) parseTemporary() bool {
+	if p.isWord("temp") || p.isWord("temporary") {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// Parses a column definition in a create table or alter table statement.
+// Returns the column and the constraints declared as part of it.
+func (p *parser) parseColumnDefinition() (*ast.ColumnDefinition, []*ast.Constraint) {
+	col := &ast.ColumnDefinition{Name: p.parseIdent(), Nullable: true}
+
+	// SERIAL is shorthand for INTEGER NOT NULL AUTO_INCREMENT.
+	if p.isWord("serial") {
+		p.next()
+		col.Type = token.Integer
+		col.Nullable = false
+		col.AutoIncrement = true
+	} else {
+		col.Type = p.parseDataType()
+	}
+
+	return col, p.parseColumnConstraints(col)
+}
 
-		nullable := true
-		if p.kind() == token.Not {
+// Parses the constraints that may follow the type of a column, in any order.
+// Returns the constraints that are not properties of the column itself.
+// AUTO_INCREMENT, GENERATED and IDENTITY are not reserved words.
+func (p *parser) parseColumnConstraints(col *ast.ColumnDefinition) []*ast.Constraint {
+	var constraints []*ast.Constraint
+	for {
+		// A named constraint must be a PRIMARY KEY, UNIQUE, CHECK or REFERENCES
+		// constraint.
+		var name *ast.Ident
+		start := p.pos()
+		if p.kind() == token.Constraint {
+			p.skip(token.Constraint)
+			name = p.parseIdent()
+			if k := p.kind(); k != token.Primary && k != token.Unique && k != token.Check && k != token.References {
+				p.expected(token.Primary, token.Unique, token.Check, token.References)
+			}
+		}
+		switch {
+		case p.kind() == token.Primary, p.kind() == token.Unique, p.kind() == token.Check:
+			c := &ast.Constraint{StartPos: start, Name: name, Kind: p.next().Kind, Columns: []*ast.Ident{col.Name}}
+			switch c.Kind {
+			case token.Primary:
+				p.matchWord("key")
+			case token.Check:
+				c.Check = p.parseCheck()
+			}
+			constraints = append(constraints, c)
+		case p.kind() == token.References:
+			c := &ast.Constraint{StartPos: start, Name: name, Kind: token.Foreign, Columns: []*ast.Ident{col.Name}}
+			p.parseReferences(c)
+			constraints = append(constraints, c)
+		case p.kind() == token.Not:
 			p.skip(token.Not)
 			p.match(token.Null)
-			nullable = false
-		} else if p.kind() == token.Null {
+			col.Nullable = false
+		case p.kind() == token.Null:
 			p.skip(token.Null)
+		case p.kind() == token.Default:
+			if col.DefaultValue != nil {
+				p.errorf("multiple default values specified for column %q", col.Name.Name)
+			}
+			p.skip(token.Default)
+			col.DefaultValue = p.parseExpr()
+		case p.isWord("auto_increment"):
+			p.next()
+			col.Nullable = false
+			col.AutoIncrement = true
+		case p.isWord("generated"):
+			// GENERATED { ALWAYS | BY DEFAULT } AS IDENTITY
+			p.next()
+			if p.kind() == token.By {
+				p.skip(token.By)
+				p.match(token.Default)
+			} else {
+				p.matchWord("always")
+				col.GeneratedAlways = true
+			}
+			p.match(token.As)
+			p.matchWord("identity")
+			col.Nullable = false
+			col.AutoIncrement = true
+		default:
+			return constraints
+		}
+	}
+}
+
+// Parses a table constraint in a create table statement.
+func (p *parser) parseTableConstraint() *ast.Constraint {
+	c := &ast.Constraint{StartPos: p.pos()}
+	if p.kind() == token.Constraint {
+		p.skip(token.Constraint)
+		c.Name = p.parseIdent()
+	}
+	switch p.kind() {
+	case token.Primary, token.Unique:
+		if c.Kind = p.next().Kind; c.Kind == token.Primary {
+			p.matchWord("key")
+		}
+		c.Columns = p.parseIdentList()
+	case token.Check:
+		c.Kind = p.next().Kind
+		c.Check = p.parseCheck()
+	case token.Foreign:
+		c.Kind = p.next().Kind
+		p.matchWord("key")
+		c.Columns = p.parseIdentList()
+		p.parseReferences(c)
+	default:
+		p.expected(token.Primary, token.Unique, token.Check, token.Foreign)
+	}
+	return c
+}
+
+// Parses the REFERENCES clause of a foreign key constraint, including its
+// ON DELETE and ON UPDATE actions, in either order.
+func (p *parser) parseReferences(c *ast.Constraint) {
+	p.match(token.References)
+	c.RefTable = p.parseIdent()
+	if p.kind() == token.LeftParen {
+		c.RefColumns = p.parseIdentList()
+	}
+	for p.kind() == token.On {
+		p.skip(token.On)
+		switch p.kind() {
+		case token.Delete:
+			p.skip(token.Delete)
+			c.OnDelete = p.parseRefAction()
+		case token.Update:
+			p.skip(token.Update)
+			c.OnUpdate = p.parseRefAction()
+		default:
+			p.expected(token.Delete, token.Update)
+		}
+	}
+}
+
+// Parses a referential action. CASCADE, RESTRICT, NO and ACTION are not
+// reserved words.
+func (p *parser) parseRefAction() ast.RefAction {
+	switch {
+	case p.isWord("cascade"):
+		p.next()
+		return ast.Cascade
+	case p.isWord("restrict"):
+		p.next()
+		return ast.Restrict
+	case p.isWord("no"):
+		p.next()
+		p.matchWord("action")
+		return ast.NoAction
+	case p.kind() == token.Set:
+		p.skip(token.Set)
+		if p.kind() == token.Null {
+			p.skip(token.Null)
+			return ast.SetNull
+		}
+		p.match(token.Default)
+		return ast.SetDefault
+	}
+	p.errorf("current token is %q, want a referential action", p.tok().Lit)
+	return ast.NoAction // not reached
+}
+
+// Parses a parenthesized, comma-separated list of identifiers.
+func (p *parser) parseIdentList() []*ast.Ident {
+	p.match(token.LeftParen)
+	idents := []*ast.Ident{p.parseIdent()}
+	for p.kind() == token.Comma {
+		p.skip(token.Comma)
+		idents = append(idents, p.parseIdent())
+	}
+	p.match(token.RightParen)
+	return idents
+}
+
+// Parses the parenthesized condition of a CHECK constraint.
+func (p *parser) parseCheck() ast.Expr {
+	p.match(token.LeftParen)
+	expr := p.parseExpr()
+	p.match(token.RightParen)
+	return expr
+}
+
+// Parses a drop table or drop view statement. IF, CASCADE, MATERIALIZED and
+// VIEW are not reserved words.
+func (p *parser) parseDropStmt() ast.Node {
+	start := p.match(token.Drop)
+	materialized := p.isWord("materialized")
+	if materialized {
+		p.next()
+	}
+	if materialized || p.isWord("view") {
+		p.matchWord("view")
+		stmt := &ast.DropViewStmt{StartPos: start.Pos, Materialized: materialized}
+		stmt.IfExists = p.parseIfExists()
+		stmt.Views = p.parseTableNameList()
+		stmt.Cascade = p.parseDropBehavior()
+		return stmt
+	}
+	p.match(token.Table)
+	stmt := &ast.DropTableStmt{StartPos: start.Pos}
+	stmt.IfExists = p.parseIfExists()
+	stmt.Tables = p.parseTableNameList()
+	stmt.Cascade = p.parseDropBehavior()
+	return stmt
+}
+
+// Parses a refresh materialized view statement. REFRESH and MATERIALIZED are
+// not reserved words.
+func (p *parser) parseRefreshStmt() *ast.RefreshStmt {
+	start := p.next()
+	p.matchWord("materialized")
+	p.matchWord("view")
+	return &ast.RefreshStmt{StartPos: start.Pos, View: p.parseIdent()}
+}
+
+// Parses a transaction control statement: BEGIN, START TRANSACTION, COMMIT,
+// ROLLBACK [TO SAVEPOINT], SAVEPOINT or RELEASE SAVEPOINT. None of the words
+// in these statements are reserved.
+func (p *parser) parseTransactionStmt() ast.Node {
+	start := p.next()
+	switch start.Lit {
+	case "begin":
+		p.skipTransaction()
+		return &ast.BeginStmt{StartPos: start.Pos}
+	case "start":
+		p.matchWord("transaction")
+		return &ast.BeginStmt{StartPos: start.Pos}
+	case "commit":
+		p.skipTransaction()
+		return &ast.CommitStmt{StartPos: start.Pos}
+	case "rollback":
+		p.skipTransaction()
+		stmt := &ast.RollbackStmt{StartPos: start.Pos}
+		if p.isWord("to") {
+			p.next()
+			p.skipWord("savepoint")
+			stmt.Savepoint = p.parseIdent()
+		}
+		return stmt
+	case "savepoint":
+		return &ast.SavepointStmt{StartPos: start.Pos, Name: p.parseIdent()}
+	default: // release
+		p.skipWord("savepoint")
+		return &ast.ReleaseStmt{StartPos: start.Pos, Name: p.parseIdent()}
+	}
+}
+
+// Advances past the optional TRANSACTION or WORK after BEGIN, COMMIT or
+// ROLLBACK.
+func (p *parser) skipTransaction() {
+	if p.isWord("transaction") || p.isWord("work") {
+		p.next()
+	}
+}
+
+// Parses a truncate statement.
+func (p *parser) parseTruncateStmt() *ast.TruncateStmt {
+	start := p.match(token.Truncate)
+	if p.kind() == token.Table {
+		p.skip(token.Table)
+	}
+	return &ast.TruncateStmt{StartPos: start.Pos, Tables: p.parseTableNameList()}
+}
+
+// Parses a comma-separated list of table or view names.
+func (p *parser) parseTableNameList() []*ast.Ident {
+	names := []*ast.Ident{p.parseIdent()}
+	for p.kind() == token.Comma {
+		p.skip(token.Comma)
+		names = append(names, p.parseIdent())
+	}
+	return names
+}
+
+// Parses an optional IF EXISTS clause. Returns true if it was present.
+func (p *parser) parseIfExists() bool {
+	if !p.isWord("if") {
+		return false
+	}
+	p.next()
+	p.match(token.Exists)
+	return true
+}
+
+// Parses an optional CASCADE or RESTRICT. Returns true for CASCADE.
+func (p *parser) parseDropBehavior() bool {
+	switch {
+	case p.isWord("cascade"):
+		p.next()
+		return true
+	case p.isWord("restrict"):
+		p.next()
+	}
+	return false
+}
+
+// Parses an alter table statement, whose subcommands are separated by commas.
+// A RENAME subcommand may not be combined with others.
+func (p *parser) parseAlterTableStmt() *ast.AlterTableStmt {
+	start := p.match(token.Alter)
+	p.match(token.Table)
+	stmt := &ast.AlterTableStmt{StartPos: start.Pos, Table: p.parseIdent()}
+	if p.isWord("rename") {
+		stmt.Cmds = []*ast.AlterTableCmd{p.parseAlterTableCmd()}
+		return stmt
+	}
+	for {
+		if p.isWord("rename") {
+			p.errorf("RENAME cannot be combined with other subcommands")
+		}
+		stmt.Cmds = append(stmt.Cmds, p.parseAlterTableCmd())
+		if p.kind() != token.Comma {
+			return stmt
+		}
+		p.skip(token.Comma)
+	}
+}
+
+// Parses a subcommand of an alter table statement. ADD, COLUMN, RENAME, TO,
+// TYPE and DATA are not reserved words.
+func (p *parser) parseAlterTableCmd() *ast.AlterTableCmd {
+	cmd := &ast.AlterTableCmd{StartPos: p.pos()}
+	switch {
+	case p.isWord("add"):
+		p.next()
+		p.skipWord("column")
+		cmd.Kind = ast.AddColumn
+		if p.isWord("if") {
+			p.next()
+			p.match(token.Not)
+			p.match(token.Exists)
+			cmd.IfExists = true
+		}
+		cmd.Definition, cmd.Constraints = p.parseColumnDefinition()
+	case p.kind() == token.Drop:
+		p.skip(token.Drop)
+		p.skipWord("column")
+		cmd.Kind = ast.DropColumn
+		cmd.IfExists = p.parseIfExists()
+		cmd.Column = p.parseIdent()
+		cmd.Cascade = p.parseDropBehavior()
+	case p.isWord("rename"):
+		p.next()
+		if p.isWord("to") {
+			p.next()
+			cmd.Kind = ast.RenameTable
+			cmd.NewName = p.parseIdent()
+			break
+		}
+		p.skipWord("column")
+		cmd.Kind = ast.RenameColumn
+		cmd.Column = p.parseIdent()
+		p.matchWord("to")
+		cmd.NewName = p.parseIdent()
+	case p.kind() == token.Alter:
+		p.skip(token.Alter)
+		p.skipWord("column")
+		cmd.Column = p.parseIdent()
+		switch {
+		case p.kind() == token.Set:
+			p.skip(token.Set)
+			if p.kind() == token.Not {
+				p.skip(token.Not)
+				p.match(token.Null)
+				cmd.Kind = ast.SetNotNull
+				break
+			}
+			p.matchWord("data")
+			p.matchWord("type")
+			cmd.Kind = ast.AlterColumnType
+			cmd.Type = p.parseDataType()
+		case p.kind() == token.Drop:
+			p.skip(token.Drop)
+			p.match(token.Not)
+			p.match(token.Null)
+			cmd.Kind = ast.DropNotNull
+		default:
+			p.matchWord("type")
+			cmd.Kind = ast.AlterColumnType
+			cmd.Type = p.parseDataType()
 		}
+	default:
+		p.errorf("current token is %q, want ADD, DROP, RENAME or ALTER", p.tok().Lit)
+	}
+	return cmd
+}
 
-		columns = append(columns, &ast.ColumnDefinition{
-			Name:     name,
-			Type:     dataType,
-			Nullable: nullable,
-		})
+// Parses the name of a data type.
+func (p *parser) parseDataType() token.Kind {
+	switch p.kind() {
+	case token.Boolean, token.Integer, token.Number, token.Varchar, token.Timestamp:
+		return p.next().Kind
+	}
+	p.expected(token.Boolean, token.Integer, token.Number, token.Varchar, token.Timestamp)
+	return token.Invalid // not reached
+}
+
+// Parses a query: one or more select statements combined with set operators,
+// followed by optional ORDER BY, LIMIT and OFFSET clauses, which apply to the
+// combined result.
+func (p *parser) parseQueryStmt() ast.QueryStmt {
+	if p.kind() == token.With {
+		return p.parseWithStmt()
+	}
+	query := p.parseCompoundSelectStmt(1)
+	var orderBy []*ast.OrderingTerm
+	if p.kind() == token.Order {
+		p.skip(token.Order)
+		p.match(token.By)
+		orderBy = p.parseOrderingTermList()
+	}
+	var limit, offset ast.Expr
+	if p.kind() == token.Limit {
+		p.skip(token.Limit)
+		limit = p.parseExpr()
+	}
+	if p.kind() == token.Offset {
+		p.skip(token.Offset)
+		offset = p.parseExpr()
+	}
+	switch query := query.(type) {
+	case *ast.SelectStmt:
+		query.OrderBy, query.Limit, query.Offset = orderBy, limit, offset
+	case *ast.CompoundSelectStmt:
+		query.OrderBy, query.Limit, query.Offset = orderBy, limit, offset
+	}
+	return query
+}
+
+// Parses a query preceded by a WITH clause.
+func (p *parser) parseWithStmt() *ast.WithStmt {
+	start := p.match(token.With)
+	stmt := &ast.WithStmt{StartPos: start.Pos}
+	if p.kind() == token.Recursive {
+		p.skip(token.Recursive)
+		stmt.Recursive = true
+	}
+	for {
+		cte := &ast.CommonTableExpr{Name: p.parseIdent()}
+		if p.kind() == token.LeftParen {
+			cte.Columns = p.parseIdentList()
+		}
+		p.match(token.As)
+		p.match(token.LeftParen)
+		cte.Query = p.parseQueryStmt()
+		p.match(token.RightParen)
+		stmt.CTEs = append(stmt.CTEs, cte)
 		if p.kind() != token.Comma {
 			break
 		}
 		p.skip(token.Comma)
 	}
-	p.match(token.RightParen)
-	return columns
+	stmt.Query = p.parseQueryStmt()
+	return stmt
+}
+
+// Reports whether the current token begins a query.
+func (p *parser) atQuery() bool {
+	return p.kind() == token.Select || p.kind() == token.With
+}
+
+// Parses a sequence of select statements combined with set operators, using
+// precedence climbing. INTERSECT binds more tightly than UNION and EXCEPT, which
+// are left-associative.
+func (p *parser) parseCompoundSelectStmt(minPrec int) ast.QueryStmt {
+	var lhs ast.QueryStmt = p.parseSelectStmt()
+	for {
+		prec := setOpPrecedence(p.kind())
+		if prec < minPrec {
+			return lhs
+		}
+		op := p.next()
+		all := false
+		switch p.kind() {
+		case token.All:
+			p.skip(token.All)
+			all = true
+		case token.Distinct:
+			p.skip(token.Distinct) // the default
+		}
+		rhs := p.parseCompoundSelectStmt(prec + 1)
+		lhs = &ast.CompoundSelectStmt{Left: lhs, Op: op.Kind, All: all, Right: rhs}
+	}
+}
+
+// Returns the precedence of a set operator, or zero if k is not one.
+func setOpPrecedence(k token.Kind) int {
+	switch k {
+	case token.Union, token.Except:
+		return 1
+	case token.Intersect:
+		return 2
+	}
+	return 0
 }
 
-// Parses a select statement.
+// Parses a select statement, excluding the ORDER BY, LIMIT and OFFSET clauses;
+// see parseQueryStmt.
 func (p *parser) parseSelectStmt() *ast.SelectStmt {
 	start := p.match(token.Select)
-	columns := p.parseSelectExprList()
-	p.match(token.From)
-	table := p.parseIdent()
+	var distinct bool
+	var distinctOn []ast.Expr
+	if p.kind() == token.Distinct {
+		p.skip(token.Distinct)
+		distinct = true
+		if p.kind() == token.On {
+			p.skip(token.On)
+			p.match(token.LeftParen)
+			distinctOn = p.parseExprList()
+			p.match(token.RightParen)
+		}
+	}
+	columns := p.parseProjection()
+	var into *ast.Ident
+	var intoTemporary bool
+	if p.kind() == token.Into {
+		p.skip(token.Into)
+		intoTemporary = p.parseTemporary()
+		if p.kind() == token.Table {
+			p.skip(token.Table)
+		}
+		into = p.parseIdent()
+	}
+	var table ast.Expr
+	if p.kind() == token.From {
+		p.skip(token.From)
+		table = p.parseFromList()
+	}
 	var where ast.Expr
 	if p.kind() == token.Where {
 		p.skip(token.Where)
 		where = p.parseExpr()
 	}
-	return &ast.SelectStmt{StartPos: start.Pos, Columns: columns, Table: table, Where: where}
+	var groupBy []ast.Expr
+	if p.kind() == token.Group {
+		p.skip(token.Group)
+		p.match(token.By)
+		groupBy = p.parseExprList()
+	}
+	var having ast.Expr
+	if p.kind() == token.Having {
+		p.skip(token.Having)
+		having = p.parseExpr()
+	}
+	var windows []*ast.WindowDef
+	if p.kind() == token.Window {
+		p.skip(token.Window)
+		for {
+			def := &ast.WindowDef{Name: p.parseIdent()}
+			p.match(token.As)
+			def.Spec = p.parseWindowSpec()
+			windows = append(windows, def)
+			if p.kind() != token.Comma {
+				break
+			}
+			p.skip(token.Comma)
+		}
+	}
+	return &ast.SelectStmt{
+		StartPos:   start.Pos,
+		Distinct:   distinct,
+		DistinctOn: distinctOn,
+		Columns:    columns,
+		Table:      table,
+		Where:      where,
+		GroupBy:    groupBy,
+		Having:     having,
+		Windows:    windows,
+
+		Into:          into,
+		IntoTemporary: intoTemporary,
+	}
+}
+
+// Parses the comma-separated list of table expressions in a FROM clause. As in
+// standard SQL, the comma is a cross join that binds less tightly than JOIN.
+func (p *parser) parseFromList() ast.Expr {
+	expr := p.parseTableExpr()
+	for p.kind() == token.Comma {
+		p.skip(token.Comma)
+		expr = &ast.JoinExpr{Left: expr, Kind: token.Cross, Right: p.parseTableExpr()}
+	}
+	return expr
+}
+
+// Parses a table expression: a table, optionally followed by a sequence of
+// joins, which are left-associative.
+func (p *parser) parseTableExpr() ast.Expr {
+	expr := p.parseTablePrimary()
+	for {
+		var kind token.Kind
+		switch p.kind() {
+		case token.Join:
+			kind = token.Inner
+		case token.Inner, token.Cross:
+			kind = p.next().Kind
+		case token.Left, token.Right, token.Full:
+			kind = p.next().Kind
+			if p.kind() == token.Outer {
+				p.skip(token.Outer)
+			}
+		default:
+			return expr
+		}
+		p.match(token.Join)
+		join := &ast.JoinExpr{Left: expr, Kind: kind, Right: p.parseTablePrimary()}
+		if kind != token.Cross {
+			p.match(token.On)
+			join.On = p.parseExpr()
+		}
+		expr = join
+	}
+}
+
+// Parses a table name or a parenthesized table expression, either of which may
+// be followed by an alias.
+func (p *parser) parseTablePrimary() ast.Expr {
+	var expr ast.Expr
+	if p.kind() == token.LeftParen {
+		tok := p.next()
+		if p.atQuery() {
+			expr = &ast.SubqueryExpr{StartPos: tok.Pos, Select: p.parseQueryStmt()}
+		} else {
+			expr = p.parseTableExpr()
+		}
+		p.match(token.RightParen)
+	} else {
+		expr = p.parseIdent()
+	}
+	if p.kind() == token.As {
+		p.skip(token.As)
+		return &ast.AliasedTableExpr{Expr: expr, Alias: p.parseIdent()}
+	}
+	if p.kind() == token.Ident {
+		return &ast.AliasedTableExpr{Expr: expr, Alias: p.parseIdent()}
+	}
+	return expr
+}
+
+// Parses a comma-separated list of sort keys in an ORDER BY clause.
+func (p *parser) parseOrderingTermList() []*ast.OrderingTerm {
+	terms := []*ast.OrderingTerm{p.parseOrderingTerm()}
+	for p.kind() == token.Comma {
+		p.skip(token.Comma)
+		terms = append(terms, p.parseOrderingTerm())
+	}
+	return terms
+}
+
+// Parses a single sort key: an expression optionally followed by ASC or DESC,
+// then optionally by NULLS FIRST or NULLS LAST. As in PostgreSQL, nulls sort
+// as if larger than any other value unless specified otherwise. N.B. NULLS,
+// FIRST and LAST are not reserved words, so we match them as identifiers.
+func (p *parser) parseOrderingTerm() *ast.OrderingTerm {
+	term := &ast.OrderingTerm{Expr: p.parseExpr()}
+	switch p.kind() {
+	case token.Asc:
+		p.skip(token.Asc)
+	case token.Desc:
+		p.skip(token.Desc)
+		term.Desc = true
+	}
+	term.NullsFirst = term.Desc
+	if p.isWord("nulls") {
+		p.skip(token.Ident)
+		switch {
+		case p.isWord("first"):
+			term.NullsFirst = true
+		case p.isWord("last"):
+			term.NullsFirst = false
+		default:
+			p.errorf("expected FIRST or LAST after NULLS")
+		}
+		p.skip(token.Ident)
+	}
+	return term
 }
 
 // Parses an insert statement.
 func (p *parser) parseInsertStmt() *ast.InsertStmt {
 	start := p.match(token.Insert)
 	p.match(token.Into)
-	table := p.parseIdent()
-	var columns []*ast.Ident
+	stmt := &ast.InsertStmt{StartPos: start.Pos, Table: p.parseIdent()}
 	if p.kind() == token.LeftParen {
-		p.skip(token.LeftParen)
-		columns = append(columns, p.parseIdent())
+		stmt.Columns = p.parseIdentList()
+	}
+	if p.atQuery() {
+		stmt.Query = p.parseQueryStmt()
+	} else {
+		p.match(token.Values)
+		stmt.Values = append(stmt.Values, p.parseValuesRow())
 		for p.kind() == token.Comma {
 			p.skip(token.Comma)
-			columns = append(columns, p.parseIdent())
+			stmt.Values = append(stmt.Values, p.parseValuesRow())
 		}
-		p.match(token.RightParen)
 	}
-	p.match(token.Values)
+	if p.kind() == token.On {
+		stmt.OnConflict = p.parseOnConflict()
+	}
+	stmt.Returning = p.parseReturning()
+	return stmt
+}
+
+// Parses the ON CONFLICT clause of an insert statement. CONFLICT, DO and
+// NOTHING are not reserved words.
+func (p *parser) parseOnConflict() *ast.OnConflict {
+	start := p.match(token.On)
+	p.matchWord("conflict")
+	clause := &ast.OnConflict{StartPos: start.Pos}
+	if p.kind() == token.LeftParen {
+		clause.Columns = p.parseIdentList()
+	}
+	p.matchWord("do")
+	if p.isWord("nothing") {
+		p.next()
+		return clause
+	}
+	if len(clause.Columns) == 0 {
+		p.errorf("ON CONFLICT DO UPDATE requires a conflict target")
+	}
+	p.match(token.Update)
+	p.match(token.Set)
+	clause.DoUpdate = true
+	for {
+		clause.Set = append(clause.Set, p.parseIdent())
+		p.match(token.Equal)
+		clause.Values = append(clause.Values, p.parseExprOrDefault())
+		if p.kind() != token.Comma {
+			break
+		}
+		p.skip(token.Comma)
+	}
+	if p.kind() == token.Where {
+		p.skip(token.Where)
+		clause.Where = p.parseExpr()
+	}
+	return clause
+}
+
+// Parses one parenthesized row of the VALUES list of an insert statement.
+func (p *parser) parseValuesRow() []ast.Expr {
 	p.match(token.LeftParen)
-	values := p.parseExprList()
+	var values []ast.Expr
+	for {
+		values = append(values, p.parseExprOrDefault())
+		if p.kind() != token.Comma {
+			break
+		}
+		p.skip(token.Comma)
+	}
 	p.match(token.RightParen)
-	return &ast.InsertStmt{StartPos: start.Pos, Table: table, Columns: columns, Values: values}
+	return values
+}
+
+// Parses an expression, or the DEFAULT keyword, which may stand in for an
+// expression in the VALUES list of an insert statement and in SET clauses.
+func (p *parser) parseExprOrDefault() ast.Expr {
+	if p.kind() == token.Default {
+		return &ast.Default{ValuePos: p.next().Pos}
+	}
+	return p.parseExpr()
+}
+
+// Parses the optional RETURNING clause of an insert, update or delete
+// statement.
+func (p *parser) parseReturning() []ast.Expr {
+	if p.kind() != token.Returning {
+		return nil
+	}
+	p.skip(token.Returning)
+	return p.parseProjection()
 }
 
 // Parses an update statement.
@@ -173,12 +955,12 @@ func (p *parser) parseUpdateStmt() *ast.UpdateStmt {
 	)
 	columns = append(columns, p.parseIdent())
 	p.match(token.Equal)
-	values = append(values, p.parseExpr())
+	values = append(values, p.parseExprOrDefault())
 	for p.kind() == token.Comma {
 		p.skip(token.Comma)
 		columns = append(columns, p.parseIdent())
 		p.match(token.Equal)
-		values = append(values, p.parseExpr())
+		values = append(values, p.parseExprOrDefault())
 	}
 	// See N.B. above.
 	if closeParen {
@@ -189,7 +971,7 @@ func (p *parser) parseUpdateStmt() *ast.UpdateStmt {
 		p.skip(token.Where)
 		where = p.parseExpr()
 	}
-	return &ast.UpdateStmt{StartPos: start.Pos, Table: table, Columns: columns, Values: values, Where: where}
+	return &ast.UpdateStmt{StartPos: start.Pos, Table: table, Columns: columns, Values: values, Where: where, Returning: p.parseReturning()}
 }
 
 // Parses a delete statement.
@@ -202,11 +984,34 @@ func (p *parser) parseDeleteStmt() *ast.DeleteStmt {
 		p.skip(token.Where)
 		where = p.parseExpr()
 	}
-	return &ast.DeleteStmt{StartPos: start.Pos, Table: table, Where: where}
+	return &ast.DeleteStmt{StartPos: start.Pos, Table: table, Where: where, Returning: p.parseReturning()}
+}
+
+// Parses the projection of a SELECT statement, in which each expression may be
+// followed by an alias, with or without AS.
+func (p *parser) parseProjection() []ast.Expr {
+	var exprs []ast.Expr
+	for {
+		expr := p.parseExprOrStar()
+		if _, isStar := expr.(*ast.SelectStarExpr); !isStar {
+			switch p.kind() {
+			case token.As:
+				p.skip(token.As)
+				expr = &ast.AliasedExpr{Expr: expr, Alias: p.parseIdent()}
+			case token.Ident:
+				expr = &ast.AliasedExpr{Expr: expr, Alias: p.parseIdent()}
+			}
+		}
+		exprs = append(exprs, expr)
+		if p.kind() != token.Comma {
+			return exprs
+		}
+		p.skip(token.Comma)
+	}
 }
 
-// Parses a comma-separated list of expressions in the projection of a SELECT
-// statement. The difference between this and parseExprList is that
+// Parses a comma-separated list of expressions, such as the arguments of a
+// function call. The difference between this and parseExprList is that
 // parseSelectExprList interprets the "*" token to mean all column names.
 func (p *parser) parseSelectExprList() []ast.Expr {
 	exprs := []ast.Expr{p.parseExprOrStar()}
@@ -220,8 +1025,8 @@ func (p *parser) parseSelectExprList() []ast.Expr {
 // Parses a single expression or a "*" operator.
 func (p *parser) parseExprOrStar() ast.Expr {
 	if p.kind() == token.Mul {
-		p.skip(token.Mul)
-		return &ast.SelectStarExpr{}
+		tok := p.next()
+		return &ast.SelectStarExpr{StartPos: tok.Pos}
 	}
 	return p.parseBinaryExpr(1)
 }
@@ -256,28 +1061,148 @@ func (p *parser) parseBinaryExpr(minPrec int) ast.Expr {
 		if opPrec < minPrec {
 			return expr
 		}
+		if op == token.Is {
+			expr = p.parseIsExpr(expr)
+			continue
+		}
+		notPos := p.pos()
 		p.skip(op)
-		rhs := p.parseBinaryExpr(opPrec + 1)
-		expr = &ast.BinaryExpr{Lhs: expr, Op: op, Rhs: rhs}
+		// "x NOT IN y" is shorthand for "NOT (x IN y)", and likewise for the
+		// other predicates that may be negated this way.
+		negate := false
+		if op == token.Not {
+			negate = true
+			op = p.kind()
+			switch op {
+			case token.In, token.Like, token.Ilike, token.Between:
+			default:
+				p.expected(token.In, token.Like, token.Ilike, token.Between)
+			}
+			p.skip(op)
+		}
+		switch op {
+		case token.In:
+			expr = &ast.BinaryExpr{Lhs: expr, Op: op, Rhs: p.parseInList()}
+		case token.Like, token.Ilike:
+			like := &ast.LikeExpr{Expr: expr, Op: op, Pattern: p.parseBinaryExpr(opPrec + 1)}
+			if p.kind() == token.Escape {
+				p.skip(token.Escape)
+				like.Escape = p.parseBinaryExpr(opPrec + 1)
+			}
+			expr = like
+		case token.Between:
+			// The bounds bind more tightly than the AND that separates them.
+			between := &ast.BetweenExpr{Expr: expr, Low: p.parseBinaryExpr(opPrec + 1)}
+			p.match(token.And)
+			between.High = p.parseBinaryExpr(opPrec + 1)
+			expr = between
+		default:
+			rhs := p.parseBinaryExpr(opPrec + 1)
+			expr = &ast.BinaryExpr{Lhs: expr, Op: op, Rhs: rhs}
+		}
+		if negate {
+			expr = &ast.UnaryExpr{StartPos: notPos, Op: token.Not, Expr: expr}
+		}
+	}
+}
+
+// Parses the right-hand operand of IN: either a subquery or a parenthesized
+// list of expressions.
+func (p *parser) parseInList() ast.Expr {
+	start := p.match(token.LeftParen)
+	if p.atQuery() {
+		stmt := p.parseQueryStmt()
+		p.match(token.RightParen)
+		return &ast.SubqueryExpr{StartPos: start.Pos, Select: stmt}
+	}
+	exprs := p.parseExprList()
+	p.match(token.RightParen)
+	return &ast.TupleExpr{StartPos: start.Pos, Exprs: exprs}
+}
+
+// Parses the remainder of an "IS [NOT] ..." predicate whose left-hand operand
+// has already been parsed.
+func (p *parser) parseIsExpr(lhs ast.Expr) *ast.IsExpr {
+	p.match(token.Is)
+	expr := &ast.IsExpr{Expr: lhs}
+	if p.kind() == token.Not {
+		p.skip(token.Not)
+		expr.Not = true
+	}
+	switch p.kind() {
+	case token.Null, token.True, token.False, token.Unknown:
+		expr.Kind = p.next().Kind
+	case token.Distinct:
+		expr.Kind = p.next().Kind
+		p.match(token.From)
+		expr.From = p.parseBinaryExpr(token.Is.Precedence() + 1)
+	default:
+		p.expected(token.Null, token.True, token.False, token.Unknown, token.Distinct)
 	}
+	return expr
 }
 
-// Parses a unary expression.
+// Parses a parenthesized select statement.
+func (p *parser) parseSubquery() *ast.SubqueryExpr {
+	start := p.match(token.LeftParen)
+	stmt := p.parseQueryStmt()
+	p.match(token.RightParen)
+	return &ast.SubqueryExpr{StartPos: start.Pos, Select: stmt}
+}
+
+// Parses a unary expression, including any "::type" suffixes.
 func (p *parser) parseUnaryExpr() ast.Expr {
+	expr := p.parseOperand()
+	for p.kind() == token.DoubleColon {
+		p.skip(token.DoubleColon)
+		expr = &ast.CastExpr{StartPos: expr.Pos(), Expr: expr, Type: p.parseDataType()}
+	}
+	return expr
+}
+
+// Parses an operand of a binary or unary expression.
+func (p *parser) parseOperand() ast.Expr {
 	switch p.kind() {
 	case token.LeftParen:
-		p.skip(token.LeftParen)
+		tok := p.next()
+		if p.atQuery() {
+			stmt := p.parseQueryStmt()
+			p.match(token.RightParen)
+			return &ast.SubqueryExpr{StartPos: tok.Pos, Select: stmt}
+		}
 		e := p.parseExpr()
 		p.match(token.RightParen)
 		return e
+	case token.Not:
+		// NOT binds less tightly than comparison operators.
+		tok := p.next()
+		return &ast.UnaryExpr{StartPos: tok.Pos, Op: tok.Kind, Expr: p.parseBinaryExpr(token.Not.Precedence())}
+	case token.Case:
+		return p.parseCaseExpr()
+	case token.Cast:
+		tok := p.next()
+		p.match(token.LeftParen)
+		expr := p.parseExpr()
+		p.match(token.As)
+		dataType := p.parseDataType()
+		p.match(token.RightParen)
+		return &ast.CastExpr{StartPos: tok.Pos, Expr: expr, Type: dataType}
+	case token.Exists:
+		tok := p.next()
+		return &ast.UnaryExpr{StartPos: tok.Pos, Op: tok.Kind, Expr: p.parseSubquery()}
 	case token.Ident:
 		tok := p.next()
+		if p.kind() == token.Dot {
+			p.skip(token.Dot)
+			table := &ast.Ident{NamePos: tok.Pos, Name: tok.Lit}
+			if p.kind() == token.Mul {
+				p.skip(token.Mul)
+				return &ast.SelectStarExpr{StartPos: tok.Pos, Table: table}
+			}
+			return &ast.QualifiedIdent{Table: table, Name: p.parseIdent()}
+		}
 		if p.kind() == token.LeftParen {
-			p.skip(token.LeftParen)
-			funcName := &ast.Ident{NamePos: tok.Pos, Name: tok.Lit}
-			funcArgs := p.parseSelectExprList()
-			p.match(token.RightParen)
-			return &ast.FunctionCall{Name: funcName, Args: funcArgs}
+			return p.parseFunctionCall(&ast.Ident{NamePos: tok.Pos, Name: tok.Lit})
 		}
 		return &ast.Ident{NamePos: tok.Pos, Name: tok.Lit}
 	case token.Plus, token.Minus:
@@ -302,6 +1227,132 @@ func (p *parser) parseUnaryExpr() ast.Expr {
 	return nil // can't get here
 }
 
+// Parses the parenthesized arguments of a function call, which may begin with
+// DISTINCT and be followed by a FILTER clause.
+func (p *parser) parseFunctionCall(name *ast.Ident) *ast.FunctionCall {
+	call := &ast.FunctionCall{Name: name}
+	p.match(token.LeftParen)
+	if p.kind() == token.Distinct {
+		p.skip(token.Distinct)
+		call.Distinct = true
+	}
+	if p.kind() != token.RightParen {
+		call.Args = p.parseSelectExprList()
+	}
+	p.match(token.RightParen)
+	if p.isWord("filter") {
+		p.next()
+		p.match(token.LeftParen)
+		p.match(token.Where)
+		call.Filter = p.parseExpr()
+		p.match(token.RightParen)
+	}
+	if p.kind() == token.Over {
+		p.skip(token.Over)
+		if p.kind() == token.Ident {
+			name := p.parseIdent()
+			call.Over = &ast.WindowSpec{StartPos: name.Pos(), Name: name}
+		} else {
+			call.Over = p.parseWindowSpec()
+		}
+	}
+	return call
+}
+
+// Parses a parenthesized window specification, which may begin with the name
+// of a window on which it is based.
+func (p *parser) parseWindowSpec() *ast.WindowSpec {
+	start := p.match(token.LeftParen)
+	spec := &ast.WindowSpec{StartPos: start.Pos}
+	if p.kind() == token.Ident && !p.isWord("partition") && !p.isWord("rows") && !p.isWord("range") {
+		spec.Name = p.parseIdent()
+	}
+	if p.isWord("partition") {
+		p.next()
+		p.match(token.By)
+		spec.PartitionBy = p.parseExprList()
+	}
+	if p.kind() == token.Order {
+		p.skip(token.Order)
+		p.match(token.By)
+		spec.OrderBy = p.parseOrderingTermList()
+	}
+	if p.isWord("rows") || p.isWord("range") {
+		tok := p.next()
+		frame := &ast.WindowFrame{StartPos: tok.Pos, Range: tok.Lit == "range"}
+		if p.kind() == token.Between {
+			p.skip(token.Between)
+			frame.Start = p.parseFrameBound()
+			p.match(token.And)
+			frame.End = p.parseFrameBound()
+		} else {
+			frame.Start = p.parseFrameBound()
+			frame.End = &ast.FrameBound{StartPos: frame.Start.Pos(), Kind: ast.CurrentRow}
+		}
+		spec.Frame = frame
+	}
+	p.match(token.RightParen)
+	return spec
+}
+
+// Parses the start or end of a window frame.
+func (p *parser) parseFrameBound() *ast.FrameBound {
+	bound := &ast.FrameBound{StartPos: p.pos()}
+	if p.isWord("current") {
+		p.next()
+		p.matchWord("row")
+		bound.Kind = ast.CurrentRow
+		return bound
+	}
+	unbounded := p.isWord("unbounded")
+	if unbounded {
+		p.next()
+	} else {
+		bound.Offset = p.parseExpr()
+	}
+	preceding := p.isWord("preceding")
+	if !preceding && !p.isWord("following") {
+		p.errorf("current token is %q, want PRECEDING or FOLLOWING", p.tok().Lit)
+	}
+	p.next()
+	switch {
+	case unbounded && preceding:
+		bound.Kind = ast.UnboundedPreceding
+	case unbounded:
+		bound.Kind = ast.UnboundedFollowing
+	case preceding:
+		bound.Kind = ast.Preceding
+	default:
+		bound.Kind = ast.Following
+	}
+	return bound
+}
+
+// Parses a CASE expression, either searched or simple.
+func (p *parser) parseCaseExpr() *ast.CaseExpr {
+	start := p.match(token.Case)
+	expr := &ast.CaseExpr{StartPos: start.Pos}
+	if p.kind() != token.When {
+		expr.Operand = p.parseExpr()
+	}
+	for {
+		p.match(token.When)
+		when := &ast.WhenClause{Cond: p.parseExpr()}
+		p.match(token.Then)
+		when.Result = p.parseExpr()
+		expr.Whens = append(expr.Whens, when)
+		if p.kind() != token.When {
+			break
+		}
+	}
+	if p.kind() == token.Else {
+		p.skip(token.Else)
+		expr.Else = p.parseExpr()
+	}
+	p.match(token.End)
+	return expr
+}
+
 // Parses a number from a string, as either an int64 or a float64.
 func (p *parser) parseNumberLiteral() ast.Expr {
 	tok := p.match(token.NumberLiteral)
@@ -315,6 +1366,29 @@ func (p *parser) parseNumberLiteral() ast.Expr {
 	return &ast.IntegerLiteral{ValuePos: tok.Pos, Value: n}
 }
 
+// Reports whether the current token is an identifier with the given name. Use
+// this to match non-reserved keywords.
+func (p *parser) isWord(name string) bool {
+	return p.kind() == token.Ident && p.tok().Lit == name
+}
+
+// Advances past an identifier with the given name, which is a non-reserved
+// keyword. Panics if the current token is not that identifier.
+func (p *parser) matchWord(name string) {
+	if !p.isWord(name) {
+		p.errorf("current token is %q, want %s", p.tok().Lit, strings.ToUpper(name))
+	}
+	p.next()
+}
+
+// Advances past an identifier with the given name, which is an optional
+// non-reserved keyword, if it is the current token.
+func (p *parser) skipWord(name string) {
+	if p.isWord(name) {
+		p.next()
+	}
+}
+
 // Advances past the specified token. It is a runtime error to call this method
 // when the current token does *not* have the specified kind.
 func (p *parser) skip(k token.Kind) {
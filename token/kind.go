@@ -7,47 +7,103 @@ type Kind uint8
 
 const (
 	Invalid Kind = iota
+	All
+	Alter
 	And
+	As
+	Asc
+	Between
 	Boolean
+	By
+	Case
+	Cast
+	Check
 	Comma
 	Concat
+	Constraint
 	Create
+	Cross
+	Default
 	Delete
+	Desc
+	Distinct
 	Div
 	Dot
+	DoubleColon
+	Drop
+	Else
+	End
 	Equal
+	Escape
+	Except
+	Exists
 	False
+	Foreign
 	From
+	Full
 	GreaterThan
 	GreaterThanOrEqualTo
+	Group
+	Having
 	Ident
+	Ilike
+	In
+	Inner
 	Insert
 	Integer
+	Intersect
 	Into
+	Is
+	Join
+	Left
 	LeftParen
 	LessThan
 	LessThanOrEqualTo
+	Like
+	Limit
 	Minus
 	Mul
 	Not
 	NotEqual
+	NotRegexIMatch
+	NotRegexMatch
 	Null
 	Number
 	NumberLiteral
+	Offset
+	On
 	Or
+	Order
+	Outer
+	Over
 	Plus
+	Primary
+	Recursive
+	References
+	RegexIMatch
+	RegexMatch
+	Returning
+	Right
 	RightParen
 	Select
 	Semicolon
 	Set
 	StringLiteral
 	Table
+	Then
 	Timestamp
 	True
+	Truncate
+	Union
+	Unique
+	Unknown
 	Update
 	Values
 	Varchar
+	When
 	Where
+	Window
+	With
 )
 
 func (k Kind) Precedence() int {
@@ -56,7 +112,8 @@ func (k Kind) Precedence() int {
 		return 1
 	case And:
 		return 2
-	case Equal, NotEqual, LessThan, LessThanOrEqualTo, GreaterThan, GreaterThanOrEqualTo:
+	case Equal, NotEqual, LessThan, LessThanOrEqualTo, GreaterThan, GreaterThanOrEqualTo, In, Is, Not,
+		Like, Ilike, Between, RegexMatch, RegexIMatch, NotRegexMatch, NotRegexIMatch:
 		return 3
 	case Plus, Minus, Concat:
 		return 4
@@ -71,46 +128,114 @@ func (k Kind) String() string {
 	switch k {
 	case Invalid:
 		return "Invalid"
+	case All:
+		return "ALL"
+	case Alter:
+		return "ALTER"
 	case And:
 		return "AND"
+	case As:
+		return "AS"
+	case Asc:
+		return "ASC"
+	case Between:
+		return "BETWEEN"
 	case Boolean:
 		return "BOOLEAN"
+	case By:
+		return "BY"
+	case Case:
+		return "CASE"
+	case Cast:
+		return "CAST"
+	case Check:
+		return "CHECK"
 	case Comma:
 		return ","
 	case Concat:
 		return "||"
+	case Constraint:
+		return "CONSTRAINT"
 	case Create:
 		return "CREATE"
+	case Cross:
+		return "CROSS"
+	case Default:
+		return "DEFAULT"
 	case Delete:
 		return "DELETE"
+	case Desc:
+		return "DESC"
+	case Distinct:
+		return "DISTINCT"
 	case Div:
 		return "/"
 	case Dot:
 		return "."
+	case DoubleColon:
+		return "::"
+	case Drop:
+		return "DROP"
+	case Else:
+		return "ELSE"
+	case End:
+		return "END"
 	case Equal:
 		return "="
+	case Escape:
+		return "ESCAPE"
+	case Except:
+		return "EXCEPT"
+	case Exists:
+		return "EXISTS"
 	case False:
 		return "FALSE"
+	case Foreign:
+		return "FOREIGN"
 	case From:
 		return "FROM"
+	case Full:
+		return "FULL"
 	case GreaterThan:
 		return ">"
 	case GreaterThanOrEqualTo:
 		return ">="
+	case Group:
+		return "GROUP"
+	case Having:
+		return "HAVING"
 	case Ident:
 		return "Ident"
+	case Ilike:
+		return "ILIKE"
+	case In:
+		return "IN"
+	case Inner:
+		return "INNER"
 	case Insert:
 		return "INSERT"
 	case Integer:
 		return "INTEGER"
+	case Intersect:
+		return "INTERSECT"
 	case Into:
 		return "INTO"
+	case Is:
+		return "IS"
+	case Join:
+		return "JOIN"
+	case Left:
+		return "LEFT"
 	case LeftParen:
 		return "("
 	case LessThan:
 		return "<"
 	case LessThanOrEqualTo:
 		return "<="
+	case Like:
+		return "LIKE"
+	case Limit:
+		return "LIMIT"
 	case Minus:
 		return "-"
 	case Mul:
@@ -119,16 +244,44 @@ func (k Kind) String() string {
 		return "NOT"
 	case NotEqual:
 		return "!="
+	case NotRegexIMatch:
+		return "!~*"
+	case NotRegexMatch:
+		return "!~"
 	case Null:
 		return "NULL"
 	case Number:
 		return "NUMBER"
 	case NumberLiteral:
 		return "NumberLiteral"
+	case Offset:
+		return "OFFSET"
+	case On:
+		return "ON"
 	case Or:
 		return "OR"
+	case Order:
+		return "ORDER"
+	case Outer:
+		return "OUTER"
+	case Over:
+		return "OVER"
 	case Plus:
 		return "+"
+	case Primary:
+		return "PRIMARY"
+	case Recursive:
+		return "RECURSIVE"
+	case References:
+		return "REFERENCES"
+	case RegexIMatch:
+		return "~*"
+	case RegexMatch:
+		return "~"
+	case Returning:
+		return "RETURNING"
+	case Right:
+		return "RIGHT"
 	case RightParen:
 		return ")"
 	case Select:
@@ -141,18 +294,34 @@ func (k Kind) String() string {
 		return "StringLiteral"
 	case Table:
 		return "TABLE"
+	case Then:
+		return "THEN"
 	case Timestamp:
 		return "TIMESTAMP"
 	case True:
 		return "TRUE"
+	case Truncate:
+		return "TRUNCATE"
+	case Union:
+		return "UNION"
+	case Unique:
+		return "UNIQUE"
+	case Unknown:
+		return "UNKNOWN"
 	case Update:
 		return "UPDATE"
 	case Values:
 		return "VALUES"
 	case Varchar:
 		return "VARCHAR"
+	case When:
+		return "WHEN"
 	case Where:
 		return "WHERE"
+	case Window:
+		return "WINDOW"
+	case With:
+		return "WITH"
 	}
 	panic(fmt.Sprintf("unknown token.Kind: %d", k))
 }